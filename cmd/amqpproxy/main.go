@@ -26,7 +26,7 @@ func newAMQPProxyCommand(ctx context.Context) *cobra.Command {
 	internal.AddCommonFlags(cmd)
 
 	disableStateTracking := cmd.Flags().Bool("disable-state-tracing", false, "Disables state tracing - useful if you are experiencing problems or intentionally creating invalid AMQP traffic but still want logging.")
-	disableTLS := cmd.Flags().Bool("disable-tls", false, "Disables TLS for the local endpoint ONLY. All traffic is still sent, via TLS, to Azure.")
+	disableTLS := cmd.Flags().Bool("disable-tls", false, "Disables TLS for the local endpoint ONLY. Traffic to the remote host still uses TLS, unless --"+internal.DisableRemoteTLSFlagName+" is also set.")
 	enableBinFiles := cmd.Flags().Bool("enable-bin-files", false, "Enables writing out amqpproxy-bin files. These files do NOT redact secrets")
 
 	cmd.RunE = func(cmd *cobra.Command, args []string) error {
@@ -50,12 +50,13 @@ func newAMQPProxyCommand(ctx context.Context) *cobra.Command {
 			"localhost:5671",
 			cf.Host,
 			&amqpproxy.AMQPProxyOptions{
-				BaseJSONName:               filepath.Join(cf.LogsDir, "amqpproxy-traffic"),
-				TLSKeyLogFile:              filepath.Join(cf.LogsDir, "amqpproxy-tlskeys.txt"),
-				BaseBinName:                baseBinName,
-				DisableTLSForLocalEndpoint: *disableTLS,
-				DisableStateTracing:        *disableStateTracking,
-				CertDir:                    cf.CertDir,
+				BaseJSONName:                filepath.Join(cf.LogsDir, "amqpproxy-traffic"),
+				TLSKeyLogFile:               filepath.Join(cf.LogsDir, "amqpproxy-tlskeys.txt"),
+				BaseBinName:                 baseBinName,
+				DisableTLSForLocalEndpoint:  *disableTLS,
+				DisableTLSForRemoteEndpoint: cf.DisableRemoteTLS,
+				DisableStateTracing:         *disableStateTracking,
+				CertDir:                     cf.CertDir,
 			})
 
 		if err != nil {
@@ -2,8 +2,12 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math"
+	"path"
 	"path/filepath"
 	"time"
 
@@ -11,10 +15,14 @@ import (
 	"github.com/richardpark-msft/amqpfaultinjector/internal/faultinjectors"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
 	"github.com/spf13/cobra"
 )
 
 const addressFileFlagName = "address-file"
+const disableTLSFlagName = "disable-tls"
+const controlAddressFlagName = "control-address"
 
 func newRootCommand() *cobra.Command {
 	rootCmd := &cobra.Command{
@@ -22,12 +30,29 @@ func newRootCommand() *cobra.Command {
 	}
 
 	rootCmd.PersistentFlags().String(addressFileFlagName, "", "File to write the address the faultinjector is listening on. If enabled, the faultinjector will start on a random port, instead of 5671.")
+	rootCmd.PersistentFlags().Bool(disableTLSFlagName, false, "Disables TLS for the local endpoint ONLY. Traffic to the remote host still uses TLS, unless --"+internal.DisableRemoteTLSFlagName+" is also set.")
+	rootCmd.PersistentFlags().String(controlAddressFlagName, "", "Address for the HTTP control API, which can change faults while the faultinjector is running (ex: localhost:5680). Disabled if empty.")
 
 	internal.AddCommonFlags(rootCmd)
 	return rootCmd
 }
 
+// runFaultInjector runs the fault injector, using the same injector for every connection.
 func runFaultInjector(ctx context.Context, cmd *cobra.Command, injector faultinjectors.MirrorCallback) error {
+	return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+		return injector
+	}, nil)
+}
+
+// runFaultInjectorPerConnection runs the fault injector, creating a new injector for each connection, using factory.
+//   - configure, if set, lets the control API reconfigure the injector. See [faultinjectors.FaultInjectorOptions.ConfigureInjector].
+func runFaultInjectorPerConnection(ctx context.Context, cmd *cobra.Command, factory faultinjectors.MirrorCallbackFactory, configure faultinjectors.InjectorConfigurer) error {
+	return runFaultInjectorWithOptions(ctx, cmd, factory, configure, nil)
+}
+
+// runFaultInjectorWithOptions is [runFaultInjectorPerConnection], but lets the command set its own options.
+//   - customize, if set, changes the options before the fault injector is created (ex: to set [faultinjectors.FaultInjectorOptions.Shaping]).
+func runFaultInjectorWithOptions(ctx context.Context, cmd *cobra.Command, factory faultinjectors.MirrorCallbackFactory, configure faultinjectors.InjectorConfigurer, customize func(options *faultinjectors.FaultInjectorOptions)) error {
 	port := 5671
 
 	addressFile, err := cmd.Flags().GetString(addressFileFlagName)
@@ -41,22 +66,40 @@ func runFaultInjector(ctx context.Context, cmd *cobra.Command, injector faultinj
 		port = 0
 	}
 
+	disableTLS, err := cmd.Flags().GetBool(disableTLSFlagName)
+
+	if err != nil {
+		return err
+	}
+
+	controlAddress, err := cmd.Flags().GetString(controlAddressFlagName)
+
+	if err != nil {
+		return err
+	}
+
 	cf, err := internal.ExtractCommonFlags(cmd)
 
 	if err != nil {
 		return err
 	}
 
-	fi, err := faultinjectors.NewFaultInjector(
-		fmt.Sprintf("localhost:%d", port),
-		cf.Host,
-		injector,
-		&faultinjectors.FaultInjectorOptions{
-			JSONLFile:     filepath.Join(cf.LogsDir, "faultinjector-traffic.json"),
-			TLSKeyLogFile: filepath.Join(cf.LogsDir, "faultinjector-tlskeys.txt"),
-			AddressFile:   addressFile,
-			CertDir:       cf.CertDir,
-		})
+	options := &faultinjectors.FaultInjectorOptions{
+		JSONLFile:                   filepath.Join(cf.LogsDir, "faultinjector-traffic.json"),
+		TLSKeyLogFile:               filepath.Join(cf.LogsDir, "faultinjector-tlskeys.txt"),
+		AddressFile:                 addressFile,
+		CertDir:                     cf.CertDir,
+		DisableTLSForLocalEndpoint:  disableTLS,
+		DisableTLSForRemoteEndpoint: cf.DisableRemoteTLS,
+		ControlEndpoint:             controlAddress,
+		ConfigureInjector:           configure,
+	}
+
+	if customize != nil {
+		customize(options)
+	}
+
+	fi, err := faultinjectors.NewFaultInjectorWithFactory(fmt.Sprintf("localhost:%d", port), cf.Host, factory, options)
 
 	if err != nil {
 		return err
@@ -76,6 +119,49 @@ func runFaultInjector(ctx context.Context, cmd *cobra.Command, injector faultinj
 	return fi.ListenAndServe()
 }
 
+// validateGlob checks a glob flag (see [path.Match]), so a bad pattern fails the command, instead of the
+// injector, when the first client connects.
+func validateGlob(flagName string, glob string) error {
+	if _, err := path.Match(glob, ""); err != nil {
+		return fmt.Errorf("invalid --%s %q: %w", flagName, glob, err)
+	}
+
+	return nil
+}
+
+func newRejectAttachCommand(ctx context.Context) *cobra.Command {
+	var address *string
+	var rejectErrorCond *string
+	var rejectErrorDesc *string
+
+	cmd := &cobra.Command{
+		Use:   "reject_attach",
+		Short: "Rejects links, without sending their ATTACH to the service. Useful for exercising entity not found, or unauthorized, errors.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				injector := faultinjectors.NewRejectAttachInjector(faultinjectors.RejectAttachInjectorOptions{
+					Address: *address,
+					Error: &encoding.Error{
+						Condition:   encoding.ErrCond(*rejectErrorCond),
+						Description: *rejectErrorDesc,
+					},
+				})
+				return injector.Callback
+			}, nil)
+		},
+	}
+
+	address = cmd.Flags().String("address", "", "Only reject links with an address that matches this glob. If empty, all links are rejected.")
+	rejectErrorCond = cmd.Flags().String("cond", "amqp:not-found", "AMQP error condition to use for the returned error from DETACH (ex: amqp:not-found, amqp:unauthorized-access)")
+	rejectErrorDesc = cmd.Flags().String("desc", "Link rejected by the fault injector", "AMQP error description to use for the returned error from DETACH")
+
+	return cmd
+}
+
 func newDetachAfterDelayCommand(ctx context.Context) *cobra.Command {
 	var detachAfter *time.Duration
 	var detachErrorCond *string
@@ -110,21 +196,872 @@ func newDetachAfterTransferCommand(ctx context.Context) *cobra.Command {
 		Use:   "detach_after_transfer",
 		Short: "Detaches AMQP senders after a specified number of TRANSFER frames.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			injector := faultinjectors.NewDetachAfterTransferInjector(*times, encoding.Error{
-				Condition:   encoding.ErrCond(*detachErrorCond),
-				Description: *detachErrorDesc,
-			})
-			return runFaultInjector(ctx, cmd, injector.Callback)
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				injector := faultinjectors.NewDetachAfterTransferInjector(*times, encoding.Error{
+					Condition:   encoding.ErrCond(*detachErrorCond),
+					Description: *detachErrorDesc,
+				})
+				return injector.Callback
+			}, nil)
 		},
 	}
 
-	times = cmd.Flags().Int("times", 1, "Number of times to DETACH after TRANSFER frames")
+	times = cmd.Flags().Int("times", 1, "Number of times to DETACH after TRANSFER frames, for each connection")
 	detachErrorCond = cmd.Flags().String("cond", "amqp:link:detach-forced", "AMQP error condition to use for the returned error from DETACH")
 	detachErrorDesc = cmd.Flags().String("desc", "Detached by the fault injector", "AMQP error description to use for the returned error from DETACH")
 
 	return cmd
 }
 
+func newEndAfterDelayCommand(ctx context.Context) *cobra.Command {
+	var endAfter *time.Duration
+	var channel *int
+	var endErrorCond *string
+	var endErrorDesc *string
+
+	cmd := &cobra.Command{
+		Use:   "end_after_delay",
+		Short: "Ends sessions after a specified delay with a specified error. Useful for exercising session recovery code.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *endAfter <= 0 {
+				return errors.New("--delay must be greater than zero")
+			}
+
+			if *channel > math.MaxUint16 {
+				return fmt.Errorf("--channel can't be bigger than %d", math.MaxUint16)
+			}
+
+			options := faultinjectors.EndSessionInjectorOptions{
+				EndAfter: *endAfter,
+				Error: &encoding.Error{
+					Condition:   encoding.ErrCond(*endErrorCond),
+					Description: *endErrorDesc,
+				},
+			}
+
+			if *channel >= 0 {
+				options.Channel = utils.Ptr(uint16(*channel))
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewEndSessionInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	endAfter = cmd.Flags().Duration("delay", 2*time.Second, "Amount of time to wait, after BEGIN, before initiating END")
+	channel = cmd.Flags().Int("channel", -1, "Only end the session using this channel, on the client. If negative, all sessions are ended.")
+	endErrorCond = cmd.Flags().String("cond", "amqp:session:window-violation", "AMQP error condition to use for the returned error from END")
+	endErrorDesc = cmd.Flags().String("desc", "Session ended by the fault injector", "AMQP error description to use for the returned error from END")
+
+	return cmd
+}
+
+func newDisconnectCommand(ctx context.Context) *cobra.Command {
+	var after *time.Duration
+	var afterFrames *int
+	var frameType *string
+	var localMode *string
+	var remoteMode *string
+
+	cmd := &cobra.Command{
+		Use:   "disconnect",
+		Short: "Abruptly terminates connections, without an AMQP CLOSE, after a delay, a number of frames or on a frame type. Useful for simulating network failures.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *after < 0 {
+				return errors.New("--delay cannot be negative")
+			}
+
+			if *afterFrames < 0 {
+				return errors.New("--frames cannot be negative")
+			}
+
+			options := faultinjectors.DisconnectInjectorOptions{
+				After:       *after,
+				AfterFrames: *afterFrames,
+				Disconnect: faultinjectors.Disconnect{
+					Local:  faultinjectors.DisconnectMode(*localMode),
+					Remote: faultinjectors.DisconnectMode(*remoteMode),
+				},
+			}
+
+			if *frameType != "" {
+				bodyType, err := faultinjectors.ParseFrameType(*frameType)
+
+				if err != nil {
+					return err
+				}
+
+				options.Match = faultinjectors.IsType(bodyType)
+			}
+
+			if err := options.Disconnect.Validate(); err != nil {
+				return err
+			}
+
+			triggers := 0
+
+			for _, isSet := range []bool{options.After > 0, options.AfterFrames > 0, options.Match != nil} {
+				if isSet {
+					triggers++
+				}
+			}
+
+			if triggers != 1 {
+				return errors.New("exactly one of --delay, --frames or --frame-type is required")
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewDisconnectInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	after = cmd.Flags().Duration("delay", 0, "Amount of time to wait, after OPEN, before disconnecting")
+	afterFrames = cmd.Flags().Int("frames", 0, "Number of frames, after OPEN, in either direction, before disconnecting. Empty (heartbeat) frames aren't counted.")
+	frameType = cmd.Flags().String("frame-type", "", "Disconnect when a frame of this type (ex: Transfer) is sent, in either direction. The frame isn't forwarded.")
+	localMode = cmd.Flags().String("local", string(faultinjectors.DisconnectModeReset), "How to terminate the client's connection: reset, close, halfclose or empty, to leave it open but unresponsive")
+	remoteMode = cmd.Flags().String("remote", string(faultinjectors.DisconnectModeReset), "How to terminate the service's connection: reset, close, halfclose or empty, to leave it open but unresponsive")
+
+	return cmd
+}
+
+func newRewriteDispositionCommand(ctx context.Context) *cobra.Command {
+	var state *string
+	var fromState *string
+	var direction *string
+	var address *string
+	var firstDeliveryID *int64
+	var lastDeliveryID *int64
+	var rejectErrorCond *string
+	var rejectErrorDesc *string
+	var deliveryFailed *bool
+	var undeliverableHere *bool
+
+	cmd := &cobra.Command{
+		Use:   "rewrite_disposition",
+		Short: "Rewrites the outcome of deliveries, in DISPOSITION frames. Useful for exercising code that handles rejected, released or modified messages.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.DispositionInjectorOptions{
+				Address: *address,
+			}
+
+			switch *state {
+			case "rejected":
+				options.State = &encoding.StateRejected{Error: &encoding.Error{
+					Condition:   encoding.ErrCond(*rejectErrorCond),
+					Description: *rejectErrorDesc,
+				}}
+			case "released":
+				options.State = &encoding.StateReleased{}
+			case "modified":
+				options.State = &encoding.StateModified{DeliveryFailed: *deliveryFailed, UndeliverableHere: *undeliverableHere}
+			default:
+				return fmt.Errorf("invalid --state %q, must be one of rejected, released or modified", *state)
+			}
+
+			switch *fromState {
+			case "accepted":
+				options.FromState = &encoding.StateAccepted{}
+			case "any":
+			default:
+				return fmt.Errorf("invalid --from %q, must be one of accepted or any", *fromState)
+			}
+
+			switch *direction {
+			case "in":
+				options.Out = utils.Ptr(false)
+			case "out":
+				options.Out = utils.Ptr(true)
+			case "both":
+			default:
+				return fmt.Errorf("invalid --direction %q, must be one of in, out or both", *direction)
+			}
+
+			if *firstDeliveryID > math.MaxUint32 || *lastDeliveryID > math.MaxUint32 {
+				return errors.New("--first and --last can't be bigger than the largest delivery-id (4294967295)")
+			}
+
+			if *firstDeliveryID >= 0 {
+				options.FirstDeliveryID = utils.Ptr(uint32(*firstDeliveryID))
+			}
+
+			if *lastDeliveryID >= 0 {
+				options.LastDeliveryID = utils.Ptr(uint32(*lastDeliveryID))
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewDispositionInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	state = cmd.Flags().String("state", "rejected", "The new outcome for deliveries: rejected, released or modified")
+	fromState = cmd.Flags().String("from", "accepted", "Only rewrite dispositions with this outcome: accepted or any")
+	direction = cmd.Flags().String("direction", "in", "Only rewrite DISPOSITION frames sent in this direction: in (from the service), out (from the client) or both")
+	address = cmd.Flags().String("address", "", "Only rewrite the outcome for deliveries on links with an address that matches this glob. If empty, deliveries for all links are rewritten.")
+	firstDeliveryID = cmd.Flags().Int64("first", -1, "Only rewrite the outcome for deliveries with a delivery-id greater than or equal to this. If negative, there's no lower bound.")
+	lastDeliveryID = cmd.Flags().Int64("last", -1, "Only rewrite the outcome for deliveries with a delivery-id less than or equal to this. If negative, there's no upper bound.")
+	rejectErrorCond = cmd.Flags().String("cond", "amqp:internal-error", "AMQP error condition to use for the error, if --state is rejected")
+	rejectErrorDesc = cmd.Flags().String("desc", "Rejected by the fault injector", "AMQP error description to use for the error, if --state is rejected")
+	deliveryFailed = cmd.Flags().Bool("delivery-failed", true, "Sets delivery-failed, if --state is modified")
+	undeliverableHere = cmd.Flags().Bool("undeliverable-here", false, "Sets undeliverable-here, if --state is modified")
+
+	return cmd
+}
+
+func newDuplicateTransfersCommand(ctx context.Context) *cobra.Command {
+	var newDeliveryID *bool
+	var everyN *int
+	var address *string
+
+	cmd := &cobra.Command{
+		Use:   "duplicate_transfers",
+		Short: "Sends deliveries, from the service, to receivers twice. Useful for checking that consumers deduplicate messages.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *everyN <= 0 {
+				return errors.New("--every must be greater than zero")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.DuplicateTransferInjectorOptions{
+				NewDeliveryID: *newDeliveryID,
+				EveryN:        *everyN,
+				Address:       *address,
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewDuplicateTransferInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	newDeliveryID = cmd.Flags().Bool("new-delivery-id", false, "Give each duplicate its own delivery-id, like a redelivery. Otherwise duplicates have the same delivery-id as the original.")
+	everyN = cmd.Flags().Int("every", 1, "Duplicate every Nth delivery, on each link")
+	address = cmd.Flags().String("address", "", "Only duplicate deliveries on links with an address that matches this glob. If empty, deliveries for all links are duplicated.")
+
+	return cmd
+}
+
+func newFragmentTransfersCommand(ctx context.Context) *cobra.Command {
+	var direction *string
+	var address *string
+	var fragmentSize *int
+	var abortAfter *int
+
+	cmd := &cobra.Command{
+		Use:   "fragment_transfers",
+		Short: "Splits deliveries into lots of small TRANSFER frames, and optionally aborts them part way through. Useful for exercising reassembly, and abort handling.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *fragmentSize <= 0 {
+				return errors.New("--fragment-size must be greater than zero")
+			}
+
+			if *abortAfter < 0 {
+				return errors.New("--abort-after cannot be negative")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.FragmentTransferInjectorOptions{
+				Address:      *address,
+				FragmentSize: *fragmentSize,
+				AbortAfter:   *abortAfter,
+			}
+
+			switch *direction {
+			case "in":
+				options.Out = utils.Ptr(false)
+			case "out":
+				options.Out = utils.Ptr(true)
+			case "both":
+			default:
+				return fmt.Errorf("invalid --direction %q, must be one of in, out or both", *direction)
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewFragmentTransferInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	direction = cmd.Flags().String("direction", "in", "Only fragment deliveries sent in this direction: in (from the service), out (from the client) or both")
+	address = cmd.Flags().String("address", "", "Only fragment deliveries on links with an address that matches this glob. If empty, deliveries on all links, apart from $cbs and $management, are fragmented.")
+	fragmentSize = cmd.Flags().Int("fragment-size", 64, "The most payload, in bytes, that each TRANSFER frame carries")
+	abortAfter = cmd.Flags().Int("abort-after", 0, "Aborts each delivery after sending this many of its TRANSFER frames. If zero, deliveries aren't aborted.")
+
+	return cmd
+}
+
+func newMutateMessagesCommand(ctx context.Context) *cobra.Command {
+	var direction *string
+	var address *string
+	var setProperties *map[string]string
+	var removeProperties *[]string
+	var messageID *string
+	var contentType *string
+	var truncate *int
+	var bumpDeliveryCount *uint32
+	var flipBytes *int
+	var seed *uint64
+
+	cmd := &cobra.Command{
+		Use:   "mutate_messages",
+		Short: "Decodes messages, mutates them and re-encodes them. Useful for checking how clients, and services, handle unexpected or corrupted messages.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := faultinjectors.MessageMutationInjectorOptions{
+				Address:                     *address,
+				RemoveApplicationProperties: *removeProperties,
+				BumpDeliveryCount:           *bumpDeliveryCount,
+				FlipBytes:                   *flipBytes,
+				Seed:                        *seed,
+			}
+
+			switch *direction {
+			case "in":
+				options.Out = utils.Ptr(false)
+			case "out":
+				options.Out = utils.Ptr(true)
+			case "both":
+			default:
+				return fmt.Errorf("invalid --direction %q, must be one of in, out or both", *direction)
+			}
+
+			if len(*setProperties) > 0 {
+				options.SetApplicationProperties = map[string]any{}
+
+				for name, value := range *setProperties {
+					options.SetApplicationProperties[name] = value
+				}
+			}
+
+			if cmd.Flags().Changed("message-id") {
+				options.MessageID = *messageID
+			}
+
+			if cmd.Flags().Changed("content-type") {
+				options.ContentType = contentType
+			}
+
+			if *truncate >= 0 {
+				options.TruncateData = truncate
+			}
+
+			if *flipBytes < 0 {
+				return errors.New("--flip-bytes cannot be negative")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewMessageMutationInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	direction = cmd.Flags().String("direction", "both", "Only mutate messages sent in this direction: in (from the service), out (from the client) or both")
+	address = cmd.Flags().String("address", "", "Only mutate messages on links with an address that matches this glob. If empty, messages on all links, apart from $cbs and $management, are mutated.")
+	setProperties = cmd.Flags().StringToString("set-property", nil, "Application properties to set, as name=value. Values are strings.")
+	removeProperties = cmd.Flags().StringSlice("remove-property", nil, "Application properties to remove")
+	messageID = cmd.Flags().String("message-id", "", "Replaces the message-id")
+	contentType = cmd.Flags().String("content-type", "", "Replaces the content-type")
+	truncate = cmd.Flags().Int("truncate", -1, "Truncates the message's data sections to this many bytes, in total. If negative, they're left alone.")
+	bumpDeliveryCount = cmd.Flags().Uint32("bump-delivery-count", 0, "Adds this to the delivery-count in the message's header")
+	flipBytes = cmd.Flags().Int("flip-bytes", 0, "Number of random bytes to flip, in the encoded message")
+	seed = cmd.Flags().Uint64("seed", 0, "Seed for choosing the bytes to flip. If zero, a random seed is used.")
+
+	return cmd
+}
+
+func newFlowCommand(ctx context.Context) *cobra.Command {
+	var credit *string
+	var maxCredit *uint32
+	var holdFor *time.Duration
+	var drain *string
+	var drainDelay *time.Duration
+	var address *string
+
+	cmd := &cobra.Command{
+		Use:   "flow",
+		Short: "Holds, reduces or zeroes the link credit the service grants to senders, and ignores or delays drain requests from receivers. Useful for simulating throttling.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *holdFor < 0 {
+				return errors.New("--hold-for cannot be negative")
+			}
+
+			if *drainDelay < 0 {
+				return errors.New("--drain-delay cannot be negative")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.FlowInjectorOptions{
+				MaxCredit:  *maxCredit,
+				HoldFor:    *holdFor,
+				DrainDelay: *drainDelay,
+				Address:    *address,
+			}
+
+			switch *credit {
+			case "none":
+			case "hold", "reduce", "zero":
+				options.Credit = faultinjectors.FlowCreditAction(*credit)
+			default:
+				return fmt.Errorf("invalid --credit %q, must be one of none, hold, reduce or zero", *credit)
+			}
+
+			switch *drain {
+			case "none":
+			case "ignore":
+				options.Drain = faultinjectors.FlowDrainActionIgnore
+			case "delay":
+				if *drainDelay <= 0 {
+					return errors.New("--drain-delay must be greater than zero")
+				}
+
+				options.Drain = faultinjectors.FlowDrainActionDelay
+			default:
+				return fmt.Errorf("invalid --drain %q, must be one of none, ignore or delay", *drain)
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewFlowInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	credit = cmd.Flags().String("credit", "zero", "What to do with the link credit the service grants to senders: none, hold, reduce or zero")
+	maxCredit = cmd.Flags().Uint32("max-credit", 1, "The most link credit a sender gets, if --credit is reduce")
+	holdFor = cmd.Flags().Duration("hold-for", 0, "How long to hold back the service's FLOW frames, if --credit is hold. If zero, they're never sent.")
+	drain = cmd.Flags().String("drain", "none", "What to do with drain requests from receivers: none, ignore or delay")
+	drainDelay = cmd.Flags().Duration("drain-delay", 0, "How long to delay drain requests, if --drain is delay")
+	address = cmd.Flags().String("address", "", "Only affect links with an address that matches this glob. If empty, all links are affected.")
+
+	return cmd
+}
+
+func newIdleTimeoutCommand(ctx context.Context) *cobra.Command {
+	var direction *string
+	var idleTimeout *time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "idle_timeout",
+		Short: "Drops empty (keep-alive) frames, so the peer's idle timer fires. Useful for checking that dead connections are detected and recovered.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := faultinjectors.IdleTimeoutInjectorOptions{}
+
+			switch *direction {
+			case "in":
+				options.Out = utils.Ptr(false)
+			case "out":
+				options.Out = utils.Ptr(true)
+			case "both":
+			default:
+				return fmt.Errorf("invalid --direction %q, must be one of in, out or both", *direction)
+			}
+
+			// the idle-timeout is sent as a uint of milliseconds.
+			if *idleTimeout > math.MaxUint32*time.Millisecond {
+				return fmt.Errorf("--idle-timeout can't be bigger than %s", math.MaxUint32*time.Millisecond)
+			}
+
+			if *idleTimeout >= 0 {
+				options.IdleTimeout = idleTimeout
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewIdleTimeoutInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	direction = cmd.Flags().String("direction", "in", "Drop empty frames sent in this direction: in (from the service), out (from the client) or both")
+	idleTimeout = cmd.Flags().Duration("idle-timeout", -1, "Replaces the idle-timeout in the service's OPEN frame, which controls how often the client sends empty frames. If zero, the client doesn't send any. If negative, it's left alone.")
+
+	return cmd
+}
+
+func newSizeLimitsCommand(ctx context.Context) *cobra.Command {
+	var maxFrameSize *uint32
+	var maxMessageSize *uint64
+	var address *string
+	var reject *bool
+
+	cmd := &cobra.Command{
+		Use:   "size_limits",
+		Short: "Shrinks the max frame size, and max message size, the service advertises. Useful for checking that clients honor negotiated limits.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *maxFrameSize == 0 && *maxMessageSize == 0 {
+				return errors.New("at least one of --max-frame-size or --max-message-size is required")
+			}
+
+			if *maxFrameSize != 0 && *maxFrameSize < 512 {
+				return errors.New("--max-frame-size must be at least 512")
+			}
+
+			if *reject && *maxMessageSize == 0 {
+				return errors.New("--reject requires --max-message-size")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.SizeLimitInjectorOptions{
+				MaxFrameSize:            *maxFrameSize,
+				MaxMessageSize:          *maxMessageSize,
+				Address:                 *address,
+				RejectOversizedMessages: *reject,
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewSizeLimitInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	maxFrameSize = cmd.Flags().Uint32("max-frame-size", 0, "Replaces the max-frame-size in the service's OPEN frame. Must be at least 512. If zero, it's left alone.")
+	maxMessageSize = cmd.Flags().Uint64("max-message-size", 0, "Replaces the max-message-size in the service's ATTACH frames. If zero, it's left alone.")
+	address = cmd.Flags().String("address", "", "Only change the max-message-size for links with an address that matches this glob. If empty, all links, apart from $cbs and $management, are changed.")
+	reject = cmd.Flags().Bool("reject", false, "Detach links with an amqp:link:message-size-exceeded error, when the client sends a message bigger than --max-message-size")
+
+	return cmd
+}
+
+func newRedirectLinkCommand(ctx context.Context) *cobra.Command {
+	var target redirectTargetFlags
+	var after *time.Duration
+	var address *string
+
+	cmd := &cobra.Command{
+		Use:   "redirect_link",
+		Short: "Detaches links with an amqp:link:redirect error, pointing at another endpoint. Useful for exercising redirect handling.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *after < 0 {
+				return errors.New("--delay cannot be negative")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewLinkRedirectInjector(faultinjectors.LinkRedirectInjectorOptions{
+					Target:  target.RedirectTarget(),
+					After:   *after,
+					Address: *address,
+				}).Callback
+			}, nil)
+		},
+	}
+
+	target.Add(cmd, true)
+	after = cmd.Flags().Duration("delay", 0, "How long to wait, after a link is attached, before redirecting it")
+	address = cmd.Flags().String("address", "", "Only redirect links with an address that matches this glob. If empty, all links are redirected.")
+
+	return cmd
+}
+
+func newRedirectConnectionCommand(ctx context.Context) *cobra.Command {
+	var target redirectTargetFlags
+	var after *time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "redirect_connection",
+		Short: "Closes connections with an amqp:connection:redirect error, pointing at another endpoint. Useful for exercising redirect handling.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *after < 0 {
+				return errors.New("--delay cannot be negative")
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewConnectionRedirectInjector(faultinjectors.ConnectionRedirectInjectorOptions{
+					Target: target.RedirectTarget(),
+					After:  *after,
+				}).Callback
+			}, nil)
+		},
+	}
+
+	target.Add(cmd, false)
+	after = cmd.Flags().Duration("delay", 0, "How long to wait, after the connection is opened, before redirecting it")
+
+	return cmd
+}
+
+// redirectTargetFlags are the flags for the endpoint a redirect error points at.
+type redirectTargetFlags struct {
+	hostname    *string
+	networkHost *string
+	port        *uint16
+	address     *string
+}
+
+func (f *redirectTargetFlags) Add(cmd *cobra.Command, withAddress bool) {
+	f.hostname = cmd.Flags().String("hostname", "", "The DNS hostname of the endpoint to redirect to, which the client uses for TLS and its OPEN frame")
+	f.networkHost = cmd.Flags().String("network-host", "", "The DNS hostname, or IP address, of the endpoint to redirect to")
+	f.port = cmd.Flags().Uint16("port", 5671, "The port of the endpoint to redirect to")
+
+	if withAddress {
+		f.address = cmd.Flags().String("target-address", "", "The address of the node the client should attach to, on the endpoint it's redirected to")
+	}
+
+	_ = cmd.MarkFlagRequired("network-host")
+}
+
+func (f *redirectTargetFlags) RedirectTarget() faultinjectors.RedirectTarget {
+	target := faultinjectors.RedirectTarget{
+		Hostname:    *f.hostname,
+		NetworkHost: *f.networkHost,
+		Port:        *f.port,
+	}
+
+	if f.address != nil {
+		target.Address = *f.address
+	}
+
+	return target
+}
+
+func newCBSCommand(ctx context.Context) *cobra.Command {
+	var statusCode *int32
+	var statusDesc *string
+	var nth *int
+
+	cmd := &cobra.Command{
+		Use:   "cbs",
+		Short: "Fails $cbs put-token calls, by rewriting the status-code in the service's response. Useful for exercising authentication failures.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *nth < 0 {
+				return errors.New("--nth cannot be negative")
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewCBSInjector(faultinjectors.CBSInjectorOptions{
+					StatusCode:        *statusCode,
+					StatusDescription: *statusDesc,
+					Nth:               *nth,
+				}).Callback
+			}, nil)
+		},
+	}
+
+	statusCode = cmd.Flags().Int32("status-code", 401, "The status-code to use in put-token responses (ex: 401, 403 or 500)")
+	statusDesc = cmd.Flags().String("status-desc", "Unauthorized by the fault injector", "The status-description to use in put-token responses")
+	nth = cmd.Flags().Int("nth", 0, "Only fail the Nth put-token call (starting from 1), for each connection. If zero, every put-token call fails.")
+
+	return cmd
+}
+
+func newManagementCommand(ctx context.Context) *cobra.Command {
+	var operation *string
+	var address *string
+	var action *string
+	var statusCode *int32
+	var statusDesc *string
+	var errorCondition *string
+	var delay *time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "management",
+		Short: "Rewrites, delays or drops the responses to $management requests. Useful for exercising lock lost, and RPC timeout, handling.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *delay < 0 {
+				return errors.New("--delay cannot be negative")
+			}
+
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			options := faultinjectors.ManagementInjectorOptions{
+				Operation:         *operation,
+				Address:           *address,
+				StatusCode:        *statusCode,
+				StatusDescription: *statusDesc,
+				ErrorCondition:    *errorCondition,
+				Delay:             *delay,
+			}
+
+			switch *action {
+			case "rewrite":
+				options.Action = faultinjectors.ManagementActionRewrite
+			case "delay":
+				if *delay <= 0 {
+					return errors.New("--delay must be greater than zero")
+				}
+
+				options.Action = faultinjectors.ManagementActionDelay
+			case "drop":
+				options.Action = faultinjectors.ManagementActionDrop
+			default:
+				return fmt.Errorf("invalid --action %q, must be one of rewrite, delay or drop", *action)
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewManagementInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	operation = cmd.Flags().String("operation", "", "Only affect requests with this operation (ex: com.microsoft:renew-lock). If empty, all requests are affected.")
+	address = cmd.Flags().String("address", "", "Only affect $management links with an address that matches this glob (ex: myqueue/$management). If empty, all $management links are affected.")
+	action = cmd.Flags().String("action", "rewrite", "What to do with the response: rewrite, delay or drop")
+	statusCode = cmd.Flags().Int32("status-code", 410, "The status code to use in the response, if --action is rewrite")
+	statusDesc = cmd.Flags().String("status-desc", "Rewritten by the fault injector", "The status description to use in the response, if --action is rewrite")
+	errorCondition = cmd.Flags().String("error-condition", "", "The errorCondition to add to the response, if --action is rewrite (ex: com.microsoft:message-lock-lost)")
+	delay = cmd.Flags().Duration("delay", 0, "How long to delay the response, if --action is delay")
+
+	return cmd
+}
+
+func newReorderCommand(ctx context.Context) *cobra.Command {
+	var window *int
+	var mode *string
+	var direction *string
+	var frameTypes *[]string
+	var seed *uint64
+
+	cmd := &cobra.Command{
+		Use:   "reorder",
+		Short: "Holds a window of frames, and sends them permuted or reversed. Useful for hitting frame ordering bugs.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *window < 2 {
+				return errors.New("--window must be at least 2")
+			}
+
+			options := faultinjectors.ReorderInjectorOptions{
+				Window: *window,
+				Mode:   faultinjectors.ReorderMode(*mode),
+				Seed:   *seed,
+			}
+
+			switch options.Mode {
+			case faultinjectors.ReorderModePermute, faultinjectors.ReorderModeReverse:
+			default:
+				return fmt.Errorf("invalid --mode %q, must be one of permute or reverse", *mode)
+			}
+
+			var predicates []faultinjectors.Predicate
+
+			switch *direction {
+			case "in":
+				predicates = append(predicates, faultinjectors.IsInbound)
+			case "out":
+				predicates = append(predicates, faultinjectors.IsOutbound)
+			case "both":
+			default:
+				return fmt.Errorf("invalid --direction %q, must be one of in, out or both", *direction)
+			}
+
+			if len(*frameTypes) > 0 {
+				var bodyTypes []frames.BodyType
+
+				for _, frameType := range *frameTypes {
+					bodyType, err := faultinjectors.ParseFrameType(frameType)
+
+					if err != nil {
+						return err
+					}
+
+					bodyTypes = append(bodyTypes, bodyType)
+				}
+
+				predicates = append(predicates, faultinjectors.IsType(bodyTypes...))
+			}
+
+			if len(predicates) > 0 {
+				options.Match = faultinjectors.And(predicates...)
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				return faultinjectors.NewReorderInjector(options).Callback
+			}, nil)
+		},
+	}
+
+	window = cmd.Flags().Int("window", 2, "Number of frames to hold, in each direction, before reordering and sending them")
+	mode = cmd.Flags().String("mode", string(faultinjectors.ReorderModeReverse), "How to reorder each window of frames: permute or reverse")
+	direction = cmd.Flags().String("direction", "both", "Only reorder frames sent in this direction: in (from the service), out (from the client) or both")
+	frameTypes = cmd.Flags().StringSlice("frame-types", nil, "Only reorder frames of these types (ex: Flow,Attach). If empty, all frames, apart from OPEN, CLOSE and empty frames, are reordered.")
+	seed = cmd.Flags().Uint64("seed", 0, "Seed for permuting frames. If zero, a random seed is used.")
+
+	return cmd
+}
+
+func newCloseAfterDelayCommand(ctx context.Context) *cobra.Command {
+	var closeAfter *time.Duration
+	var closeErrorCond *string
+	var closeErrorDesc *string
+
+	cmd := &cobra.Command{
+		Use:   "close_after_delay",
+		Short: "Closes connections after a specified delay with a specified error. Useful for exercising connection recovery code.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *closeAfter <= 0 {
+				return errors.New("--delay must be greater than zero")
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				injector := faultinjectors.NewCloseAfterDelayInjector(*closeAfter, &encoding.Error{
+					Condition:   encoding.ErrCond(*closeErrorCond),
+					Description: *closeErrorDesc,
+				})
+				return injector.Callback
+			}, nil)
+		},
+	}
+
+	closeAfter = cmd.Flags().Duration("delay", 2*time.Second, "Amount of time to wait, after OPEN, before initiating CLOSE")
+	closeErrorCond = cmd.Flags().String("cond", "amqp:connection:forced", "AMQP error condition to use for the returned error from CLOSE")
+	closeErrorDesc = cmd.Flags().String("desc", "Connection closed by the fault injector", "AMQP error description to use for the returned error from CLOSE")
+
+	return cmd
+}
+
+func newCloseAfterFramesCommand(ctx context.Context) *cobra.Command {
+	var afterFrames *int
+	var closeErrorCond *string
+	var closeErrorDesc *string
+
+	cmd := &cobra.Command{
+		Use:   "close_after_frames",
+		Short: "Closes connections after a specified number of frames with a specified error. Useful for exercising connection recovery code.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *afterFrames <= 0 {
+				return errors.New("--frames must be greater than zero")
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+				injector := faultinjectors.NewCloseAfterFramesInjector(*afterFrames, &encoding.Error{
+					Condition:   encoding.ErrCond(*closeErrorCond),
+					Description: *closeErrorDesc,
+				})
+				return injector.Callback
+			}, nil)
+		},
+	}
+
+	afterFrames = cmd.Flags().Int("frames", 10, "Number of frames, after OPEN, in either direction, before initiating CLOSE. Empty (heartbeat) frames aren't counted.")
+	closeErrorCond = cmd.Flags().String("cond", "amqp:connection:forced", "AMQP error condition to use for the returned error from CLOSE")
+	closeErrorDesc = cmd.Flags().String("desc", "Connection closed by the fault injector", "AMQP error description to use for the returned error from CLOSE")
+
+	return cmd
+}
+
 func newSlowTransferFrames(ctx context.Context) *cobra.Command {
 	var delay *time.Duration
 
@@ -141,19 +1078,258 @@ func newSlowTransferFrames(ctx context.Context) *cobra.Command {
 	return cmd
 }
 
+func newShapeCommand(ctx context.Context) *cobra.Command {
+	var inRate, outRate *int64
+	var inBurst, outBurst *int64
+	var inLatency, outLatency *time.Duration
+	var inJitter, outJitter *time.Duration
+	var jitterDistribution *string
+	var address *string
+	var queueLimit *int
+	var seed *uint64
+
+	cmd := &cobra.Command{
+		Use:   "shape",
+		Short: "Limits the bandwidth, and adds latency and jitter, to each connection. Useful for simulating a slow, or far away, network.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if err := validateGlob("address", *address); err != nil {
+				return err
+			}
+
+			if *queueLimit < 0 {
+				return errors.New("--queue-limit cannot be negative")
+			}
+
+			shaping := &faultinjectors.ShapingOptions{
+				Address:    *address,
+				QueueLimit: *queueLimit,
+				Seed:       *seed,
+			}
+
+			if *inRate != 0 || *inLatency != 0 || *inJitter != 0 {
+				shaping.In = &faultinjectors.DirectionShaping{
+					BytesPerSecond:     *inRate,
+					Burst:              *inBurst,
+					Latency:            *inLatency,
+					Jitter:             *inJitter,
+					JitterDistribution: faultinjectors.JitterDistribution(*jitterDistribution),
+				}
+			}
+
+			if *outRate != 0 || *outLatency != 0 || *outJitter != 0 {
+				shaping.Out = &faultinjectors.DirectionShaping{
+					BytesPerSecond:     *outRate,
+					Burst:              *outBurst,
+					Latency:            *outLatency,
+					Jitter:             *outJitter,
+					JitterDistribution: faultinjectors.JitterDistribution(*jitterDistribution),
+				}
+			}
+
+			if shaping.In == nil && shaping.Out == nil {
+				return errors.New("at least one of the rate, latency or jitter flags must be set")
+			}
+
+			if err := shaping.Validate(); err != nil {
+				return err
+			}
+
+			return runFaultInjectorWithOptions(ctx, cmd, newPassthroughFactory(), nil, func(options *faultinjectors.FaultInjectorOptions) {
+				options.Shaping = shaping
+			})
+		},
+	}
+
+	inRate = cmd.Flags().Int64("in-rate", 0, "Bandwidth limit, in bytes per second, for frames sent to the client. If zero, there's no limit.")
+	outRate = cmd.Flags().Int64("out-rate", 0, "Bandwidth limit, in bytes per second, for frames sent to the service. If zero, there's no limit.")
+	inBurst = cmd.Flags().Int64("in-burst", 0, "Bytes that can be sent to the client, at full speed, after the connection's been idle")
+	outBurst = cmd.Flags().Int64("out-burst", 0, "Bytes that can be sent to the service, at full speed, after the connection's been idle")
+	inLatency = cmd.Flags().Duration("in-latency", 0, "Latency added to frames sent to the client")
+	outLatency = cmd.Flags().Duration("out-latency", 0, "Latency added to frames sent to the service")
+	inJitter = cmd.Flags().Duration("in-jitter", 0, "Jitter added to the latency for frames sent to the client")
+	outJitter = cmd.Flags().Duration("out-jitter", 0, "Jitter added to the latency for frames sent to the service")
+	jitterDistribution = cmd.Flags().String("jitter-distribution", string(faultinjectors.JitterDistributionUniform), "How jitter is distributed: uniform (between -jitter and +jitter) or normal (jitter is the standard deviation)")
+	address = cmd.Flags().String("address", "", "Only shape frames for links with an address that matches this glob (ex: 'myhub/*'). Each session is shaped separately, so it doesn't block the others. If empty, all traffic is shaped.")
+	queueLimit = cmd.Flags().Int("queue-limit", 0, "The most frames each shaping queue holds, before the fault injector stops reading from the peer that's sending them. If zero, the default (1000) is used. Not used with --address, since stopping reads for one session would stop every session.")
+	seed = cmd.Flags().Uint64("seed", 0, "Seed for the jitter. If zero, a random seed is used.")
+
+	return cmd
+}
+
+func newSASLCommand(ctx context.Context) *cobra.Command {
+	var outcome *string
+	var additionalData *string
+	var mechanismsDelay *time.Duration
+
+	cmd := &cobra.Command{
+		Use:   "sasl",
+		Short: "Replaces the service's SASL outcome, or delays its SASL mechanisms. Useful for checking how clients classify authentication failures.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			if *mechanismsDelay < 0 {
+				return errors.New("--mechanisms-delay cannot be negative")
+			}
+
+			options := faultinjectors.SASLInjectorOptions{
+				MechanismsDelay: *mechanismsDelay,
+			}
+
+			if *outcome != "" {
+				code, err := encoding.ParseSASLCode(*outcome)
+
+				if err != nil {
+					return fmt.Errorf("invalid --outcome: %w", err)
+				}
+
+				options.Outcome = &code
+			}
+
+			if *additionalData != "" {
+				options.AdditionalData = []byte(*additionalData)
+			}
+
+			if options.Outcome == nil && options.AdditionalData == nil && options.MechanismsDelay == 0 {
+				return errors.New("at least one of --outcome, --additional-data or --mechanisms-delay must be set")
+			}
+
+			return runFaultInjectorWithOptions(ctx, cmd, newPassthroughFactory(), nil, func(fiOptions *faultinjectors.FaultInjectorOptions) {
+				fiOptions.HandshakeFactory = func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+					return faultinjectors.NewSASLInjector(options).Callback
+				}
+			})
+		},
+	}
+
+	outcome = cmd.Flags().String("outcome", "", "SASL outcome code to send to the client instead of the service's: ok, auth, sys, sys-perm or sys-temp")
+	additionalData = cmd.Flags().String("additional-data", "", "Additional data to send, in the SASL outcome, instead of the service's")
+	mechanismsDelay = cmd.Flags().Duration("mechanisms-delay", 0, "Amount of time to wait before sending the service's SASL mechanisms to the client")
+
+	return cmd
+}
+
+func newProtocolHeaderCommand(ctx context.Context) *cobra.Command {
+	var mode *string
+	var protocol *string
+	var protocolID *uint8
+	var version *string
+	var garbage *string
+
+	protocolIDs := map[string]frames.ProtocolID{
+		"amqp": frames.ProtocolIDAMQP,
+		"tls":  frames.ProtocolIDTLS,
+		"sasl": frames.ProtocolIDSASL,
+	}
+
+	cmd := &cobra.Command{
+		Use:   "protocol_header",
+		Short: "Replaces the service's protocol header (preamble) with a different one, or garbage, or closes the connection instead. Useful for exercising protocol negotiation failures.",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			options := faultinjectors.ProtocolHeaderInjectorOptions{
+				Mode:    faultinjectors.ProtocolHeaderMode(*mode),
+				Header:  frames.ProtocolHeader{ProtocolID: frames.ProtocolID(*protocolID)},
+				Garbage: []byte(*garbage),
+			}
+
+			switch options.Mode {
+			case faultinjectors.ProtocolHeaderModeReplace, faultinjectors.ProtocolHeaderModeGarbage, faultinjectors.ProtocolHeaderModeClose:
+			default:
+				return fmt.Errorf("invalid --mode %q, must be one of replace, garbage or close", *mode)
+			}
+
+			if *protocol != "" {
+				id, exists := protocolIDs[*protocol]
+
+				if !exists {
+					return fmt.Errorf("invalid --protocol %q, must be one of amqp, tls or sasl", *protocol)
+				}
+
+				options.Protocol = &id
+			}
+
+			if _, err := fmt.Sscanf(*version, "%d.%d.%d", &options.Header.Major, &options.Header.Minor, &options.Header.Revision); err != nil {
+				return fmt.Errorf("invalid --version %q, must be major.minor.revision (ex: 1.0.0): %w", *version, err)
+			}
+
+			if options.Mode == faultinjectors.ProtocolHeaderModeGarbage && len(options.Garbage) == 0 {
+				return errors.New("--garbage must be set, when --mode is garbage")
+			}
+
+			return runFaultInjectorWithOptions(ctx, cmd, newPassthroughFactory(), nil, func(fiOptions *faultinjectors.FaultInjectorOptions) {
+				fiOptions.HandshakeFactory = func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+					return faultinjectors.NewProtocolHeaderInjector(options).Callback
+				}
+			})
+		},
+	}
+
+	mode = cmd.Flags().String("mode", string(faultinjectors.ProtocolHeaderModeReplace), "What to do with the service's protocol header: replace, garbage or close")
+	protocol = cmd.Flags().String("protocol", "", "Only change the service's protocol header for this protocol: amqp, tls or sasl. If empty, every protocol header is changed.")
+	protocolID = cmd.Flags().Uint8("protocol-id", uint8(frames.ProtocolIDAMQP), "Protocol id to send, when --mode is replace: 0 (AMQP), 2 (TLS) or 3 (SASL)")
+	version = cmd.Flags().String("version", "1.0.0", "Protocol version to send, when --mode is replace")
+	garbage = cmd.Flags().String("garbage", "HTTP/1.1 400 Bad Request\r\n\r\n", "Bytes to send, when --mode is garbage")
+
+	return cmd
+}
+
+// newScenarioCommand creates a command that runs the rules from a scenario file. See [faultinjectors.Scenario] for the format.
+func newScenarioCommand(ctx context.Context) *cobra.Command {
+	var file *string
+
+	cmd := &cobra.Command{
+		Use:   "scenario",
+		Short: "Runs the fault rules from a YAML scenario file (ex: scenario --file faults.yaml)",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			scenario, err := faultinjectors.LoadScenario(*file)
+
+			if err != nil {
+				return err
+			}
+
+			return runFaultInjectorPerConnection(ctx, cmd, newScenarioFactory(scenario), func(config json.RawMessage) (faultinjectors.MirrorCallbackFactory, error) {
+				// JSON is also valid YAML.
+				scenario, err := faultinjectors.ParseScenario(config)
+
+				if err != nil {
+					return nil, err
+				}
+
+				return newScenarioFactory(scenario), nil
+			})
+		},
+	}
+
+	file = cmd.Flags().String("file", "", "Path to the YAML scenario file")
+	_ = cmd.MarkFlagRequired("file")
+
+	return cmd
+}
+
+// newScenarioFactory creates a factory that gives each connection its own rule counters.
+func newScenarioFactory(scenario *faultinjectors.Scenario) faultinjectors.MirrorCallbackFactory {
+	return func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+		return faultinjectors.NewScenarioInjector(scenario).Callback
+	}
+}
+
 // newPassthroughCommand creates a command that passes all frames through, unchanged. Useful if trying to troubleshoot.
 func newPassthroughCommand(ctx context.Context) *cobra.Command {
 	cmd := &cobra.Command{
 		Use:   "passthrough",
 		Short: "Runs the fault injector but passes all frames through. Useful for troubleshooting.",
 		RunE: func(cmd *cobra.Command, args []string) error {
-			return runFaultInjector(ctx, cmd, func(ctx context.Context, params faultinjectors.MirrorCallbackParams) ([]faultinjectors.MetaFrame, error) {
-				return []faultinjectors.MetaFrame{{
-					Action: faultinjectors.MetaFrameActionPassthrough, Frame: params.Frame,
-				}}, nil
-			})
+			return runFaultInjectorPerConnection(ctx, cmd, newPassthroughFactory(), nil)
 		},
 	}
 
 	return cmd
 }
+
+// newPassthroughFactory creates a factory whose callbacks pass all frames through, unchanged.
+func newPassthroughFactory() faultinjectors.MirrorCallbackFactory {
+	return func(connInfo faultinjectors.ConnInfo) faultinjectors.MirrorCallback {
+		return func(ctx context.Context, params faultinjectors.MirrorCallbackParams) ([]faultinjectors.MetaFrame, error) {
+			return []faultinjectors.MetaFrame{{
+				Action: faultinjectors.MetaFrameActionPassthrough, Frame: params.Frame,
+			}}, nil
+		}
+	}
+}
@@ -8,12 +8,63 @@ import (
 func main() {
 	rootCmd := newRootCommand()
 
+	// attach commands
+	rootCmd.AddCommand(newRejectAttachCommand(context.Background()))
+
 	// detach commands
 	rootCmd.AddCommand(newDetachAfterDelayCommand(context.Background()))
 	rootCmd.AddCommand(newDetachAfterTransferCommand(context.Background()))
 
+	// end commands
+	rootCmd.AddCommand(newEndAfterDelayCommand(context.Background()))
+
+	// close commands
+	rootCmd.AddCommand(newCloseAfterDelayCommand(context.Background()))
+	rootCmd.AddCommand(newCloseAfterFramesCommand(context.Background()))
+
+	// redirect commands
+	rootCmd.AddCommand(newRedirectLinkCommand(context.Background()))
+	rootCmd.AddCommand(newRedirectConnectionCommand(context.Background()))
+
+	// disconnect commands
+	rootCmd.AddCommand(newDisconnectCommand(context.Background()))
+
+	// disposition commands
+	rootCmd.AddCommand(newRewriteDispositionCommand(context.Background()))
+
+	// flow commands
+	rootCmd.AddCommand(newFlowCommand(context.Background()))
+
+	// idle timeout commands
+	rootCmd.AddCommand(newIdleTimeoutCommand(context.Background()))
+
+	// size limit commands
+	rootCmd.AddCommand(newSizeLimitsCommand(context.Background()))
+
 	// transfer commands
 	rootCmd.AddCommand(newSlowTransferFrames(context.Background()))
+	rootCmd.AddCommand(newDuplicateTransfersCommand(context.Background()))
+	rootCmd.AddCommand(newMutateMessagesCommand(context.Background()))
+	rootCmd.AddCommand(newFragmentTransfersCommand(context.Background()))
+
+	// $cbs commands
+	rootCmd.AddCommand(newCBSCommand(context.Background()))
+
+	// $management commands
+	rootCmd.AddCommand(newManagementCommand(context.Background()))
+
+	// reorder commands
+	rootCmd.AddCommand(newReorderCommand(context.Background()))
+
+	// handshake commands
+	rootCmd.AddCommand(newProtocolHeaderCommand(context.Background()))
+	rootCmd.AddCommand(newSASLCommand(context.Background()))
+
+	// shaping commands
+	rootCmd.AddCommand(newShapeCommand(context.Background()))
+
+	// scenarios
+	rootCmd.AddCommand(newScenarioCommand(context.Background()))
 
 	// passthrough/diagnostics
 	rootCmd.AddCommand(newPassthroughCommand(context.Background()))
@@ -236,6 +236,57 @@ func TestFaultInjector_VerbatimPassthrough(t *testing.T) {
 	require.NotZero(t, rawFrames)
 }
 
+func TestFaultInjector_InvalidFlags(t *testing.T) {
+	// invalid flags have to fail the command, before it starts listening, instead of when a client connects.
+	testCases := []struct {
+		Command func(ctx context.Context) *cobra.Command
+		Args    []string
+		Err     string
+	}{
+		{Command: newEndAfterDelayCommand, Args: []string{"--delay", "0s"}, Err: "--delay must be greater than zero"},
+		{Command: newEndAfterDelayCommand, Args: []string{"--channel", "65536"}, Err: "--channel can't be bigger than 65535"},
+		{Command: newDisconnectCommand, Args: []string{"--frame-type", "Teleport"}, Err: `invalid frame type "Teleport"`},
+		{Command: newDisconnectCommand, Args: []string{"--delay", "-1s", "--frames", "2"}, Err: "--delay cannot be negative"},
+		{Command: newDisconnectCommand, Args: []string{"--frames", "-1", "--frame-type", "transfer"}, Err: "--frames cannot be negative"},
+		{Command: newRewriteDispositionCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newRewriteDispositionCommand, Args: []string{"--last", "4294967296"}, Err: "--first and --last can't be bigger"},
+		{Command: newDuplicateTransfersCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newFlowCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newFlowCommand, Args: []string{"--credit", "hold", "--hold-for", "-1s"}, Err: "--hold-for cannot be negative"},
+		{Command: newFlowCommand, Args: []string{"--drain-delay", "-1s"}, Err: "--drain-delay cannot be negative"},
+		{Command: newIdleTimeoutCommand, Args: []string{"--idle-timeout", "1200h"}, Err: "--idle-timeout can't be bigger"},
+		{Command: newRejectAttachCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newRedirectLinkCommand, Args: []string{"--network-host", "localhost", "--address", "["}, Err: `invalid --address "["`},
+		{Command: newRedirectLinkCommand, Args: []string{"--network-host", "localhost", "--delay", "-1s"}, Err: "--delay cannot be negative"},
+		{Command: newRedirectConnectionCommand, Args: []string{"--network-host", "localhost", "--delay", "-1s"}, Err: "--delay cannot be negative"},
+		{Command: newManagementCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newManagementCommand, Args: []string{"--action", "drop", "--delay", "-1s"}, Err: "--delay cannot be negative"},
+		{Command: newMutateMessagesCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newReorderCommand, Args: []string{"--frame-types", "transfer,bogus"}, Err: `invalid frame type "bogus"`},
+		{Command: newFragmentTransfersCommand, Args: []string{"--address", "["}, Err: `invalid --address "["`},
+		{Command: newSizeLimitsCommand, Args: []string{"--max-message-size", "1024", "--address", "["}, Err: `invalid --address "["`},
+		{Command: newShapeCommand, Args: []string{"--out-latency", "1s", "--address", "["}, Err: `invalid --address "["`},
+		{Command: newShapeCommand, Args: []string{"--out-latency", "1s", "--queue-limit", "-1"}, Err: "--queue-limit cannot be negative"},
+		{Command: newCloseAfterDelayCommand, Args: []string{"--delay", "0s"}, Err: "--delay must be greater than zero"},
+		{Command: newCloseAfterFramesCommand, Args: []string{"--frames", "-1"}, Err: "--frames must be greater than zero"},
+		{Command: newShapeCommand, Args: []string{"--out-latency", "-1s"}, Err: "shaping values cannot be negative"},
+		{Command: newSASLCommand, Args: []string{"--mechanisms-delay", "-1s", "--outcome", "auth"}, Err: "--mechanisms-delay cannot be negative"},
+		{Command: newSASLCommand, Args: []string{"--outcome", "bogus"}, Err: "invalid --outcome"},
+	}
+
+	for _, tc := range testCases {
+		subCommand := tc.Command(context.Background())
+
+		rootCmd := newRootCommand()
+		rootCmd.SilenceErrors = true
+		rootCmd.SilenceUsage = true
+		rootCmd.AddCommand(subCommand)
+		rootCmd.SetArgs(append([]string{subCommand.Name(), "--host", "localhost"}, tc.Args...))
+
+		require.ErrorContains(t, rootCmd.Execute(), tc.Err, "%s %v", subCommand.Name(), tc.Args)
+	}
+}
+
 type testFaultInjector struct {
 	cancelFaultInjector context.CancelFunc
 	JSONLFile           string
@@ -5,17 +5,20 @@ import "github.com/spf13/cobra"
 const HostFlagName = "host"
 const LogsFlagName = "logs"
 const CertFlagName = "cert"
+const DisableRemoteTLSFlagName = "disable-remote-tls"
 
 type CommonFlags struct {
-	Host    string
-	LogsDir string
-	CertDir string
+	Host             string
+	LogsDir          string
+	CertDir          string
+	DisableRemoteTLS bool
 }
 
 func AddCommonFlags(cmd *cobra.Command) {
 	cmd.PersistentFlags().String(HostFlagName, "", "The hostname of the service we're proxying to (ex: <server>.servicebus.windows.net)")
 	cmd.PersistentFlags().String(LogsFlagName, ".", "The directory to write any logs or trace files")
 	cmd.PersistentFlags().String(CertFlagName, ".", "The directory to write the TLS server.cert and server.key used for the proxy's endpoint. If the files already exist, they are re-used.")
+	cmd.PersistentFlags().Bool(DisableRemoteTLSFlagName, false, "Disables TLS for the connection to the remote host. Useful for a local broker, or emulator, listening on the plain AMQP port (5672).")
 
 	_ = cmd.MarkPersistentFlagRequired(HostFlagName)
 }
@@ -39,9 +42,16 @@ func ExtractCommonFlags(cmd *cobra.Command) (CommonFlags, error) {
 		return CommonFlags{}, err
 	}
 
+	disableRemoteTLS, err := cmd.Flags().GetBool(DisableRemoteTLSFlagName)
+
+	if err != nil {
+		return CommonFlags{}, err
+	}
+
 	return CommonFlags{
-		Host:    host,
-		LogsDir: logs,
-		CertDir: cert,
+		Host:             host,
+		LogsDir:          logs,
+		CertDir:          cert,
+		DisableRemoteTLS: disableRemoteTLS,
 	}, nil
 }
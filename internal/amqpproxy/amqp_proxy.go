@@ -10,7 +10,6 @@ import (
 	"log/slog"
 	"net"
 	"os"
-	"strings"
 	"sync/atomic"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
@@ -23,6 +22,7 @@ type AMQPProxy struct {
 	conn                          atomic.Pointer[net.Listener]
 	localEndpoint, remoteEndpoint string
 	options                       AMQPProxyOptions
+	closedByUser                  atomic.Bool
 }
 
 type AMQPProxyOptions struct {
@@ -42,9 +42,13 @@ type AMQPProxyOptions struct {
 	// DisableTLSForLocalEndpoint will disable TLS for the _local_ endpoint, while still using TLS
 	// when communicating with the remote host. This can be used an alternative to accepting self-signed
 	// certificates.
-	// NOTE: even with this flag set to true, no traffic between your machine and Azure is unencrypted.
+	// NOTE: unless DisableTLSForRemoteEndpoint is also set, no traffic between your machine and Azure is unencrypted.
 	DisableTLSForLocalEndpoint bool
 
+	// DisableTLSForRemoteEndpoint will disable TLS when communicating with the remote host. This is
+	// useful when the remote host is a local broker, or an emulator, listening on the plain AMQP port (5672).
+	DisableTLSForRemoteEndpoint bool
+
 	DisableStateTracing bool
 }
 
@@ -60,15 +64,13 @@ func NewAMQPProxy(localEndpoint, remoteEndpoint string, options *AMQPProxyOption
 		panic("remoteEndpoint is not set")
 	}
 
-	// can override for emulator
-	if !strings.Contains(remoteEndpoint, ":") {
-		remoteEndpoint += ":5671"
-	}
-
 	if options == nil {
 		options = &AMQPProxyOptions{}
 	}
 
+	// can override for emulator
+	remoteEndpoint = shared.RemoteEndpointWithPort(remoteEndpoint, options.DisableTLSForRemoteEndpoint)
+
 	amqpProxy := &AMQPProxy{
 		localEndpoint:  localEndpoint,
 		remoteEndpoint: remoteEndpoint,
@@ -79,6 +81,10 @@ func NewAMQPProxy(localEndpoint, remoteEndpoint string, options *AMQPProxyOption
 }
 
 func (fi *AMQPProxy) Close() error {
+	if !fi.closedByUser.CompareAndSwap(false, true) {
+		return nil
+	}
+
 	listener := fi.conn.Swap(nil)
 
 	if listener != nil {
@@ -88,6 +94,18 @@ func (fi *AMQPProxy) Close() error {
 	return nil
 }
 
+// ListenAddr is the address that the proxy is listening on, including the port (ex: 127.0.0.1:39607)
+// If the proxy has not yet started this function returns an empty string.
+func (proxy *AMQPProxy) ListenAddr() string {
+	listener := proxy.conn.Load()
+
+	if listener == nil {
+		return ""
+	}
+
+	return (*listener).Addr().String()
+}
+
 func (proxy *AMQPProxy) ListenAndServe() error {
 	slog.Info("Starting server...")
 
@@ -97,6 +115,8 @@ func (proxy *AMQPProxy) ListenAndServe() error {
 		return err
 	}
 
+	proxy.conn.Store(&listener)
+
 	certFile, keyFile, cert, err := shared.LoadOrCreateCert(proxy.options.CertDir)
 
 	if err != nil {
@@ -135,6 +155,10 @@ func (proxy *AMQPProxy) ListenAndServe() error {
 		localConn, err := listener.Accept()
 
 		if err != nil {
+			if proxy.closedByUser.Load() {
+				return nil
+			}
+
 			slog.Error("Connection failed to accept", "err", err)
 			return err
 		}
@@ -144,7 +168,8 @@ func (proxy *AMQPProxy) ListenAndServe() error {
 			slog.Info("Connection started", "clientip", localConn.RemoteAddr())
 
 			// open up connection to remote host
-			remoteConn, err := net.Dial("tcp4", proxy.remoteEndpoint)
+			slog.Info("Connecting to remote host", "remote", proxy.remoteEndpoint, "tls", !proxy.options.DisableTLSForRemoteEndpoint)
+			remoteConn, err := shared.DialRemote(proxy.remoteEndpoint, proxy.options.DisableTLSForRemoteEndpoint, tlsKeyLogWriter)
 
 			if err != nil {
 				slog.Error("Failed to open remote connection", "endpoint", proxy.remoteEndpoint, "err", err)
@@ -152,13 +177,6 @@ func (proxy *AMQPProxy) ListenAndServe() error {
 			}
 
 			defer utils.CloseWithLogging("remote", remoteConn)
-			slog.Info("Setting up remote TLS connection", "remote", proxy.remoteEndpoint)
-
-			remoteConn = tls.Client(remoteConn, &tls.Config{
-				ServerName: utils.HostOnly(proxy.remoteEndpoint),
-				// TODO: not thread safe....
-				KeyLogWriter: tlsKeyLogWriter,
-			})
 
 			connectionIndex := atomic.AddUint64(&proxy.nextFileID, 1)
 
@@ -60,6 +60,61 @@ func TestAMQPProxy(t *testing.T) {
 	testhelpers.ValidateLog(t, testData.JSONLFile+"-1.json")
 }
 
+func TestAMQPProxy_Broker(t *testing.T) {
+	dir := t.TempDir()
+	jsonlFile := filepath.Join(dir, "amqpproxy-traffic")
+
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	amqpProxy, err := amqpproxy.NewAMQPProxy("127.0.0.1:0", broker.ListenAddr(), &amqpproxy.AMQPProxyOptions{
+		BaseJSONName:                jsonlFile,
+		CertDir:                     dir,
+		DisableTLSForRemoteEndpoint: true,
+	})
+	require.NoError(t, err)
+
+	go func() { _ = amqpProxy.ListenAndServe() }()
+	defer amqpProxy.Close()
+
+	require.Eventually(t, func() bool { return amqpProxy.ListenAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+
+	// the broker accepts any token, so the key doesn't matter.
+	client, err := azservicebus.NewClientFromConnectionString("Endpoint=sb://localhost/;SharedAccessKeyName=keyName;SharedAccessKey=key", &azservicebus.ClientOptions{
+		TLSConfig: &tls.Config{
+			InsecureSkipVerify: true,
+		},
+		CustomEndpoint: amqpProxy.ListenAddr(),
+		RetryOptions: azservicebus.RetryOptions{
+			MaxRetries: -1,
+		},
+	})
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	sender, err := client.NewSender("queue", nil)
+	require.NoError(t, err)
+
+	err = sender.SendMessage(ctx, &azservicebus.Message{
+		Body: []byte("hello world"),
+	}, nil)
+	require.NoError(t, err)
+
+	receiver, err := client.NewReceiverForQueue("queue", nil)
+	require.NoError(t, err)
+
+	messages, err := receiver.ReceiveMessages(ctx, 1, nil)
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "hello world", string(messages[0].Body))
+
+	require.NoError(t, receiver.CompleteMessage(ctx, messages[0], nil))
+	require.NoError(t, client.Close(ctx))
+
+	testhelpers.ValidateLog(t, jsonlFile+"-1.json")
+}
+
 type testAMQPProxy struct {
 	*amqpproxy.AMQPProxy
 	JSONLFile          string
@@ -0,0 +1,278 @@
+package broker
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// Broker is a small, in-memory, AMQP 1.0 broker. It's meant to stand in for a real service,
+// like Service Bus or Event Hubs, so the AMQP proxy and the fault injectors can be tested
+// end-to-end, without any cloud resources.
+//
+// It supports:
+//   - SASL ANONYMOUS and PLAIN.
+//   - Sessions and links, with link credit.
+//   - In-memory queues, which are created the first time they're used.
+//   - $cbs put-token requests, which are always accepted.
+//   - $management requests, which always succeed, with an empty response.
+//
+// The broker listens using plain TCP, so clients (and the fault injector) need to disable TLS
+// when connecting to it.
+type Broker struct {
+	listener     atomic.Pointer[net.Listener]
+	endpoint     string
+	options      BrokerOptions
+	closedByUser atomic.Bool
+
+	// mu protects all of the state below, as well as all the connection, session and link
+	// state. The broker is only used in tests, so simplicity beats throughput. Frames are only queued
+	// while it's held, and written by each connection's own goroutine, so a slow client can't block it.
+	mu     sync.Mutex
+	queues map[string]*queue
+	conns  map[*conn]bool
+}
+
+type BrokerOptions struct {
+	// AddressFile, if set, is where the broker will write its listening address after it starts.
+	AddressFile string
+
+	// Users, if set, are the only username and password combinations that are allowed when using
+	// SASL PLAIN. ANONYMOUS is not allowed when Users is set.
+	//
+	// If nil, any credentials are accepted.
+	Users map[string]string
+}
+
+// NewBroker creates a Broker. Call [Broker.ListenAndServe] to start accepting connections.
+//   - endpoint is the address to listen on (ex: 127.0.0.1:5672). Use port 0 to have a port
+//     picked for you, and [Broker.ListenAddr] to get the address once it's started.
+func NewBroker(endpoint string, options *BrokerOptions) *Broker {
+	if endpoint == "" {
+		panic("endpoint is not set")
+	}
+
+	if options == nil {
+		options = &BrokerOptions{}
+	}
+
+	return &Broker{
+		endpoint: endpoint,
+		options:  *options,
+		queues:   map[string]*queue{},
+		conns:    map[*conn]bool{},
+	}
+}
+
+// ListenAndServe starts listening and accepts connections until [Broker.Close] is called.
+func (b *Broker) ListenAndServe() error {
+	listener, err := net.Listen("tcp4", b.endpoint)
+
+	if err != nil {
+		return err
+	}
+
+	b.listener.Store(&listener)
+
+	defer func() {
+		if !b.closedByUser.Load() {
+			utils.CloseWithLogging("broker listener", listener)
+		}
+	}()
+
+	if b.options.AddressFile != "" {
+		if err := os.WriteFile(b.options.AddressFile, []byte(listener.Addr().String()), 0777); err != nil {
+			return fmt.Errorf("failed to create file to write address file at %s: %w", b.options.AddressFile, err)
+		}
+
+		defer os.Remove(b.options.AddressFile)
+	}
+
+	slog.Info("Broker started, listening for connections...", "address", listener.Addr().String())
+
+	for {
+		netConn, err := listener.Accept()
+
+		if err != nil {
+			if !b.closedByUser.Load() {
+				slog.Error("Broker connection failed to accept", "err", err)
+				return err
+			}
+
+			return nil
+		}
+
+		c := newConn(b, netConn)
+
+		b.mu.Lock()
+		b.conns[c] = true
+		b.mu.Unlock()
+
+		go func() {
+			if err := c.serve(); err != nil {
+				slog.Info("Broker connection closed with error", "clientip", netConn.RemoteAddr(), "err", err)
+			}
+
+			b.mu.Lock()
+			delete(b.conns, c)
+			c.cleanup()
+			b.mu.Unlock()
+		}()
+	}
+}
+
+// ListenAddr is the address that the broker is listening on, including the port (ex: 127.0.0.1:39607)
+// If the broker has not yet started this function returns an empty string.
+func (b *Broker) ListenAddr() string {
+	listener := b.listener.Load()
+
+	if listener == nil {
+		return ""
+	}
+
+	return (*listener).Addr().String()
+}
+
+// Close stops the listener and closes any open connections.
+func (b *Broker) Close() error {
+	if !b.closedByUser.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	b.mu.Lock()
+
+	for c := range b.conns {
+		_ = c.netConn.Close()
+	}
+
+	b.mu.Unlock()
+
+	listener := b.listener.Swap(nil)
+
+	if listener != nil {
+		return (*listener).Close()
+	}
+
+	return nil
+}
+
+// Send adds a message to a queue, as if it had been sent by a client.
+func (b *Broker) Send(queueName string, message *models.Message) error {
+	payload, err := message.MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.enqueue(queueName, payload)
+	return nil
+}
+
+// Messages returns the messages that are in a queue, and haven't yet been delivered to a receiver.
+func (b *Broker) Messages(queueName string) ([]*models.Message, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	q := b.queues[queueName]
+
+	if q == nil {
+		return nil, nil
+	}
+
+	var messages []*models.Message
+
+	for _, payload := range q.messages {
+		m := &models.Message{}
+
+		if err := m.UnmarshalBinary(payload); err != nil {
+			return nil, err
+		}
+
+		messages = append(messages, m)
+	}
+
+	return messages, nil
+}
+
+// queue holds messages that are waiting to be delivered, and the links that they can be delivered to.
+type queue struct {
+	messages [][]byte
+
+	// receivers are the broker's sending links - from the client's point of view they're
+	// receivers.
+	receivers []*link
+
+	// next is the index of the receiver we'll try first, the next time we dispatch messages,
+	// so we spread messages out amongst receivers.
+	next int
+}
+
+// getQueue returns the queue, creating it if needed.
+// NOTE: b.mu must be held.
+func (b *Broker) getQueue(name string) *queue {
+	q := b.queues[name]
+
+	if q == nil {
+		q = &queue{}
+		b.queues[name] = q
+	}
+
+	return q
+}
+
+// enqueue adds a message to the end of the queue, and delivers any messages that we can.
+// NOTE: b.mu must be held.
+func (b *Broker) enqueue(name string, payload []byte) {
+	q := b.getQueue(name)
+	q.messages = append(q.messages, payload)
+	b.dispatch(q)
+}
+
+// requeue puts an undelivered message back at the front of the queue, and delivers any messages that we can.
+// NOTE: b.mu must be held.
+func (b *Broker) requeue(name string, payload []byte) {
+	q := b.getQueue(name)
+	q.messages = append([][]byte{payload}, q.messages...)
+	b.dispatch(q)
+}
+
+// dispatch sends as many messages as possible to the receivers attached to this queue,
+// based on their link credit.
+// NOTE: b.mu must be held.
+func (b *Broker) dispatch(q *queue) {
+	for len(q.messages) > 0 {
+		var target *link
+
+		for i := range len(q.receivers) {
+			l := q.receivers[(q.next+i)%len(q.receivers)]
+
+			if l.credit > 0 {
+				target = l
+				q.next = (q.next + i + 1) % len(q.receivers)
+				break
+			}
+		}
+
+		if target == nil {
+			return
+		}
+
+		payload := q.messages[0]
+		q.messages = q.messages[1:]
+
+		if err := target.session.conn.sendMessage(target, payload); err != nil {
+			slog.Info("Failed to deliver message, requeueing", "address", target.address, "err", err)
+			q.messages = append([][]byte{payload}, q.messages...)
+			return
+		}
+	}
+}
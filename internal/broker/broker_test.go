@@ -0,0 +1,305 @@
+package broker_test
+
+import (
+	"context"
+	"math"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/broker"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBroker_SendAndReceive(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	for _, body := range []string{"hello", "world"} {
+		require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil))
+	}
+
+	messages, err := b.Messages("queue")
+	require.NoError(t, err)
+	require.Equal(t, 2, len(messages))
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	for _, expected := range []string{"hello", "world"} {
+		msg := mustReceive(t, receiver)
+		require.Equal(t, expected, string(msg.GetData()))
+		require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+	}
+
+	messages, err = b.Messages("queue")
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func TestBroker_ReleasedMessagesAreRedelivered(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	require.NoError(t, b.Send("queue", models.NewMessage([]byte("hello"))))
+
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	msg := mustReceive(t, receiver)
+	require.NoError(t, receiver.ReleaseMessage(context.Background(), msg))
+
+	msg = mustReceive(t, receiver)
+	require.Equal(t, "hello", string(msg.GetData()))
+	require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+}
+
+func TestBroker_UnsettledMessagesAreRequeuedOnDetach(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	require.NoError(t, b.Send("queue", models.NewMessage([]byte("hello"))))
+
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	_ = mustReceive(t, receiver)
+	require.NoError(t, receiver.Close(context.Background()))
+
+	messages, err := b.Messages("queue")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "hello", string(messages[0].GetData()))
+}
+
+func TestBroker_LargeMessages(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+
+	// small enough that messages have to be split into multiple TRANSFER frames, in both directions.
+	session := newSessionForTest(t, b.ListenAddr(), &amqp.ConnOptions{MaxFrameSize: 512})
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	body := strings.Repeat("0123456789", 1000)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil))
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	msg := mustReceive(t, receiver)
+	require.Equal(t, body, string(msg.GetData()))
+}
+
+func TestBroker_SASLPlain(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, &broker.BrokerOptions{
+		Users: map[string]string{"user": "password"},
+	})
+
+	_ = newSessionForTest(t, b.ListenAddr(), &amqp.ConnOptions{SASLType: amqp.SASLTypePlain("user", "password")})
+
+	for _, saslType := range []amqp.SASLType{amqp.SASLTypePlain("user", "wrong password"), amqp.SASLTypeAnonymous()} {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		conn, err := amqp.Dial(ctx, "amqp://"+b.ListenAddr(), &amqp.ConnOptions{SASLType: saslType})
+		cancel()
+
+		if conn != nil {
+			_ = conn.Close()
+		}
+
+		require.Error(t, err)
+	}
+}
+
+func TestBroker_CBS(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	sender, err := session.NewSender(context.Background(), "$cbs", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "$cbs", &amqp.ReceiverOptions{TargetAddress: "reply-to-address"})
+	require.NoError(t, err)
+
+	require.NoError(t, sender.Send(context.Background(), &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			MessageID: "message-id",
+			ReplyTo:   utils.Ptr("reply-to-address"),
+		},
+		ApplicationProperties: map[string]any{
+			"operation": "put-token",
+			"type":      "jwt",
+			"name":      "amqp://localhost/queue",
+		},
+		Value: "token",
+	}, nil))
+
+	msg := mustReceive(t, receiver)
+	require.Equal(t, "message-id", msg.Properties.CorrelationID)
+	require.Equal(t, int32(202), msg.ApplicationProperties["status-code"])
+	require.Equal(t, "Accepted", msg.ApplicationProperties["status-description"])
+}
+
+func TestBroker_Management(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	sender, err := session.NewSender(context.Background(), "queue/$management", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue/$management", &amqp.ReceiverOptions{TargetAddress: "reply-to-address"})
+	require.NoError(t, err)
+
+	require.NoError(t, sender.Send(context.Background(), &amqp.Message{
+		Properties: &amqp.MessageProperties{
+			MessageID: "message-id",
+			ReplyTo:   utils.Ptr("reply-to-address"),
+		},
+		ApplicationProperties: map[string]any{
+			"operation": "com.microsoft:renew-lock",
+		},
+		Value: map[string]any{},
+	}, nil))
+
+	msg := mustReceive(t, receiver)
+	require.Equal(t, "message-id", msg.Properties.CorrelationID)
+	require.Equal(t, int32(200), msg.ApplicationProperties["statusCode"])
+	require.Equal(t, "OK", msg.ApplicationProperties["statusDescription"])
+}
+
+func TestBroker_StuckClient(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+
+	// this client gives the broker credit, but never reads what it's sent.
+	_ = newRawReceiverForTest(t, b.ListenAddr(), "stuck", 1000)
+
+	sent := make(chan error, 1)
+
+	go func() {
+		// far more than fits in the socket's buffers.
+		payload := strings.Repeat("0123456789", 10000)
+
+		for range 200 {
+			if err := b.Send("stuck", models.NewMessage([]byte(payload))); err != nil {
+				sent <- err
+				return
+			}
+		}
+
+		sent <- nil
+	}()
+
+	select {
+	case err := <-sent:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.FailNow(t, "the stuck client blocked the broker")
+	}
+
+	// other clients aren't held up either.
+	session := newSessionForTest(t, b.ListenAddr(), nil)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+}
+
+func TestBroker_DispositionRange(t *testing.T) {
+	b := testhelpers.NewBrokerForTest(t, nil)
+	require.NoError(t, b.Send("queue", models.NewMessage([]byte("hello"))))
+
+	rw := newRawReceiverForTest(t, b.ListenAddr(), "queue", 1)
+
+	// releasing every delivery id only requeues the one that's been sent.
+	require.NoError(t, rw.Write(frames.Frame{Body: &frames.PerformDisposition{
+		Role:    encoding.RoleReceiver,
+		First:   0,
+		Last:    utils.Ptr(uint32(math.MaxUint32)),
+		Settled: true,
+		State:   &encoding.StateReleased{},
+	}}))
+
+	require.Eventually(t, func() bool {
+		messages, err := b.Messages("queue")
+		return err == nil && len(messages) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// newRawReceiverForTest attaches a receiver, with credit, without using a client library, so tests can send
+// frames that a real client wouldn't, or stop reading. Nothing is read after the broker's ATTACH.
+func newRawReceiverForTest(t *testing.T, addr string, queue string, credit uint32) *frames.ConnReadWriter {
+	netConn, err := net.Dial("tcp", addr)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = netConn.Close() })
+
+	rw := frames.NewConnReadWriter(netConn)
+
+	require.NoError(t, rw.Write(frames.Raw("AMQP\x00\x01\x00\x00")))
+
+	for _, body := range []frames.Body{
+		&frames.PerformOpen{ContainerID: "raw", MaxFrameSize: 65536},
+		&frames.PerformBegin{IncomingWindow: 5000, OutgoingWindow: 5000},
+		&frames.PerformAttach{Name: "raw", Role: encoding.RoleReceiver, Source: &frames.Source{Address: queue}},
+	} {
+		require.NoError(t, rw.Write(frames.Frame{Body: body}))
+	}
+
+	for item, err := range rw.Iter() {
+		require.NoError(t, err)
+
+		if fr, isFrame := item.(*frames.Frame); isFrame && fr.Body.Type() == frames.BodyTypeAttach {
+			break
+		}
+	}
+
+	require.NoError(t, rw.Write(frames.Frame{Body: &frames.PerformFlow{
+		NextIncomingID: utils.Ptr(uint32(0)),
+		IncomingWindow: 5000,
+		OutgoingWindow: 5000,
+		Handle:         utils.Ptr(uint32(0)),
+		DeliveryCount:  utils.Ptr(uint32(0)),
+		LinkCredit:     utils.Ptr(credit),
+	}}))
+
+	return rw
+}
+
+func newSessionForTest(t *testing.T, addr string, options *amqp.ConnOptions) *amqp.Session {
+	if options == nil {
+		options = &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous()}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := amqp.Dial(ctx, "amqp://"+addr, options)
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	session, err := conn.NewSession(ctx, nil)
+	require.NoError(t, err)
+
+	return session
+}
+
+func mustReceive(t *testing.T, receiver *amqp.Receiver) *amqp.Message {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := receiver.Receive(ctx, nil)
+	require.NoError(t, err)
+
+	return msg
+}
@@ -0,0 +1,954 @@
+package broker
+
+import (
+	"bytes"
+	"cmp"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"maps"
+	"math"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+const (
+	containerID = "amqpfaultinjector-broker"
+
+	// maxFrameSize is the largest frame we'll accept from a client.
+	maxFrameSize uint32 = 65536
+
+	// sessionWindow is the incoming and outgoing window we advertise for each session.
+	sessionWindow uint32 = 5000
+
+	// linkCredit is the credit we give to each client sender. It's replenished once it
+	// falls below half.
+	linkCredit uint32 = 1000
+
+	cbsAddress = "$cbs"
+
+	// managementSuffix is the suffix for $management addresses (ex: "queue/$management").
+	managementSuffix = "$management"
+
+	// flushTimeout is how long we wait, when a connection ends, for the frames we've queued to be written.
+	flushTimeout = 5 * time.Second
+)
+
+var (
+	saslPreamble = frames.Preamble("AMQP\x03\x01\x00\x00")
+	amqpPreamble = frames.Preamble("AMQP\x00\x01\x00\x00")
+)
+
+// conn is a single client connection to the broker.
+type conn struct {
+	broker  *Broker
+	netConn net.Conn
+	rw      *frames.ConnReadWriter
+	logger  *slog.Logger
+
+	// outMu protects the frames that are waiting to be written, by writeLoop. Nothing writes to the
+	// connection while holding broker.mu, so a slow (or stuck) client can't hold up the rest of the broker.
+	outMu     sync.Mutex
+	outCond   *sync.Cond
+	out       [][]byte
+	outClosed bool
+
+	// done is closed when the connection has stopped serving.
+	done chan struct{}
+
+	// The fields below are protected by broker.mu
+
+	// peerMaxFrameSize is the max frame size from the client's OPEN frame.
+	peerMaxFrameSize uint32
+
+	// sessions, by the client's channel.
+	sessions map[uint16]*session
+}
+
+type session struct {
+	conn *conn
+
+	// channel is the channel we use when sending frames for this session.
+	channel uint16
+
+	// remoteChannel is the channel that the client uses for this session.
+	remoteChannel uint16
+
+	nextIncomingID uint32
+	nextOutgoingID uint32
+	nextDeliveryID uint32
+
+	// incomingSinceFlow is the number of TRANSFER frames we've received since we last
+	// told the client about our incoming window.
+	incomingSinceFlow uint32
+
+	// links, by the client's handle.
+	links map[uint32]*link
+
+	// unsettled are the deliveries we've sent, but the client hasn't settled, by delivery ID.
+	unsettled map[uint32]*delivery
+}
+
+type link struct {
+	session *session
+	name    string
+
+	// handle is the handle we use when sending frames for this link.
+	handle uint32
+
+	// remoteHandle is the handle the client uses for this link.
+	remoteHandle uint32
+
+	// sender is true if the broker is the sender for this link (ie: the client is receiving).
+	sender bool
+
+	// address is the source address, for a link where the broker is sending, or the target
+	// address for a link where the broker is receiving.
+	address string
+
+	// queueName is the queue that a sending link takes messages from. It's the same as address,
+	// except for $cbs and $management links, where it's the reply-to address.
+	queueName string
+
+	deliveryCount uint32
+	credit        uint32
+	drain         bool
+
+	// settled is true if we send deliveries pre-settled (sender settle mode of 'settled').
+	settled bool
+
+	// state for a (multi-frame) delivery we're receiving.
+	receiving          bool
+	incomingDeliveryID *uint32
+	incomingSettled    bool
+	incomingPayload    []byte
+}
+
+type delivery struct {
+	link    *link
+	payload []byte
+}
+
+func newConn(b *Broker, netConn net.Conn) *conn {
+	c := &conn{
+		broker:   b,
+		netConn:  netConn,
+		rw:       frames.NewConnReadWriter(netConn),
+		logger:   slog.With("clientip", netConn.RemoteAddr().String()),
+		done:     make(chan struct{}),
+		sessions: map[uint16]*session{},
+	}
+
+	c.outCond = sync.NewCond(&c.outMu)
+	return c
+}
+
+// serve processes frames from the client until the connection is closed.
+func (c *conn) serve() error {
+	defer close(c.done)
+	defer utils.CloseWithLogging("broker connection", c.netConn)
+
+	writeLoopDone := make(chan struct{})
+
+	go func() {
+		defer close(writeLoopDone)
+		c.writeLoop()
+	}()
+
+	defer func() {
+		// send anything that's still queued (ex: our reply to a CLOSE) before the connection is closed.
+		c.stopWriting(time.Now().Add(flushTimeout))
+		<-writeLoopDone
+	}()
+
+	c.logger.Info("Broker connection started")
+
+	for item, err := range c.rw.Iter() {
+		if err != nil {
+			return err
+		}
+
+		c.broker.mu.Lock()
+		done, err := c.handleItem(item)
+		c.broker.mu.Unlock()
+
+		if err != nil {
+			return err
+		}
+
+		if done {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+// cleanup detaches any links that were still attached when the connection ended.
+// NOTE: broker.mu must be held.
+func (c *conn) cleanup() {
+	for _, s := range c.sessions {
+		s.detachAll()
+	}
+
+	c.sessions = map[uint16]*session{}
+}
+
+// handleItem processes a single preamble or frame from the client. It returns true if
+// the connection should be closed.
+// NOTE: broker.mu must be held.
+func (c *conn) handleItem(item frames.PreambleOrFrame) (bool, error) {
+	switch item := item.(type) {
+	case frames.Preamble:
+		return c.handlePreamble(item)
+	case *frames.Frame:
+		return c.handleFrame(item)
+	default:
+		return true, fmt.Errorf("unexpected item type %T", item)
+	}
+}
+
+func (c *conn) handlePreamble(preamble frames.Preamble) (bool, error) {
+	switch {
+	case bytes.Equal(preamble, saslPreamble):
+		if err := c.writeBytes(saslPreamble); err != nil {
+			return true, err
+		}
+
+		return false, c.writeFrame(frames.FrameTypeSASL, 0, &frames.SASLMechanisms{Mechanisms: c.broker.mechanisms()})
+	case bytes.Equal(preamble, amqpPreamble):
+		return false, c.writeBytes(amqpPreamble)
+	default:
+		// we're supposed to reply with the protocol header we _do_ support, and then close the connection.
+		return true, errors.Join(fmt.Errorf("unsupported protocol header %q", []byte(preamble)), c.writeBytes(amqpPreamble))
+	}
+}
+
+func (c *conn) handleFrame(fr *frames.Frame) (bool, error) {
+	switch body := fr.Body.(type) {
+	case *frames.EmptyFrame:
+		// keep-alive, nothing to do.
+		return false, nil
+	case *frames.SASLInit:
+		if !c.broker.authenticate(body) {
+			return true, errors.Join(
+				fmt.Errorf("authentication failed using %s", body.Mechanism),
+				c.writeFrame(frames.FrameTypeSASL, 0, &frames.SASLOutcome{Code: encoding.CodeSASLAuth}))
+		}
+
+		return false, c.writeFrame(frames.FrameTypeSASL, 0, &frames.SASLOutcome{Code: encoding.CodeSASLOK})
+	case *frames.PerformOpen:
+		return false, c.handleOpen(body)
+	case *frames.PerformBegin:
+		return false, c.handleBegin(fr.Header.Channel, body)
+	case *frames.PerformClose:
+		c.logger.Info("Broker connection closed by client", "error", body.Error)
+		return true, c.writeFrame(frames.FrameTypeAMQP, 0, &frames.PerformClose{})
+	}
+
+	// everything else is session scoped.
+	s := c.sessions[fr.Header.Channel]
+
+	if s == nil {
+		return true, fmt.Errorf("received %s frame for channel %d, which has no session", fr.Body.Type(), fr.Header.Channel)
+	}
+
+	switch body := fr.Body.(type) {
+	case *frames.PerformAttach:
+		return false, s.handleAttach(body)
+	case *frames.PerformFlow:
+		return false, s.handleFlow(body)
+	case *frames.PerformTransfer:
+		return false, s.handleTransfer(body)
+	case *frames.PerformDisposition:
+		return false, s.handleDisposition(body)
+	case *frames.PerformDetach:
+		return false, s.handleDetach(body)
+	case *frames.PerformEnd:
+		s.detachAll()
+		delete(c.sessions, fr.Header.Channel)
+		return false, c.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformEnd{})
+	default:
+		c.logger.Warn("Broker ignoring unhandled frame", "type", fr.Body.Type())
+		return false, nil
+	}
+}
+
+func (c *conn) handleOpen(body *frames.PerformOpen) error {
+	c.peerMaxFrameSize = body.MaxFrameSize
+
+	if err := c.writeFrame(frames.FrameTypeAMQP, 0, &frames.PerformOpen{
+		ContainerID:  containerID,
+		MaxFrameSize: maxFrameSize,
+		ChannelMax:   math.MaxUint16,
+	}); err != nil {
+		return err
+	}
+
+	if body.IdleTimeout > 0 {
+		// the client expects to hear from us at least this often, or it'll consider the connection dead.
+		go c.keepAlive(body.IdleTimeout / 2)
+	}
+
+	return nil
+}
+
+func (c *conn) keepAlive(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+			if err := c.writeFrame(frames.FrameTypeAMQP, 0, &frames.EmptyFrame{}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (c *conn) handleBegin(remoteChannel uint16, body *frames.PerformBegin) error {
+	if body.RemoteChannel != nil {
+		return fmt.Errorf("received BEGIN with a remote channel (%d), but the broker never starts sessions", *body.RemoteChannel)
+	}
+
+	if c.sessions[remoteChannel] != nil {
+		return fmt.Errorf("received BEGIN for channel %d, which already has a session", remoteChannel)
+	}
+
+	s := &session{
+		conn:           c,
+		channel:        c.allocateChannel(),
+		remoteChannel:  remoteChannel,
+		nextIncomingID: body.NextOutgoingID,
+		links:          map[uint32]*link{},
+		unsettled:      map[uint32]*delivery{},
+	}
+
+	c.sessions[remoteChannel] = s
+
+	return c.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformBegin{
+		RemoteChannel:  &remoteChannel,
+		NextOutgoingID: s.nextOutgoingID,
+		IncomingWindow: sessionWindow,
+		OutgoingWindow: sessionWindow,
+		HandleMax:      math.MaxUint32,
+	})
+}
+
+// allocateChannel returns the lowest channel that isn't in use by one of our sessions.
+func (c *conn) allocateChannel() uint16 {
+	used := map[uint16]bool{}
+
+	for _, s := range c.sessions {
+		used[s.channel] = true
+	}
+
+	var ch uint16
+
+	for used[ch] {
+		ch++
+	}
+
+	return ch
+}
+
+// sendMessage sends a message to the client, over link l, splitting it into multiple TRANSFER frames if
+// it's larger than the client's max frame size.
+// NOTE: broker.mu must be held.
+func (c *conn) sendMessage(l *link, payload []byte) error {
+	s := l.session
+
+	deliveryID := s.nextDeliveryID
+	s.nextDeliveryID++
+
+	transfer := &frames.PerformTransfer{
+		Handle:        l.handle,
+		DeliveryID:    &deliveryID,
+		DeliveryTag:   binary.BigEndian.AppendUint32(nil, deliveryID),
+		MessageFormat: utils.Ptr(uint32(0)),
+		Settled:       l.settled,
+	}
+
+	remaining := payload
+
+	for {
+		overhead, err := (frames.Frame{Body: transfer}).MarshalAMQP()
+
+		if err != nil {
+			return err
+		}
+
+		// a little extra room, since the encoding for the payload's size varies based on its length.
+		room := int(c.peerMaxFrameSize) - len(overhead) - 8
+
+		if room <= 0 {
+			return fmt.Errorf("max frame size %d is too small to send a TRANSFER", c.peerMaxFrameSize)
+		}
+
+		transfer.Payload = remaining[:min(room, len(remaining))]
+		remaining = remaining[len(transfer.Payload):]
+		transfer.More = len(remaining) > 0
+
+		if err := c.writeFrame(frames.FrameTypeAMQP, s.channel, transfer); err != nil {
+			return err
+		}
+
+		s.nextOutgoingID++
+
+		if !transfer.More {
+			break
+		}
+
+		// continuation frames only need the handle.
+		transfer = &frames.PerformTransfer{Handle: l.handle}
+	}
+
+	l.deliveryCount++
+	l.credit--
+
+	if !l.settled {
+		s.unsettled[deliveryID] = &delivery{link: l, payload: payload}
+	}
+
+	return nil
+}
+
+func (c *conn) writeFrame(frameType uint8, channel uint16, body frames.Body) error {
+	return c.writeItem(frames.Frame{
+		Header: frames.Header{FrameType: frameType, Channel: channel},
+		Body:   body,
+	})
+}
+
+func (c *conn) writeBytes(data []byte) error {
+	return c.writeItem(frames.Raw(data))
+}
+
+// writeItem queues item to be written, by writeLoop. It never blocks on the network, so it's safe to call
+// while holding broker.mu.
+func (c *conn) writeItem(item interface{ MarshalAMQP() ([]byte, error) }) error {
+	data, err := item.MarshalAMQP()
+
+	if err != nil {
+		return err
+	}
+
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	if c.outClosed {
+		return net.ErrClosed
+	}
+
+	c.out = append(c.out, data)
+	c.outCond.Signal()
+	return nil
+}
+
+// writeLoop writes the queued frames to the connection, in order, until stopWriting is called and the queue
+// is empty, or a write fails.
+func (c *conn) writeLoop() {
+	for {
+		c.outMu.Lock()
+
+		for len(c.out) == 0 && !c.outClosed {
+			c.outCond.Wait()
+		}
+
+		pending := c.out
+		c.out = nil
+		c.outMu.Unlock()
+
+		if len(pending) == 0 {
+			// closed, and there's nothing left to send.
+			return
+		}
+
+		for _, data := range pending {
+			if err := c.rw.Write(frames.Raw(data)); err != nil {
+				c.logger.Info("Broker failed writing to connection", "err", err)
+
+				// the reader will see the connection's closed, and clean up.
+				c.stopWriting(time.Time{})
+				_ = c.netConn.Close()
+				return
+			}
+		}
+	}
+}
+
+// stopWriting stops any more frames from being queued. Frames that are already queued are still written,
+// unless deadline (if it's set) passes first.
+func (c *conn) stopWriting(deadline time.Time) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+
+	c.outClosed = true
+	c.outCond.Broadcast()
+
+	if !deadline.IsZero() {
+		_ = c.netConn.SetWriteDeadline(deadline)
+	}
+}
+
+func (s *session) handleAttach(body *frames.PerformAttach) error {
+	if s.links[body.Handle] != nil {
+		return fmt.Errorf("received ATTACH for handle %d, which is already in use", body.Handle)
+	}
+
+	l := &link{
+		session:      s,
+		name:         body.Name,
+		handle:       s.allocateHandle(),
+		remoteHandle: body.Handle,
+		sender:       body.Role == encoding.RoleReceiver,
+	}
+
+	reply := &frames.PerformAttach{
+		Name:               body.Name,
+		Handle:             l.handle,
+		Role:               !body.Role,
+		SenderSettleMode:   body.SenderSettleMode,
+		ReceiverSettleMode: body.ReceiverSettleMode,
+		Source:             body.Source,
+		Target:             body.Target,
+	}
+
+	if l.sender {
+		if body.Source != nil {
+			l.address = body.Source.Address
+		}
+
+		l.queueName = l.address
+
+		if isRequestResponseAddress(l.address) && body.Target != nil {
+			// $cbs and $management replies are sent to the request's reply-to address, which is the target
+			// address of the client's receiver.
+			l.queueName = body.Target.Address
+		}
+
+		l.settled = body.SenderSettleMode != nil && *body.SenderSettleMode == encoding.SenderSettleModeSettled
+	} else {
+		if body.Target != nil {
+			l.address = body.Target.Address
+		}
+
+		l.deliveryCount = body.InitialDeliveryCount
+	}
+
+	s.links[body.Handle] = l
+	s.conn.logger.Info("Broker link attached", "name", l.name, "address", l.address, "sender", l.sender)
+
+	if err := s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, reply); err != nil {
+		return err
+	}
+
+	if l.sender {
+		// we can't send anything until the client gives us credit.
+		q := s.conn.broker.getQueue(l.queueName)
+		q.receivers = append(q.receivers, l)
+		return nil
+	}
+
+	l.credit = linkCredit
+	return s.sendLinkFlow(l)
+}
+
+// allocateHandle returns the lowest handle that isn't in use by one of our links.
+func (s *session) allocateHandle() uint32 {
+	used := map[uint32]bool{}
+
+	for _, l := range s.links {
+		used[l.handle] = true
+	}
+
+	var h uint32
+
+	for used[h] {
+		h++
+	}
+
+	return h
+}
+
+func (s *session) handleFlow(body *frames.PerformFlow) error {
+	if body.Handle == nil {
+		if body.Echo {
+			return s.sendSessionFlow()
+		}
+
+		return nil
+	}
+
+	l := s.links[*body.Handle]
+
+	if l == nil {
+		return fmt.Errorf("received FLOW for handle %d, which isn't attached", *body.Handle)
+	}
+
+	if l.sender {
+		var deliveryCount, credit uint32
+
+		if body.DeliveryCount != nil {
+			deliveryCount = *body.DeliveryCount
+		}
+
+		if body.LinkCredit != nil {
+			credit = *body.LinkCredit
+		}
+
+		// from the spec: link-credit(snd) := delivery-count(rcv) + link-credit(rcv) - delivery-count(snd)
+		l.credit = uint32(max(int64(deliveryCount)+int64(credit)-int64(l.deliveryCount), 0))
+		l.drain = body.Drain
+
+		s.conn.broker.dispatch(s.conn.broker.getQueue(l.queueName))
+
+		if l.drain {
+			// we've sent everything we have, so the rest of the credit is used up by advancing the delivery count.
+			l.deliveryCount += l.credit
+			l.credit = 0
+
+			err := s.sendLinkFlow(l)
+			l.drain = false
+			return err
+		}
+	}
+
+	if body.Echo {
+		return s.sendLinkFlow(l)
+	}
+
+	return nil
+}
+
+func (s *session) handleTransfer(body *frames.PerformTransfer) error {
+	s.nextIncomingID++
+	s.incomingSinceFlow++
+
+	if s.incomingSinceFlow >= sessionWindow/2 {
+		if err := s.sendSessionFlow(); err != nil {
+			return err
+		}
+	}
+
+	l := s.links[body.Handle]
+
+	if l == nil {
+		return fmt.Errorf("received TRANSFER for handle %d, which isn't attached", body.Handle)
+	}
+
+	if l.sender {
+		return fmt.Errorf("received TRANSFER for handle %d, but the client is the receiver for that link", body.Handle)
+	}
+
+	if !l.receiving {
+		l.receiving = true
+		l.incomingDeliveryID = body.DeliveryID
+		l.incomingSettled = body.Settled
+		l.incomingPayload = nil
+	}
+
+	if body.Aborted {
+		l.receiving = false
+		l.incomingPayload = nil
+		return nil
+	}
+
+	l.incomingPayload = append(l.incomingPayload, body.Payload...)
+
+	if body.More {
+		return nil
+	}
+
+	payload, deliveryID, settled := l.incomingPayload, l.incomingDeliveryID, l.incomingSettled
+	l.receiving = false
+	l.incomingPayload = nil
+
+	l.deliveryCount++
+
+	if l.credit > 0 {
+		l.credit--
+	}
+
+	switch {
+	case l.address == cbsAddress:
+		if err := s.conn.broker.handleCBSRequest(payload); err != nil {
+			return err
+		}
+	case strings.HasSuffix(l.address, managementSuffix):
+		if err := s.conn.broker.handleManagementRequest(payload); err != nil {
+			return err
+		}
+	default:
+		s.conn.broker.enqueue(l.address, payload)
+	}
+
+	if !settled && deliveryID != nil {
+		if err := s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformDisposition{
+			Role:    encoding.RoleReceiver,
+			First:   *deliveryID,
+			Settled: true,
+			State:   &encoding.StateAccepted{},
+		}); err != nil {
+			return err
+		}
+	}
+
+	if l.credit <= linkCredit/2 {
+		l.credit = linkCredit
+		return s.sendLinkFlow(l)
+	}
+
+	return nil
+}
+
+func (s *session) handleDisposition(body *frames.PerformDisposition) error {
+	if body.Role != encoding.RoleReceiver {
+		// we settle everything we receive, as soon as we receive it, so there's nothing to do.
+		return nil
+	}
+
+	last := body.First
+
+	if body.Last != nil {
+		last = *body.Last
+	}
+
+	// the range can be huge (and it can wrap), so we only look at the deliveries that we're tracking.
+	var ids []uint32
+
+	for id := range s.unsettled {
+		if id-body.First <= last-body.First {
+			ids = append(ids, id)
+		}
+	}
+
+	slices.SortFunc(ids, func(a, b uint32) int { return cmp.Compare(a-body.First, b-body.First) })
+
+	for _, id := range ids {
+		d := s.unsettled[id]
+
+		switch body.State.(type) {
+		case *encoding.StateReleased, *encoding.StateModified:
+			delete(s.unsettled, id)
+			s.conn.broker.requeue(d.link.queueName, d.payload)
+		case nil:
+			// settled, without an outcome, is the same as accepting it.
+			if body.Settled {
+				delete(s.unsettled, id)
+			}
+		default:
+			// accepted, or rejected. There's no dead-letter queue, so the message is gone.
+			delete(s.unsettled, id)
+		}
+	}
+
+	if body.Settled || body.State == nil {
+		return nil
+	}
+
+	// the client is using receiver settle mode 'second', and is waiting for us to settle.
+	return s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformDisposition{
+		Role:    encoding.RoleSender,
+		First:   body.First,
+		Last:    body.Last,
+		Settled: true,
+		State:   body.State,
+	})
+}
+
+func (s *session) handleDetach(body *frames.PerformDetach) error {
+	l := s.links[body.Handle]
+
+	if l == nil {
+		return fmt.Errorf("received DETACH for handle %d, which isn't attached", body.Handle)
+	}
+
+	s.detach(l)
+	s.conn.logger.Info("Broker link detached", "name", l.name, "address", l.address, "error", body.Error)
+
+	return s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformDetach{
+		Handle: l.handle,
+		Closed: body.Closed,
+	})
+}
+
+// detach removes the link, and puts any messages that were delivered, but not settled, back into the queue.
+func (s *session) detach(l *link) {
+	delete(s.links, l.remoteHandle)
+
+	if !l.sender {
+		return
+	}
+
+	b := s.conn.broker
+	q := b.getQueue(l.queueName)
+	q.receivers = slices.DeleteFunc(q.receivers, func(other *link) bool { return other == l })
+
+	if q.next >= len(q.receivers) {
+		q.next = 0
+	}
+
+	ids := slices.Sorted(maps.Keys(s.unsettled))
+
+	// requeue (which adds to the front) in reverse, so the messages keep their original order.
+	for _, id := range slices.Backward(ids) {
+		if d := s.unsettled[id]; d.link == l {
+			delete(s.unsettled, id)
+			b.requeue(l.queueName, d.payload)
+		}
+	}
+}
+
+func (s *session) detachAll() {
+	for _, l := range s.links {
+		s.detach(l)
+	}
+}
+
+func (s *session) sendSessionFlow() error {
+	s.incomingSinceFlow = 0
+
+	return s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformFlow{
+		NextIncomingID: utils.Ptr(s.nextIncomingID),
+		IncomingWindow: sessionWindow,
+		NextOutgoingID: s.nextOutgoingID,
+		OutgoingWindow: sessionWindow,
+	})
+}
+
+func (s *session) sendLinkFlow(l *link) error {
+	s.incomingSinceFlow = 0
+
+	return s.conn.writeFrame(frames.FrameTypeAMQP, s.channel, &frames.PerformFlow{
+		NextIncomingID: utils.Ptr(s.nextIncomingID),
+		IncomingWindow: sessionWindow,
+		NextOutgoingID: s.nextOutgoingID,
+		OutgoingWindow: sessionWindow,
+		Handle:         utils.Ptr(l.handle),
+		DeliveryCount:  utils.Ptr(l.deliveryCount),
+		LinkCredit:     utils.Ptr(l.credit),
+		Drain:          l.drain,
+	})
+}
+
+// mechanisms are the SASL mechanisms that the broker supports.
+func (b *Broker) mechanisms() encoding.MultiSymbol {
+	if b.options.Users != nil {
+		return encoding.MultiSymbol{"PLAIN"}
+	}
+
+	return encoding.MultiSymbol{"ANONYMOUS", "PLAIN"}
+}
+
+func (b *Broker) authenticate(init *frames.SASLInit) bool {
+	switch init.Mechanism {
+	case "ANONYMOUS":
+		return b.options.Users == nil
+	case "PLAIN":
+		// the PLAIN response is: [authzid] NUL authcid NUL passwd
+		parts := bytes.Split(init.InitialResponse, []byte{0})
+
+		if len(parts) != 3 {
+			return false
+		}
+
+		if b.options.Users == nil {
+			return true
+		}
+
+		password, exists := b.options.Users[string(parts[1])]
+		return exists && password == string(parts[2])
+	default:
+		return false
+	}
+}
+
+// handleCBSRequest accepts a $cbs put-token request, and queues up a successful response for the
+// client's reply-to address.
+// NOTE: b.mu must be held.
+func (b *Broker) handleCBSRequest(payload []byte) error {
+	req := &models.Message{}
+
+	if err := req.UnmarshalBinary(payload); err != nil {
+		return fmt.Errorf("failed to unmarshal $cbs request: %w", err)
+	}
+
+	if req.Properties == nil || req.Properties.ReplyTo == nil {
+		slog.Warn("Broker received a $cbs request without a reply-to address, ignoring")
+		return nil
+	}
+
+	resp := &models.Message{
+		Properties: &models.MessageProperties{
+			CorrelationID: req.Properties.MessageID,
+		},
+		ApplicationProperties: map[string]any{
+			"status-code":        int32(202),
+			"status-description": "Accepted",
+		},
+	}
+
+	respPayload, err := resp.MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	b.enqueue(*req.Properties.ReplyTo, respPayload)
+	return nil
+}
+
+// handleManagementRequest accepts any $management request, and queues up a successful, empty, response for
+// the client's reply-to address.
+// NOTE: b.mu must be held.
+func (b *Broker) handleManagementRequest(payload []byte) error {
+	req := &models.Message{}
+
+	if err := req.UnmarshalBinary(payload); err != nil {
+		return fmt.Errorf("failed to unmarshal $management request: %w", err)
+	}
+
+	if req.Properties == nil || req.Properties.ReplyTo == nil {
+		slog.Warn("Broker received a $management request without a reply-to address, ignoring")
+		return nil
+	}
+
+	resp := &models.Message{
+		Properties: &models.MessageProperties{
+			CorrelationID: req.Properties.MessageID,
+		},
+		ApplicationProperties: map[string]any{
+			"statusCode":        int32(200),
+			"statusDescription": "OK",
+		},
+		Value: map[string]any{},
+	}
+
+	respPayload, err := resp.MarshalBinary()
+
+	if err != nil {
+		return err
+	}
+
+	b.enqueue(*req.Properties.ReplyTo, respPayload)
+	return nil
+}
+
+// isRequestResponseAddress is true for $cbs and $management addresses, where responses are sent to the
+// request's reply-to address.
+func isRequestResponseAddress(address string) bool {
+	return address == cbsAddress || strings.HasSuffix(address, managementSuffix)
+}
@@ -0,0 +1,93 @@
+package faultinjectors
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type CBSInjectorOptions struct {
+	// StatusCode is the status-code the client sees in the put-token response (ex: 401, 403 or 500).
+	StatusCode int32
+
+	// StatusDescription is the status-description the client sees in the put-token response.
+	StatusDescription string
+
+	// Nth, if set, only rewrites the Nth put-token response (starting from 1), for each connection. Otherwise
+	// every put-token response is rewritten.
+	Nth int
+}
+
+// NewCBSInjector creates an injector that fails $cbs put-token calls, by rewriting the status-code and
+// status-description in the service's response. The client sees the token as having been rejected, as if it
+// were expired, or didn't grant access to the entity.
+func NewCBSInjector(options CBSInjectorOptions) *CBSInjector {
+	if options.StatusCode == 0 {
+		utils.Panicf("StatusCode must be set")
+	}
+
+	if options.Nth < 0 {
+		utils.Panicf("Nth cannot be negative")
+	}
+
+	return &CBSInjector{options: options}
+}
+
+type CBSInjector struct {
+	options   CBSInjectorOptions
+	responses atomic.Int64
+}
+
+func (inj *CBSInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	transferBody, isTransfer := params.Frame.Body.(*frames.PerformTransfer)
+
+	// the put-token responses come from the service, on the client's $cbs receiver.
+	if params.Out || !isTransfer || !params.CBS() {
+		return passthrough(params), nil
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	if transferBody.More {
+		// put-token responses are tiny, so this shouldn't happen, but we'd have to re-assemble the message to rewrite it.
+		logger.Warn("Not rewriting $cbs response, it's split across multiple TRANSFER frames")
+		return passthrough(params), nil
+	}
+
+	msg := &models.Message{}
+
+	if err := msg.UnmarshalBinary(transferBody.Payload); err != nil {
+		logger.Warn("Not rewriting $cbs response, failed to unmarshal it", "error", err)
+		return passthrough(params), nil
+	}
+
+	if _, hasStatus := msg.ApplicationProperties["status-code"]; !hasStatus {
+		return passthrough(params), nil
+	}
+
+	if n := inj.responses.Add(1); inj.options.Nth > 0 && n != int64(inj.options.Nth) {
+		return passthrough(params), nil
+	}
+
+	logger.Info("Rewriting $cbs put-token response",
+		"statusCode", msg.ApplicationProperties["status-code"],
+		"newStatusCode", inj.options.StatusCode,
+		"newStatusDescription", inj.options.StatusDescription)
+
+	msg.ApplicationProperties["status-code"] = inj.options.StatusCode
+	msg.ApplicationProperties["status-description"] = inj.options.StatusDescription
+
+	payload, err := msg.MarshalBinary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	transferBody.Payload = payload
+
+	return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "failing put-token"}}, nil
+}
@@ -0,0 +1,68 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCBSInjector(t *testing.T) {
+	testCases := []struct {
+		Nth      int
+		Expected []int32
+	}{
+		{Nth: 0, Expected: []int32{401, 401, 401}},
+		{Nth: 2, Expected: []int32{202, 401, 202}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(fmt.Sprintf("Nth=%d", tc.Nth), func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				injector := NewCBSInjector(CBSInjectorOptions{StatusCode: 401, StatusDescription: "Unauthorized", Nth: tc.Nth})
+				return injector.Callback
+			}, nil)
+
+			session := newSessionForTest(t, fi.ListenAddr())
+
+			sender, err := session.NewSender(context.Background(), "$cbs", nil)
+			require.NoError(t, err)
+
+			receiver, err := session.NewReceiver(context.Background(), "$cbs", &amqp.ReceiverOptions{TargetAddress: "reply-to-address"})
+			require.NoError(t, err)
+
+			for i, expected := range tc.Expected {
+				messageID := fmt.Sprintf("put-token %d", i)
+
+				err := sender.Send(context.Background(), &amqp.Message{
+					Properties: &amqp.MessageProperties{MessageID: messageID, ReplyTo: utils.Ptr("reply-to-address")},
+					ApplicationProperties: map[string]any{
+						"operation": "put-token",
+						"type":      "jwt",
+						"name":      "amqp://localhost/queue",
+					},
+					Value: "token",
+				}, nil)
+				require.NoError(t, err)
+
+				msg, err := receiver.Receive(context.Background(), nil)
+				require.NoError(t, err)
+				require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+
+				// the rest of the response is left alone.
+				require.Equal(t, messageID, msg.Properties.CorrelationID)
+				require.Equal(t, expected, msg.ApplicationProperties["status-code"])
+
+				if expected == 401 {
+					require.Equal(t, "Unauthorized", msg.ApplicationProperties["status-description"])
+				}
+			}
+		})
+	}
+}
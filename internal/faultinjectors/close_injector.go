@@ -0,0 +1,91 @@
+package faultinjectors
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// NewCloseAfterDelayInjector creates an injector that closes the connection, with closeError, once the connection
+// has been open for closeAfter.
+//
+// The CLOSE is sent to the service, as if the client sent it. When the service replies we add closeError, so
+// the client thinks the service closed the connection.
+func NewCloseAfterDelayInjector(closeAfter time.Duration, closeError *encoding.Error) *CloseInjector {
+	if closeAfter <= 0 {
+		utils.Panicf("closeAfter must be greater than zero")
+	}
+
+	return &CloseInjector{
+		closeAfter: closeAfter,
+		closeError: closeError,
+		terminator: newTerminator(),
+	}
+}
+
+// NewCloseAfterFramesInjector creates an injector that closes the connection, with closeError, after afterFrames
+// frames have been sent, in either direction. Empty (heartbeat) frames aren't counted.
+//
+// See [NewCloseAfterDelayInjector] for how the connection is closed.
+func NewCloseAfterFramesInjector(afterFrames int, closeError *encoding.Error) *CloseInjector {
+	if afterFrames <= 0 {
+		utils.Panicf("afterFrames must be greater than zero")
+	}
+
+	return &CloseInjector{
+		afterFrames: int64(afterFrames),
+		closeError:  closeError,
+		terminator:  newTerminator(),
+	}
+}
+
+type CloseInjector struct {
+	closeAfter  time.Duration
+	afterFrames int64
+	closeError  *encoding.Error
+
+	frames     atomic.Int64
+	closing    atomic.Bool
+	terminator *terminator
+}
+
+func (inj *CloseInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	if !inj.shouldClose(params) || !inj.closing.CompareAndSwap(false, true) {
+		return passthrough(params), nil
+	}
+
+	logging.SloggerFromContext(ctx).Info("Closing connection", "delay", inj.closeAfter, "frames", inj.frames.Load())
+
+	return []MetaFrame{
+		{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+		inj.terminator.Close(inj.closeError, inj.closeAfter),
+	}, nil
+}
+
+func (inj *CloseInjector) shouldClose(params MirrorCallbackParams) bool {
+	if inj.afterFrames == 0 {
+		// we close after a delay, which starts with the first frame we see.
+		return true
+	}
+
+	if _, isEmpty := params.Frame.Body.(*frames.EmptyFrame); isEmpty {
+		return false
+	}
+
+	return inj.frames.Add(1) == inj.afterFrames
+}
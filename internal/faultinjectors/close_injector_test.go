@@ -0,0 +1,89 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCloseInjector_AfterDelay(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewCloseAfterDelayInjector(500*time.Millisecond, &encoding.Error{Condition: proto.ErrCondConnectionForced, Description: "closed after a delay"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	// the connection works normally, until the delay is up.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	requireConnClosedForTest(t, sender, &amqp.Error{Condition: amqp.ErrCondConnectionForced, Description: "closed after a delay"})
+}
+
+func TestCloseInjector_AfterFrames(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		// OPEN (from the service), BEGIN, BEGIN, ATTACH
+		injector := NewCloseAfterFramesInjector(4, &encoding.Error{Condition: "amqp:custom", Description: "closed after frames"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	// the ATTACH is forwarded, but the connection is closed right after.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+
+	if err != nil {
+		var connErr *amqp.ConnError
+		require.ErrorAs(t, err, &connErr)
+		require.Equal(t, &amqp.Error{Condition: "amqp:custom", Description: "closed after frames"}, connErr.RemoteErr)
+		return
+	}
+
+	requireConnClosedForTest(t, sender, &amqp.Error{Condition: "amqp:custom", Description: "closed after frames"})
+}
+
+func TestCloseInjector_Once(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewCloseAfterDelayInjector(500*time.Millisecond, &encoding.Error{Condition: proto.ErrCondConnectionForced, Description: "closed once"})
+
+		// the service's reply to our CLOSE is filtered out by Once, but the injector still gets it, so it can add
+		// the error.
+		return Once(injector.Callback)
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	requireConnClosedForTest(t, sender, &amqp.Error{Condition: amqp.ErrCondConnectionForced, Description: "closed once"})
+}
+
+// requireConnClosedForTest sends messages until the connection is closed, and checks the error.
+func requireConnClosedForTest(t *testing.T, sender *amqp.Sender, expectedErr *amqp.Error) {
+	var connErr *amqp.ConnError
+
+	require.Eventually(t, func() bool {
+		err := sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		return errors.As(err, &connErr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, expectedErr, connErr.RemoteErr)
+}
@@ -0,0 +1,266 @@
+package faultinjectors
+
+import (
+	"context"
+	"math/rand"
+	"path"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// The functions in this file wrap a [MirrorCallback], controlling which frames can trigger its fault. Frames
+// that are filtered out are still passed to the wrapped callback, so it can keep track of the connection (ex:
+// the service's reply to a CLOSE it started), but [TriggersAllowed] is false for them. Callbacks that never
+// call [TriggersAllowed] don't know about this, so their result, for a filtered frame, is ignored and the
+// frame is passed through, unchanged.
+//
+// They can be combined to build up scenarios, without writing a new injector. For example, to delay TRANSFER
+// frames sent to "queueA", but only after the 10th one:
+//
+//	callback := ForAddress("queueA",
+//		When(IsType(frames.BodyTypeTransfer),
+//			AfterN(10, NewSlowTransfersInjector(time.Second).Callback)))
+
+// Predicate decides if a frame should be handled, for [When].
+type Predicate func(params *MirrorCallbackParams) bool
+
+// IsOutbound matches frames sent from the client to the service.
+func IsOutbound(params *MirrorCallbackParams) bool { return params.Out }
+
+// IsInbound matches frames sent from the service to the client.
+func IsInbound(params *MirrorCallbackParams) bool { return !params.Out }
+
+// IsManagementOrCBS matches frames for $management or $cbs links.
+func IsManagementOrCBS(params *MirrorCallbackParams) bool { return params.ManagementOrCBS() }
+
+// IsType matches frames with any of the bodyTypes.
+func IsType(bodyTypes ...frames.BodyType) Predicate {
+	return func(params *MirrorCallbackParams) bool {
+		for _, bodyType := range bodyTypes {
+			if params.Type() == bodyType {
+				return true
+			}
+		}
+
+		return false
+	}
+}
+
+// Not matches frames that the predicate doesn't match.
+func Not(predicate Predicate) Predicate {
+	return func(params *MirrorCallbackParams) bool {
+		return !predicate(params)
+	}
+}
+
+// And matches frames that all the predicates match.
+func And(predicates ...Predicate) Predicate {
+	return func(params *MirrorCallbackParams) bool {
+		for _, predicate := range predicates {
+			if !predicate(params) {
+				return false
+			}
+		}
+
+		return true
+	}
+}
+
+// Chain calls each callback, in order, and uses the result of the first one that does something other than
+// pass the frame through unchanged. If they all pass the frame through, so does Chain.
+//
+// The callbacks after that one still get the frame, with [TriggersAllowed] false, so they can keep track of
+// the connection, but their results are ignored. They see the frame after the earlier callbacks have had it,
+// so any changes those callbacks made to it, in place, are visible.
+func Chain(callbacks ...MirrorCallback) MirrorCallback {
+	return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		filtered := isFiltered(ctx)
+		var result []MetaFrame
+
+		for _, callback := range callbacks {
+			if result != nil {
+				_, _ = callFiltered(ctx, callback, params)
+				continue
+			}
+
+			var metaFrames []MetaFrame
+			var err error
+
+			if filtered {
+				// each callback's result is only used if it understands filtered frames.
+				metaFrames, err = callFiltered(ctx, callback, params)
+			} else {
+				metaFrames, err = callback(ctx, params)
+			}
+
+			if err != nil {
+				return metaFrames, err
+			}
+
+			if !isUnchanged(params.Frame, metaFrames) {
+				result = metaFrames
+			}
+		}
+
+		if result == nil {
+			return passthrough(params), nil
+		}
+
+		return result, nil
+	}
+}
+
+// When lets callback trigger its fault for frames that match the predicate. Other frames are still passed to
+// callback, with [TriggersAllowed] false.
+func When(predicate Predicate, callback MirrorCallback) MirrorCallback {
+	return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		// frames that an outer combinator filtered out don't count (ex: for [Once]).
+		if isFiltered(ctx) || !predicate(&params) {
+			return callFiltered(ctx, callback, params)
+		}
+
+		return callback(ctx, params)
+	}
+}
+
+// TriggersAllowed is false for frames that a combinator (ex: [When]) has filtered out. Injectors still get
+// these frames, so they can do their bookkeeping, but shouldn't start a new fault.
+//
+// Calling TriggersAllowed also tells the combinator that the injector understands filtered frames, so the
+// injector's result, for them, is used. Call it at the start of your callback, for every frame.
+func TriggersAllowed(ctx context.Context) bool {
+	f, isFiltered := ctx.Value(filteredKey{}).(*filtered)
+
+	if !isFiltered {
+		return true
+	}
+
+	f.checked.Store(true)
+	return false
+}
+
+type filteredKey struct{}
+
+func isFiltered(ctx context.Context) bool {
+	return ctx.Value(filteredKey{}) != nil
+}
+
+// callFiltered calls callback for a frame that's been filtered out. If the callback doesn't call
+// [TriggersAllowed] its result is ignored, and the frame is passed through.
+func callFiltered(ctx context.Context, callback MirrorCallback, params MirrorCallbackParams) ([]MetaFrame, error) {
+	f := &filtered{}
+	metaFrames, err := callback(context.WithValue(ctx, filteredKey{}, f), params)
+
+	if !f.checked.Load() {
+		return passthrough(params), nil
+	}
+
+	if outer, isFiltered := ctx.Value(filteredKey{}).(*filtered); isFiltered {
+		outer.checked.Store(true)
+	}
+
+	return metaFrames, err
+}
+
+// filtered is added to the context, by [When], for frames that its predicate filtered out.
+type filtered struct {
+	// checked is true if the callback called [TriggersAllowed].
+	checked atomic.Bool
+}
+
+// ForAddress lets callback trigger its fault for frames on links with an address that matches the glob (see [path.Match]). Frames that
+// aren't part of a link (ex: BEGIN) are never matched.
+func ForAddress(glob string, callback MirrorCallback) MirrorCallback {
+	if _, err := path.Match(glob, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", glob, err)
+	}
+
+	return When(func(params *MirrorCallbackParams) bool {
+		return params.AttachFrame() != nil && globMatches(glob, params.Address())
+	}, callback)
+}
+
+// Once lets callback trigger its fault for the first frame it sees.
+func Once(callback MirrorCallback) MirrorCallback {
+	return whenCount(func(count int64) bool { return count == 1 }, callback)
+}
+
+// AfterN lets callback trigger its fault for every frame after the first n.
+func AfterN(n int, callback MirrorCallback) MirrorCallback {
+	if n < 0 {
+		utils.Panicf("n must be >= 0, was %d", n)
+	}
+
+	return whenCount(func(count int64) bool { return count > int64(n) }, callback)
+}
+
+// EveryN lets callback trigger its fault for every nth frame (n, 2n, 3n, etc...)
+func EveryN(n int, callback MirrorCallback) MirrorCallback {
+	if n <= 0 {
+		utils.Panicf("n must be > 0, was %d", n)
+	}
+
+	return whenCount(func(count int64) bool { return count%int64(n) == 0 }, callback)
+}
+
+// whenCount counts the frames it sees (starting at 1), and lets callback trigger its fault if shouldCall returns
+// true for that count. Frames that an outer combinator filtered out aren't counted.
+func whenCount(shouldCall func(count int64) bool, callback MirrorCallback) MirrorCallback {
+	var count int64
+
+	return When(func(params *MirrorCallbackParams) bool {
+		return shouldCall(atomic.AddInt64(&count, 1))
+	}, callback)
+}
+
+// WithProbability lets callback trigger its fault for a frame with probability p (0.0 to 1.0).
+//   - seed seeds the random number generator, so runs can be repeated.
+func WithProbability(p float64, seed int64, callback MirrorCallback) MirrorCallback {
+	if p < 0 || p > 1 {
+		utils.Panicf("p must be between 0.0 and 1.0, was %f", p)
+	}
+
+	var mu sync.Mutex
+	rng := rand.New(rand.NewSource(seed))
+
+	return When(func(params *MirrorCallbackParams) bool {
+		mu.Lock()
+		defer mu.Unlock()
+
+		return rng.Float64() < p
+	}, callback)
+}
+
+// During lets callback trigger its fault for frames that arrive within a window of time. The window is relative to the first
+// frame During sees.
+//   - start is how long to wait, after the first frame, before the window opens.
+//   - duration is how long the window stays open.
+func During(start time.Duration, duration time.Duration, callback MirrorCallback) MirrorCallback {
+	var once sync.Once
+	var firstFrame time.Time
+
+	return When(func(params *MirrorCallbackParams) bool {
+		once.Do(func() { firstFrame = time.Now() })
+
+		elapsed := time.Since(firstFrame)
+		return elapsed >= start && elapsed < start+duration
+	}, callback)
+}
+
+// passthrough sends the frame on, unchanged.
+func passthrough(params MirrorCallbackParams) []MetaFrame {
+	return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame}}
+}
+
+// isUnchanged checks if metaFrames just passes frame through, unchanged.
+func isUnchanged(frame *frames.Frame, metaFrames []MetaFrame) bool {
+	return len(metaFrames) == 1 &&
+		metaFrames[0].Action == MetaFrameActionPassthrough &&
+		metaFrames[0].Frame == frame &&
+		metaFrames[0].Delay == 0 &&
+		metaFrames[0].OverrideOut == nil
+}
@@ -0,0 +1,219 @@
+package faultinjectors
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCombinators_When(t *testing.T) {
+	callback := When(IsType(frames.BodyTypeTransfer, frames.BodyTypeFlow), dropCallback)
+
+	require.Equal(t, []bool{true, true, false}, runCombinatorForTest(t, callback,
+		&frames.PerformTransfer{},
+		&frames.PerformFlow{},
+		&frames.PerformDisposition{}))
+
+	callback = When(Not(IsOutbound), dropCallback)
+
+	for _, out := range []bool{true, false} {
+		metaFrames, err := callback(context.Background(), MirrorCallbackParams{Out: out, Frame: &frames.Frame{Body: &frames.PerformFlow{}}})
+		require.NoError(t, err)
+		require.Equal(t, !out, metaFrames[0].Action == MetaFrameActionDropped)
+	}
+
+	callback = When(And(IsOutbound, IsType(frames.BodyTypeFlow)), dropCallback)
+
+	for _, out := range []bool{true, false} {
+		metaFrames, err := callback(context.Background(), MirrorCallbackParams{Out: out, Frame: &frames.Frame{Body: &frames.PerformFlow{}}})
+		require.NoError(t, err)
+		require.Equal(t, out, metaFrames[0].Action == MetaFrameActionDropped)
+	}
+}
+
+func TestCombinators_ForAddress(t *testing.T) {
+	sm := loadStateMap(t)
+
+	test := func(glob string, channel uint16, handle uint32) bool {
+		metaFrames, err := ForAddress(glob, dropCallback)(context.Background(), MirrorCallbackParams{
+			Out: true,
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: channel},
+				Body:   &frames.PerformFlow{Handle: utils.Ptr(handle)},
+			},
+			StateMap: sm,
+		})
+		require.NoError(t, err)
+		return metaFrames[0].Action == MetaFrameActionDropped
+	}
+
+	require.True(t, test("testQueue", 200, 200))
+	require.True(t, test("test*", 300, 300))
+	require.False(t, test("otherQueue", 300, 300))
+
+	// not an attached link
+	require.False(t, test("*", 400, 400))
+
+	require.Panics(t, func() { ForAddress("[", dropCallback) })
+}
+
+func TestCombinators_Counting(t *testing.T) {
+	bodies := []frames.Body{
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+	}
+
+	require.Equal(t, []bool{true, false, false, false, false}, runCombinatorForTest(t, Once(dropCallback), bodies...))
+	require.Equal(t, []bool{false, false, true, true, true}, runCombinatorForTest(t, AfterN(2, dropCallback), bodies...))
+	require.Equal(t, []bool{false, true, false, true, false}, runCombinatorForTest(t, EveryN(2, dropCallback), bodies...))
+
+	// combinators only count the frames that make it to them.
+	callback := When(IsType(frames.BodyTypeTransfer), Once(dropCallback))
+	require.Equal(t, []bool{false, true, false}, runCombinatorForTest(t, callback, &frames.PerformFlow{}, &frames.PerformTransfer{}, &frames.PerformTransfer{}))
+
+	require.Panics(t, func() { EveryN(0, dropCallback) })
+	require.Panics(t, func() { AfterN(-1, dropCallback) })
+}
+
+func TestCombinators_WithProbability(t *testing.T) {
+	bodies := make([]frames.Body, 1000)
+
+	for i := range bodies {
+		bodies[i] = &frames.PerformTransfer{}
+	}
+
+	dropped := runCombinatorForTest(t, WithProbability(0.25, 1, dropCallback), bodies...)
+
+	// the same seed gives us the same results.
+	require.Equal(t, dropped, runCombinatorForTest(t, WithProbability(0.25, 1, dropCallback), bodies...))
+
+	count := 0
+
+	for _, d := range dropped {
+		if d {
+			count++
+		}
+	}
+
+	require.InDelta(t, 250, count, 50)
+
+	require.NotContains(t, runCombinatorForTest(t, WithProbability(0, 1, dropCallback), bodies...), true)
+	require.NotContains(t, runCombinatorForTest(t, WithProbability(1, 1, dropCallback), bodies...), false)
+
+	require.Panics(t, func() { WithProbability(1.5, 1, dropCallback) })
+}
+
+func TestCombinators_During(t *testing.T) {
+	callback := During(100*time.Millisecond, 200*time.Millisecond, dropCallback)
+
+	require.Equal(t, []bool{false}, runCombinatorForTest(t, callback, &frames.PerformTransfer{}))
+
+	time.Sleep(150 * time.Millisecond)
+	require.Equal(t, []bool{true}, runCombinatorForTest(t, callback, &frames.PerformTransfer{}))
+
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, []bool{false}, runCombinatorForTest(t, callback, &frames.PerformTransfer{}))
+}
+
+func TestCombinators_Chain(t *testing.T) {
+	delayCallback := func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: time.Second}}, nil
+	}
+
+	callback := Chain(
+		When(IsType(frames.BodyTypeFlow), delayCallback),
+		When(IsType(frames.BodyTypeTransfer, frames.BodyTypeFlow), dropCallback),
+	)
+
+	var actions []MetaFrameAction
+	var delays []time.Duration
+
+	for _, body := range []frames.Body{&frames.PerformFlow{}, &frames.PerformTransfer{}, &frames.PerformDisposition{}} {
+		metaFrames, err := callback(context.Background(), MirrorCallbackParams{Frame: &frames.Frame{Body: body}})
+		require.NoError(t, err)
+		require.Len(t, metaFrames, 1)
+
+		actions = append(actions, metaFrames[0].Action)
+		delays = append(delays, metaFrames[0].Delay)
+	}
+
+	require.Equal(t, []MetaFrameAction{MetaFrameActionPassthrough, MetaFrameActionDropped, MetaFrameActionPassthrough}, actions)
+	require.Equal(t, []time.Duration{time.Second, 0, 0}, delays)
+}
+
+func TestCombinators_ChainPassesHandledFrames(t *testing.T) {
+	var allowed []bool
+
+	// an injector that keeps track of the connection still sees frames an earlier callback has dropped.
+	awareCallback := func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		allowed = append(allowed, TriggersAllowed(ctx))
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: time.Second}}, nil
+	}
+
+	callback := Chain(When(IsType(frames.BodyTypeAttach), dropCallback), awareCallback)
+
+	require.Equal(t, []bool{true, false}, runCombinatorForTest(t, callback,
+		&frames.PerformAttach{},
+		&frames.PerformFlow{}))
+	require.Equal(t, []bool{false, true}, allowed)
+}
+
+func TestCombinators_FilteredFrames(t *testing.T) {
+	var allowed []bool
+
+	// an injector that understands filtered frames sees all of them, and its result is used.
+	awareCallback := func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		allowed = append(allowed, TriggersAllowed(ctx))
+		return dropCallback(ctx, params)
+	}
+
+	callback := Once(When(IsType(frames.BodyTypeTransfer), awareCallback))
+
+	require.Equal(t, []bool{true, true, true}, runCombinatorForTest(t, callback,
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+		&frames.PerformFlow{}))
+	require.Equal(t, []bool{true, false, false}, allowed)
+
+	// an injector that doesn't, still sees all of them, but its result is ignored.
+	var calls int
+
+	unawareCallback := func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		calls++
+		return dropCallback(ctx, params)
+	}
+
+	callback = Once(Chain(unawareCallback))
+
+	require.Equal(t, []bool{true, false, false}, runCombinatorForTest(t, callback,
+		&frames.PerformTransfer{},
+		&frames.PerformTransfer{},
+		&frames.PerformFlow{}))
+	require.Equal(t, 3, calls)
+}
+
+func dropCallback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame}}, nil
+}
+
+// runCombinatorForTest runs each body through the callback, and returns whether it was dropped.
+func runCombinatorForTest(t *testing.T, callback MirrorCallback, bodies ...frames.Body) []bool {
+	var dropped []bool
+
+	for _, body := range bodies {
+		metaFrames, err := callback(context.Background(), MirrorCallbackParams{Out: true, Frame: &frames.Frame{Body: body}})
+		require.NoError(t, err)
+		require.Len(t, metaFrames, 1)
+
+		dropped = append(dropped, metaFrames[0].Action == MetaFrameActionDropped)
+	}
+
+	return dropped
+}
@@ -0,0 +1,404 @@
+package faultinjectors
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"slices"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+)
+
+// The control API is a small HTTP/JSON API, started when [FaultInjectorOptions.ControlEndpoint] is set. It lets
+// tests change faults, while the fault injector is running, without restarting it.
+//
+//	GET  /connections                               lists active connections, and their links ([ConnectionStatus]).
+//	POST /connections/{id}/close                    closes a connection, with an error ([TerminateRequest]).
+//	POST /connections/{id}/links/{name}/detach      detaches a link, by name, with an error ([TerminateRequest]).
+//	GET  /injector                                  gets the injector's status ([InjectorStatus]).
+//	PUT  /injector                                  enables, disables or reconfigures the injector ([UpdateInjectorRequest]).
+
+// InjectorConfigurer creates a new injector, from the configuration passed to the control API's PUT /injector.
+type InjectorConfigurer func(config json.RawMessage) (MirrorCallbackFactory, error)
+
+// ConnectionStatus is an active connection, from the control API.
+type ConnectionStatus struct {
+	ConnInfo
+	Links []LinkStatus
+}
+
+// LinkStatus is a link, from the control API. The values are all from the client's side of the link.
+type LinkStatus struct {
+	Name    string
+	Role    string
+	Address string
+	Channel uint16
+	Handle  uint32
+
+	// Attached is true once the service has replied to the client's ATTACH.
+	Attached bool
+
+	// Detached is true if either side has sent a DETACH.
+	Detached bool
+}
+
+// InjectorStatus is the status of the injector, from the control API.
+type InjectorStatus struct {
+	Enabled bool
+
+	// Config is the last configuration set using the control API. It's omitted if the injector hasn't been reconfigured.
+	Config json.RawMessage `json:",omitempty"`
+}
+
+// UpdateInjectorRequest is the body for the control API's PUT /injector. Fields that aren't set are left unchanged.
+type UpdateInjectorRequest struct {
+	// Enabled enables, or disables, the injector. A disabled injector doesn't start new faults, but still sees every
+	// frame, with [TriggersAllowed] false, so it can finish any fault it's already started. One-shot faults, like
+	// detaching a link, still work when the injector is disabled.
+	Enabled *bool
+
+	// Config is passed to [FaultInjectorOptions.ConfigureInjector], to create a new injector. Each connection creates
+	// its new injector when it gets its next frame, so the new injector doesn't see anything that came before. The
+	// old injector still gets frames, with [TriggersAllowed] false, so any fault it's started can finish.
+	Config json.RawMessage `json:",omitempty"`
+}
+
+// TerminateRequest is the (optional) body for the control API's detach and close requests.
+type TerminateRequest struct {
+	// Error is the error the client sees. If it's not set, a default error is used.
+	Error *encoding.Error
+}
+
+// activeConn is a connection that's being mirrored using the user's callback.
+type activeConn struct {
+	info       ConnInfo
+	mirror     *mirror
+	terminator *terminator
+}
+
+// injectorState holds the injector, which can be changed at runtime, using the control API.
+type injectorState struct {
+	disabled atomic.Bool
+
+	// mu protects the fields below.
+	mu         sync.Mutex
+	factory    MirrorCallbackFactory
+	generation int64
+	config     json.RawMessage
+}
+
+func (is *injectorState) current() (MirrorCallbackFactory, int64) {
+	is.mu.Lock()
+	defer is.mu.Unlock()
+
+	return is.factory, is.generation
+}
+
+// newConnCallback creates the callback for a connection. It handles one-shot faults from the control API, and
+// switches to a new injector if the injector's been reconfigured.
+//
+// The injector gets every frame, even when it's disabled or has been replaced, with [TriggersAllowed] false, so
+// its view of the connection doesn't go stale.
+func (fi *FaultInjector) newConnCallback(ac *activeConn) MirrorCallback {
+	// the callback is called from both directions, at the same time.
+	var mu sync.Mutex
+	factory, generation := fi.injector.current()
+	callback := factory(ac.info)
+
+	return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		if metaFrames, handled := ac.terminator.Intercept(ctx, params); handled {
+			return metaFrames, nil
+		}
+
+		mu.Lock()
+
+		if factory, latest := fi.injector.current(); latest != generation {
+			// the old injector keeps getting frames, without triggers, so any fault it's started can finish.
+			callback, generation = Chain(withoutTriggers(callback), factory(ac.info)), latest
+		}
+
+		current := callback
+		mu.Unlock()
+
+		if fi.injector.disabled.Load() {
+			// a disabled injector still sees every frame, so it can keep track of the connection.
+			return callFiltered(ctx, current, params)
+		}
+
+		return current(ctx, params)
+	}
+}
+
+// withoutTriggers passes every frame to callback with [TriggersAllowed] false.
+func withoutTriggers(callback MirrorCallback) MirrorCallback {
+	return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		return callFiltered(ctx, callback, params)
+	}
+}
+
+func (fi *FaultInjector) addConn(ac *activeConn) {
+	fi.connsMu.Lock()
+	defer fi.connsMu.Unlock()
+
+	fi.conns[ac.info.ID] = ac
+}
+
+func (fi *FaultInjector) removeConn(ac *activeConn) {
+	fi.connsMu.Lock()
+	defer fi.connsMu.Unlock()
+
+	delete(fi.conns, ac.info.ID)
+}
+
+// startControlServer starts the control API's HTTP server. It runs until the fault injector is closed.
+func (fi *FaultInjector) startControlServer() error {
+	listener, err := net.Listen("tcp4", fi.options.ControlEndpoint)
+
+	if err != nil {
+		return fmt.Errorf("failed to start control API: %w", err)
+	}
+
+	server := &http.Server{Handler: fi.controlHandler()}
+	fi.controlServer.Store(server)
+	fi.controlListener.Store(&listener)
+
+	slog.Info("Control API started", "address", listener.Addr().String())
+
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("Control API failed", "err", err)
+		}
+	}()
+
+	return nil
+}
+
+// ControlAddr is the address the control API is listening on, including the port (ex: 127.0.0.1:39608). If the control
+// API isn't enabled, or hasn't started yet, this function returns an empty string.
+func (fi *FaultInjector) ControlAddr() string {
+	listener := fi.controlListener.Load()
+
+	if listener == nil {
+		return ""
+	}
+
+	return (*listener).Addr().String()
+}
+
+func (fi *FaultInjector) controlHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("GET /connections", fi.handleListConnections)
+	mux.HandleFunc("POST /connections/{id}/close", fi.handleCloseConnection)
+	mux.HandleFunc("POST /connections/{id}/links/{name}/detach", fi.handleDetachLink)
+	mux.HandleFunc("GET /injector", fi.handleGetInjector)
+	mux.HandleFunc("PUT /injector", fi.handleUpdateInjector)
+
+	return mux
+}
+
+func (fi *FaultInjector) handleListConnections(w http.ResponseWriter, r *http.Request) {
+	fi.connsMu.Lock()
+
+	var conns []*activeConn
+
+	for _, ac := range fi.conns {
+		conns = append(conns, ac)
+	}
+
+	fi.connsMu.Unlock()
+
+	statuses := []ConnectionStatus{}
+
+	for _, ac := range conns {
+		statuses = append(statuses, newConnectionStatus(ac))
+	}
+
+	slices.SortFunc(statuses, func(a, b ConnectionStatus) int { return cmp.Compare(a.ID, b.ID) })
+	writeJSON(w, http.StatusOK, statuses)
+}
+
+func newConnectionStatus(ac *activeConn) ConnectionStatus {
+	status := ConnectionStatus{ConnInfo: ac.info, Links: []LinkStatus{}}
+
+	for _, link := range ac.mirror.sm.Links() {
+		status.Links = append(status.Links, LinkStatus{
+			Name:     link.LocalAttach.Body.Name,
+			Role:     link.LocalAttach.Body.Role.String(),
+			Address:  link.LocalAttach.Body.Address(true),
+			Channel:  link.LocalAttach.Header.Channel,
+			Handle:   link.LocalAttach.Body.Handle,
+			Attached: link.RemoteAttach != nil,
+			Detached: link.Detached,
+		})
+	}
+
+	return status
+}
+
+func (fi *FaultInjector) handleCloseConnection(w http.ResponseWriter, r *http.Request) {
+	ac, req, ok := fi.parseTerminateRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	slog.Info("Closing connection, from the control API", "connid", ac.info.ID)
+
+	metaFrame := ac.terminator.Close(defaultError(req.Error, proto.ErrCondConnectionForced, "Connection closed by the fault injector"), 0)
+	fi.inject(w, ac, metaFrame)
+}
+
+func (fi *FaultInjector) handleDetachLink(w http.ResponseWriter, r *http.Request) {
+	ac, req, ok := fi.parseTerminateRequest(w, r)
+
+	if !ok {
+		return
+	}
+
+	name := r.PathValue("name")
+	var link *proto.LinkState
+
+	for _, l := range ac.mirror.sm.Links() {
+		if l.LocalAttach.Body.Name == name && l.RemoteAttach != nil && !l.Detached {
+			link = &l
+			break
+		}
+	}
+
+	if link == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no attached link named %q on connection %d", name, ac.info.ID))
+		return
+	}
+
+	slog.Info("Detaching link, from the control API", "connid", ac.info.ID, "name", name)
+
+	metaFrame := ac.terminator.Detach(link.LocalAttach.Header.Channel, link.LocalAttach.Body.Handle,
+		defaultError(req.Error, proto.ErrCondDetachForced, "Detached by the fault injector"), 0)
+	fi.inject(w, ac, metaFrame)
+}
+
+// parseTerminateRequest gets the connection, from the path, and the [TerminateRequest], from the body. If it returns
+// false, the error response has already been written.
+func (fi *FaultInjector) parseTerminateRequest(w http.ResponseWriter, r *http.Request) (*activeConn, *TerminateRequest, bool) {
+	id, err := strconv.ParseInt(r.PathValue("id"), 10, 64)
+
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid connection ID: %w", err))
+		return nil, nil, false
+	}
+
+	fi.connsMu.Lock()
+	ac := fi.conns[id]
+	fi.connsMu.Unlock()
+
+	if ac == nil {
+		writeError(w, http.StatusNotFound, fmt.Errorf("no active connection with ID %d", id))
+		return nil, nil, false
+	}
+
+	req := &TerminateRequest{}
+
+	if !readJSON(w, r, req) {
+		return nil, nil, false
+	}
+
+	return ac, req, true
+}
+
+func (fi *FaultInjector) inject(w http.ResponseWriter, ac *activeConn, metaFrame MetaFrame) {
+	if err := ac.mirror.inject(true, []MetaFrame{metaFrame}); err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (fi *FaultInjector) handleGetInjector(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, fi.injectorStatus())
+}
+
+func (fi *FaultInjector) handleUpdateInjector(w http.ResponseWriter, r *http.Request) {
+	req := &UpdateInjectorRequest{}
+
+	if !readJSON(w, r, req) {
+		return
+	}
+
+	if len(req.Config) > 0 && string(req.Config) != "null" {
+		if fi.options.ConfigureInjector == nil {
+			writeError(w, http.StatusBadRequest, errors.New("this injector can't be reconfigured, it can only be enabled or disabled (only the scenario command's injector can be reconfigured)"))
+			return
+		}
+
+		factory, err := fi.options.ConfigureInjector(req.Config)
+
+		if err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid config: %w", err))
+			return
+		}
+
+		fi.injector.mu.Lock()
+		fi.injector.factory = factory
+		fi.injector.generation++
+		fi.injector.config = req.Config
+		fi.injector.mu.Unlock()
+
+		slog.Info("Injector reconfigured, from the control API")
+	}
+
+	if req.Enabled != nil {
+		fi.injector.disabled.Store(!*req.Enabled)
+		slog.Info("Injector updated, from the control API", "enabled", *req.Enabled)
+	}
+
+	writeJSON(w, http.StatusOK, fi.injectorStatus())
+}
+
+func (fi *FaultInjector) injectorStatus() InjectorStatus {
+	fi.injector.mu.Lock()
+	defer fi.injector.mu.Unlock()
+
+	return InjectorStatus{
+		Enabled: !fi.injector.disabled.Load(),
+		Config:  fi.injector.config,
+	}
+}
+
+// readJSON decodes the request's body into v. An empty body leaves v unchanged. If it returns false, the error
+// response has already been written.
+func readJSON(w http.ResponseWriter, r *http.Request, v any) bool {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(v); err != nil && !errors.Is(err, io.EOF) {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %w", err))
+		return false
+	}
+
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("Failed to write control API response", "err", err)
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, struct{ Error string }{err.Error()})
+}
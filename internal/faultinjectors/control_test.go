@@ -0,0 +1,189 @@
+package faultinjectors
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestControlAPI_DetachLink(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	fi := newControlledFaultInjectorForTest(t, broker.ListenAddr())
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", &amqp.SenderOptions{Name: "my-sender"})
+	require.NoError(t, err)
+
+	var conns []ConnectionStatus
+	require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodGet, "/connections", nil, &conns))
+	require.Len(t, conns, 1)
+	require.Equal(t, int64(1), conns[0].ID)
+	require.NotEmpty(t, conns[0].ContainerID)
+	require.Equal(t, []LinkStatus{
+		{Name: "my-sender", Role: "Sender", Address: "queue", Channel: 200, Handle: 200, Attached: true},
+	}, conns[0].Links)
+
+	require.Equal(t, http.StatusNotFound, controlRequestForTest(t, fi, http.MethodPost, "/connections/1/links/not-a-link/detach", nil, nil))
+	require.Equal(t, http.StatusNotFound, controlRequestForTest(t, fi, http.MethodPost, "/connections/100/links/my-sender/detach", nil, nil))
+
+	status := controlRequestForTest(t, fi, http.MethodPost, "/connections/1/links/my-sender/detach", TerminateRequest{
+		Error: &encoding.Error{Condition: "amqp:link:stolen", Description: "detached by the control API"},
+	}, nil)
+	require.Equal(t, http.StatusAccepted, status)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+
+	var linkErr *amqp.LinkError
+	require.ErrorAs(t, err, &linkErr)
+	require.Equal(t, &amqp.Error{Condition: "amqp:link:stolen", Description: "detached by the control API"}, linkErr.RemoteErr)
+
+	require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodGet, "/connections", nil, &conns))
+	require.True(t, conns[0].Links[0].Detached)
+}
+
+func TestControlAPI_CloseConnection(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	fi := newControlledFaultInjectorForTest(t, broker.ListenAddr())
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	require.Equal(t, http.StatusAccepted, controlRequestForTest(t, fi, http.MethodPost, "/connections/1/close", nil, nil))
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+
+	var connErr *amqp.ConnError
+	require.ErrorAs(t, err, &connErr)
+	require.Equal(t, amqp.ErrCond(proto.ErrCondConnectionForced), connErr.RemoteErr.Condition)
+
+	require.Eventually(t, func() bool {
+		var conns []ConnectionStatus
+		require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodGet, "/connections", nil, &conns))
+		return len(conns) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestControlAPI_Injector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	fi := newControlledFaultInjectorForTest(t, broker.ListenAddr())
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	var injectorStatus InjectorStatus
+	require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodGet, "/injector", nil, &injectorStatus))
+	require.Equal(t, InjectorStatus{Enabled: true}, injectorStatus)
+
+	require.Equal(t, http.StatusBadRequest, controlRequestForTest(t, fi, http.MethodPut, "/injector", map[string]any{
+		"Config": map[string]any{"rules": []any{}},
+	}, nil))
+
+	// reconfigure, but leave the injector disabled, for now.
+	config := json.RawMessage(`{"rules":[{"match":{"direction":"out","frameType":"Attach"},"action":{"type":"disconnect"}}]}`)
+	status := controlRequestForTest(t, fi, http.MethodPut, "/injector", UpdateInjectorRequest{Enabled: new(bool), Config: config}, &injectorStatus)
+	require.Equal(t, http.StatusOK, status)
+	require.Equal(t, InjectorStatus{Enabled: false, Config: config}, injectorStatus)
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	enabled := true
+	require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodPut, "/injector", UpdateInjectorRequest{Enabled: &enabled}, nil))
+
+	_, err = session.NewSender(context.Background(), "queue", nil)
+
+	var connErr *amqp.ConnError
+	require.ErrorAs(t, err, &connErr)
+}
+
+func TestControlAPI_DisabledInjectorSeesFrames(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	var mu sync.Mutex
+	var attaches []bool // TriggersAllowed, for each ATTACH the injector saw
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			triggersAllowed := TriggersAllowed(ctx)
+
+			if params.Out && params.AttachFrame() != nil {
+				mu.Lock()
+				attaches = append(attaches, triggersAllowed)
+				mu.Unlock()
+			}
+
+			return passthrough(params), nil
+		}
+	}, &FaultInjectorOptions{ControlEndpoint: "127.0.0.1:0"})
+
+	require.Eventually(t, func() bool { return fi.ControlAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	require.Equal(t, http.StatusOK, controlRequestForTest(t, fi, http.MethodPut, "/injector", UpdateInjectorRequest{Enabled: new(bool)}, nil))
+
+	_, err = session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	require.Equal(t, []bool{true, false}, attaches)
+}
+
+// newControlledFaultInjectorForTest starts a fault injector that passes all frames through, with the control API
+// enabled. The injector can be reconfigured using a [Scenario].
+func newControlledFaultInjectorForTest(t *testing.T, remoteEndpoint string) *FaultInjector {
+	fi := newFaultInjectorWithFactoryForTest(t, remoteEndpoint, func(connInfo ConnInfo) MirrorCallback {
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			return passthrough(params), nil
+		}
+	}, &FaultInjectorOptions{
+		ControlEndpoint: "127.0.0.1:0",
+		ConfigureInjector: func(config json.RawMessage) (MirrorCallbackFactory, error) {
+			scenario, err := ParseScenario(config)
+
+			if err != nil {
+				return nil, err
+			}
+
+			return func(connInfo ConnInfo) MirrorCallback { return NewScenarioInjector(scenario).Callback }, nil
+		},
+	})
+
+	require.Eventually(t, func() bool { return fi.ControlAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+	return fi
+}
+
+// controlRequestForTest sends a request to the control API, and returns the HTTP status code.
+//   - body, if not nil, is sent as JSON.
+//   - result, if not nil, is where the JSON response is decoded.
+func controlRequestForTest(t *testing.T, fi *FaultInjector, method string, path string, body any, result any) int {
+	var reqBody bytes.Buffer
+
+	if body != nil {
+		require.NoError(t, json.NewEncoder(&reqBody).Encode(body))
+	}
+
+	req, err := http.NewRequest(method, "http://"+fi.ControlAddr()+path, &reqBody)
+	require.NoError(t, err)
+
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+
+	defer resp.Body.Close()
+
+	if result != nil && resp.StatusCode == http.StatusOK {
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(result))
+	}
+
+	return resp.StatusCode
+}
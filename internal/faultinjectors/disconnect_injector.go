@@ -0,0 +1,97 @@
+package faultinjectors
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type DisconnectInjectorOptions struct {
+	// After disconnects once the connection has been open for this long.
+	After time.Duration
+
+	// AfterFrames disconnects after this many frames have been sent, in either direction. Empty (heartbeat)
+	// frames aren't counted.
+	AfterFrames int
+
+	// Match disconnects on the first frame it matches (ex: a TRANSFER). The matched frame isn't sent.
+	Match Predicate
+
+	// Disconnect is how the local and remote connections are terminated.
+	Disconnect Disconnect
+}
+
+// NewDisconnectInjector creates an injector that abruptly terminates the underlying connections, without an
+// AMQP CLOSE, to simulate a network failure. Exactly one of After, AfterFrames or Match must be set.
+func NewDisconnectInjector(options DisconnectInjectorOptions) *DisconnectInjector {
+	triggers := 0
+
+	for _, isSet := range []bool{options.After > 0, options.AfterFrames > 0, options.Match != nil} {
+		if isSet {
+			triggers++
+		}
+	}
+
+	if triggers != 1 {
+		utils.Panicf("exactly one of After, AfterFrames or Match must be set")
+	}
+
+	return &DisconnectInjector{options: options}
+}
+
+type DisconnectInjector struct {
+	options DisconnectInjectorOptions
+
+	frames        atomic.Int64
+	disconnecting atomic.Bool
+}
+
+func (inj *DisconnectInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	if inj.disconnecting.Load() {
+		return passthrough(params), nil
+	}
+
+	switch {
+	case inj.options.After > 0:
+		// the delay starts with the first frame we see.
+		if !inj.disconnecting.CompareAndSwap(false, true) {
+			return passthrough(params), nil
+		}
+
+		logging.SloggerFromContext(ctx).Info("Disconnecting", "delay", inj.options.After)
+
+		return []MetaFrame{
+			{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+			{Action: MetaFrameActionDisconnect, Delay: inj.options.After, Disconnect: &inj.options.Disconnect},
+		}, nil
+	case inj.options.AfterFrames > 0:
+		if _, isEmpty := params.Frame.Body.(*frames.EmptyFrame); isEmpty {
+			return passthrough(params), nil
+		}
+
+		if inj.frames.Add(1) != int64(inj.options.AfterFrames) || !inj.disconnecting.CompareAndSwap(false, true) {
+			return passthrough(params), nil
+		}
+
+		logging.SloggerFromContext(ctx).Info("Disconnecting", "frames", inj.options.AfterFrames)
+
+		return []MetaFrame{
+			{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+			{Action: MetaFrameActionDisconnect, Disconnect: &inj.options.Disconnect},
+		}, nil
+	default:
+		if !inj.options.Match(&params) || !inj.disconnecting.CompareAndSwap(false, true) {
+			return passthrough(params), nil
+		}
+
+		logging.SloggerFromContext(ctx).Info("Disconnecting, on matched frame", "type", params.Type())
+
+		return []MetaFrame{
+			{Action: MetaFrameActionDisconnect, Frame: params.Frame, Disconnect: &inj.options.Disconnect, Description: "disconnected on this frame"},
+		}, nil
+	}
+}
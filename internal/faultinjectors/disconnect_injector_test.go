@@ -0,0 +1,94 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDisconnectInjector_OnMatchedFrame(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDisconnectInjector(DisconnectInjectorOptions{
+			Match:      IsType(frames.BodyTypeTransfer),
+			Disconnect: Disconnect{Local: DisconnectModeReset, Remote: DisconnectModeReset},
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	requireDisconnectedForTest(t, err)
+}
+
+func TestDisconnectInjector_AfterDelay(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDisconnectInjector(DisconnectInjectorOptions{
+			After: 500 * time.Millisecond,
+			// the service's connection is left open, so only the client notices.
+			Disconnect: Disconnect{Local: DisconnectModeHalfClose, Remote: DisconnectModeNone},
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	// the connection works normally, until the delay is up.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	requireDisconnectedForTest(t, err)
+}
+
+func TestDisconnectInjector_AfterFrames(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		// OPEN (from the service), BEGIN, BEGIN
+		injector := NewDisconnectInjector(DisconnectInjectorOptions{
+			AfterFrames: 3,
+			Disconnect:  Disconnect{Local: DisconnectModeClose, Remote: DisconnectModeClose},
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+	requireDisconnectedForTest(t, err)
+}
+
+func TestNewDisconnectInjector_InvalidOptions(t *testing.T) {
+	require.Panics(t, func() { NewDisconnectInjector(DisconnectInjectorOptions{}) })
+	require.Panics(t, func() {
+		NewDisconnectInjector(DisconnectInjectorOptions{After: time.Second, AfterFrames: 1})
+	})
+}
+
+// requireDisconnectedForTest checks that the connection failed, without the service sending a CLOSE.
+func requireDisconnectedForTest(t *testing.T, err error) {
+	var connErr *amqp.ConnError
+	require.True(t, errors.As(err, &connErr), "expected a *amqp.ConnError, got %#v", err)
+	require.Nil(t, connErr.RemoteErr)
+}
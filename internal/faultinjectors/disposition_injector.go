@@ -0,0 +1,326 @@
+package faultinjectors
+
+import (
+	"context"
+	"math"
+	"path"
+	"reflect"
+	"slices"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type DispositionInjectorOptions struct {
+	// State replaces the state in matching DISPOSITION frames. For example:
+	//   - &encoding.StateRejected{Error: &encoding.Error{...}}
+	//   - &encoding.StateReleased{}
+	//   - &encoding.StateModified{DeliveryFailed: true, UndeliverableHere: true}
+	State encoding.DeliveryState
+
+	// FromState, if set, only rewrites dispositions with the same type of state (ex: &encoding.StateAccepted{}).
+	// Otherwise any disposition with a state is rewritten.
+	FromState encoding.DeliveryState
+
+	// Out, if set, only rewrites DISPOSITION frames sent in this direction. True is for frames sent by
+	// the client, false is for frames sent by the service.
+	Out *bool
+
+	// FirstDeliveryID and LastDeliveryID, if set, only rewrite the state for deliveries in this range, inclusive.
+	FirstDeliveryID *uint32
+	LastDeliveryID  *uint32
+
+	// Address, if set, only rewrites the state for deliveries on links with an address that matches
+	// this glob (see [path.Match]).
+	Address string
+}
+
+// NewDispositionInjector creates an injector that rewrites the outcome of deliveries, in DISPOSITION frames.
+//
+// A DISPOSITION can cover a range of deliveries, which might not all match the delivery-id or address filters.
+// In that case the DISPOSITION is split, and only the state for the matching deliveries is rewritten.
+func NewDispositionInjector(options DispositionInjectorOptions) *DispositionInjector {
+	if options.State == nil {
+		utils.Panicf("State must be set")
+	}
+
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &DispositionInjector{options: options}
+}
+
+type DispositionInjector struct {
+	options DispositionInjectorOptions
+
+	// addresses has the link address for each delivery, so we can filter dispositions by address. It's
+	// only populated if the Address option is set.
+	addresses utils.SyncMap[deliveryKey, string]
+}
+
+// deliveryKey identifies a delivery. Delivery-ids are only unique within a session, and each side of
+// the session assigns its own.
+type deliveryKey struct {
+	// Out is true if the delivery was sent by the client.
+	Out bool
+
+	// Channel is the client's channel for the session.
+	Channel uint16
+
+	DeliveryID uint32
+}
+
+func (inj *DispositionInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformTransfer:
+		inj.trackDelivery(params, body)
+	case *frames.PerformDisposition:
+		deliveriesOut, channel := dispositionDeliveries(params, body)
+		metaFrames := passthrough(params)
+
+		if triggersAllowed {
+			metaFrames = inj.rewrite(ctx, params, body, deliveriesOut, channel)
+		}
+
+		if body.Settled && inj.options.Address != "" {
+			// settled deliveries are done, we won't see them again.
+			inj.forgetDeliveries(deliveriesOut, channel, body)
+		}
+
+		return metaFrames, nil
+	}
+
+	return passthrough(params), nil
+}
+
+func (inj *DispositionInjector) trackDelivery(params MirrorCallbackParams, transferBody *frames.PerformTransfer) {
+	// only the first frame, of a multi-frame delivery, has the delivery-id. Pre-settled deliveries never get a
+	// DISPOSITION, so there's no point tracking them.
+	if inj.options.Address == "" || transferBody.DeliveryID == nil || transferBody.Settled {
+		return
+	}
+
+	if channel, ok := localChannelForFrame(params); ok {
+		inj.addresses.Store(deliveryKey{Out: params.Out, Channel: channel, DeliveryID: *transferBody.DeliveryID}, params.Address())
+	}
+}
+
+// forgetDeliveries stops tracking the deliveries in a DISPOSITION.
+func (inj *DispositionInjector) forgetDeliveries(deliveriesOut bool, channel uint16, dispositionBody *frames.PerformDisposition) {
+	first := dispositionBody.First
+	size := dispositionLast(dispositionBody) - first
+
+	inj.addresses.Range(func(key deliveryKey, address string) bool {
+		if key.Out == deliveriesOut && key.Channel == channel && key.DeliveryID-first <= size {
+			inj.addresses.Delete(key)
+		}
+
+		return true
+	})
+}
+
+func (inj *DispositionInjector) rewrite(ctx context.Context, params MirrorCallbackParams, dispositionBody *frames.PerformDisposition, deliveriesOut bool, channel uint16) []MetaFrame {
+	if dispositionBody.State == nil ||
+		(inj.options.Out != nil && *inj.options.Out != params.Out) ||
+		(inj.options.FromState != nil && reflect.TypeOf(inj.options.FromState) != reflect.TypeOf(dispositionBody.State)) {
+		return passthrough(params)
+	}
+
+	runs := inj.matchingRuns(deliveriesOut, channel, dispositionBody)
+
+	if len(runs) == 1 && !runs[0].matches {
+		return passthrough(params)
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	var metaFrames []MetaFrame
+
+	for _, run := range runs {
+		newBody := *dispositionBody
+		newBody.First = run.first
+		newBody.Last = utils.Ptr(run.last)
+
+		if run.matches {
+			logger.Info("Rewriting disposition", "first", run.first, "last", run.last, "from", dispositionBody.State, "to", inj.options.State)
+			newBody.State = inj.options.State
+		}
+
+		metaFrames = append(metaFrames, MetaFrame{
+			Action:      MetaFrameActionModified,
+			Frame:       &frames.Frame{Header: params.Frame.Header, Body: &newBody},
+			Description: "rewrote disposition state",
+		})
+	}
+
+	return metaFrames
+}
+
+// deliveryRun is a contiguous range of deliveries, in a DISPOSITION, that either all match or all don't match
+// our filters.
+type deliveryRun struct {
+	first, last uint32
+	matches     bool
+}
+
+// offsetRange is a range of deliveries, in a DISPOSITION, as offsets from its first delivery-id, inclusive.
+// Offsets don't wrap, so they're easier to compare than delivery-ids, which are sequence numbers.
+type offsetRange struct {
+	first, last uint64
+}
+
+// matchingRuns splits the DISPOSITION's range into runs that match, or don't match, our filters. A
+// DISPOSITION can cover any number of deliveries, so we never walk its range - only the delivery-id
+// filter's range, and the deliveries we're tracking.
+func (inj *DispositionInjector) matchingRuns(deliveriesOut bool, channel uint16, dispositionBody *frames.PerformDisposition) []deliveryRun {
+	first := dispositionBody.First
+	size := uint64(dispositionLast(dispositionBody) - first)
+
+	matching := inj.idFilterRanges(first, size)
+
+	if inj.options.Address != "" {
+		matching = inj.addressMatches(deliveriesOut, channel, first, size, matching)
+	}
+
+	var runs []deliveryRun
+	next := uint64(0)
+
+	for _, r := range matching {
+		if r.first > next {
+			runs = append(runs, deliveryRun{first: first + uint32(next), last: first + uint32(r.first-1)})
+		}
+
+		runs = append(runs, deliveryRun{first: first + uint32(r.first), last: first + uint32(r.last), matches: true})
+		next = r.last + 1
+	}
+
+	if next <= size {
+		runs = append(runs, deliveryRun{first: first + uint32(next), last: first + uint32(size)})
+	}
+
+	return runs
+}
+
+// idFilterRanges returns the parts of the DISPOSITION's range, in order, that are within the FirstDeliveryID
+// and LastDeliveryID options.
+func (inj *DispositionInjector) idFilterRanges(first uint32, size uint64) []offsetRange {
+	low, high := uint32(0), uint32(math.MaxUint32)
+
+	if inj.options.FirstDeliveryID != nil {
+		low = *inj.options.FirstDeliveryID
+	}
+
+	if inj.options.LastDeliveryID != nil {
+		high = *inj.options.LastDeliveryID
+	}
+
+	// the DISPOSITION's range can wrap, past the highest delivery-id, back to zero.
+	segments := [][2]uint32{{first, first + uint32(size)}}
+
+	if uint64(first)+size > math.MaxUint32 {
+		segments = [][2]uint32{{first, math.MaxUint32}, {0, first + uint32(size)}}
+	}
+
+	var ranges []offsetRange
+
+	for _, segment := range segments {
+		start, end := max(segment[0], low), min(segment[1], high)
+
+		if start > end {
+			continue
+		}
+
+		r := offsetRange{first: uint64(start - first), last: uint64(end - first)}
+
+		if len(ranges) > 0 && ranges[len(ranges)-1].last+1 == r.first {
+			ranges[len(ranges)-1].last = r.last
+			continue
+		}
+
+		ranges = append(ranges, r)
+	}
+
+	return ranges
+}
+
+// addressMatches returns the deliveries, within ranges, that were sent on a link with a matching address. Only
+// the deliveries we're tracking are checked.
+func (inj *DispositionInjector) addressMatches(deliveriesOut bool, channel uint16, first uint32, size uint64, ranges []offsetRange) []offsetRange {
+	var offsets []uint64
+
+	inj.addresses.Range(func(key deliveryKey, address string) bool {
+		offset := uint64(key.DeliveryID - first)
+
+		if key.Out != deliveriesOut || key.Channel != channel || offset > size || !globMatches(inj.options.Address, address) {
+			return true
+		}
+
+		for _, r := range ranges {
+			if offset >= r.first && offset <= r.last {
+				offsets = append(offsets, offset)
+				break
+			}
+		}
+
+		return true
+	})
+
+	slices.Sort(offsets)
+
+	var matching []offsetRange
+
+	for _, offset := range offsets {
+		if len(matching) > 0 && matching[len(matching)-1].last+1 == offset {
+			matching[len(matching)-1].last = offset
+			continue
+		}
+
+		matching = append(matching, offsetRange{first: offset, last: offset})
+	}
+
+	return matching
+}
+
+// dispositionDeliveries returns who sent the deliveries in a DISPOSITION (true if it was the client), and the
+// client's channel for the session.
+func dispositionDeliveries(params MirrorCallbackParams, dispositionBody *frames.PerformDisposition) (bool, uint16) {
+	// a receiver's DISPOSITION is for deliveries that were sent to it, a sender's is for its own deliveries.
+	deliveriesOut := params.Out
+
+	if dispositionBody.Role == encoding.RoleReceiver {
+		deliveriesOut = !params.Out
+	}
+
+	channel, _ := localChannelForFrame(params)
+	return deliveriesOut, channel
+}
+
+// dispositionLast is the last delivery-id in the DISPOSITION's range.
+func dispositionLast(dispositionBody *frames.PerformDisposition) uint32 {
+	if dispositionBody.Last != nil {
+		return *dispositionBody.Last
+	}
+
+	return dispositionBody.First
+}
+
+// localChannelForFrame returns the client's channel for the session the frame is part of. Returns false
+// if the service hasn't replied to the client's BEGIN.
+func localChannelForFrame(params MirrorCallbackParams) (uint16, bool) {
+	if params.Out {
+		return params.Channel(), true
+	}
+
+	localChannel := params.StateMap.LookupCorrespondingChannel(false, params.Channel())
+
+	if localChannel == nil {
+		return 0, false
+	}
+
+	return *localChannel, true
+}
@@ -0,0 +1,195 @@
+package faultinjectors
+
+import (
+	"context"
+	"math"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDispositionInjector_RejectForAddress(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDispositionInjector(DispositionInjectorOptions{
+			State:     &encoding.StateRejected{Error: &encoding.Error{Condition: "amqp:custom", Description: "rejected by the fault injector"}},
+			FromState: &encoding.StateAccepted{},
+			Out:       utils.Ptr(false),
+			Address:   "rejected-*",
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	rejectedSender, err := session.NewSender(context.Background(), "rejected-queue", nil)
+	require.NoError(t, err)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = rejectedSender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.Equal(t, &amqp.Error{Condition: "amqp:custom", Description: "rejected by the fault injector"}, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+}
+
+func TestDispositionInjector_Release(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDispositionInjector(DispositionInjectorOptions{
+			State: &encoding.StateReleased{},
+			Out:   utils.Ptr(true),
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	// our accept is turned into a release, so the broker delivers the message again.
+	for range 2 {
+		msg, err := receiver.Receive(context.Background(), nil)
+		require.NoError(t, err)
+		require.Equal(t, []byte("hello world"), msg.GetData())
+
+		require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+	}
+}
+
+func TestDispositionInjector_SplitsRanges(t *testing.T) {
+	injector := NewDispositionInjector(DispositionInjectorOptions{
+		State:           &encoding.StateModified{DeliveryFailed: true, UndeliverableHere: true},
+		FirstDeliveryID: utils.Ptr(uint32(2)),
+		LastDeliveryID:  utils.Ptr(uint32(3)),
+	})
+
+	metaFrames, err := injector.Callback(context.Background(), MirrorCallbackParams{
+		Frame: &frames.Frame{
+			Header: frames.Header{Channel: 200},
+			Body: &frames.PerformDisposition{
+				Role:    encoding.RoleReceiver,
+				First:   0,
+				Last:    utils.Ptr(uint32(4)),
+				Settled: true,
+				State:   &encoding.StateAccepted{},
+			},
+		},
+		StateMap: proto.NewStateMap(),
+	})
+	require.NoError(t, err)
+
+	var dispositions []frames.PerformDisposition
+
+	for _, mf := range metaFrames {
+		require.Equal(t, MetaFrameActionModified, mf.Action)
+		require.Equal(t, uint16(200), mf.Frame.Header.Channel)
+		dispositions = append(dispositions, *mf.Frame.Body.(*frames.PerformDisposition))
+	}
+
+	require.Equal(t, []frames.PerformDisposition{
+		{Role: encoding.RoleReceiver, First: 0, Last: utils.Ptr(uint32(1)), Settled: true, State: &encoding.StateAccepted{}},
+		{Role: encoding.RoleReceiver, First: 2, Last: utils.Ptr(uint32(3)), Settled: true, State: &encoding.StateModified{DeliveryFailed: true, UndeliverableHere: true}},
+		{Role: encoding.RoleReceiver, First: 4, Last: utils.Ptr(uint32(4)), Settled: true, State: &encoding.StateAccepted{}},
+	}, dispositions)
+
+	// dispositions outside of the range are left alone.
+	params := MirrorCallbackParams{
+		Frame: &frames.Frame{
+			Body: &frames.PerformDisposition{Role: encoding.RoleReceiver, First: 5, Settled: true, State: &encoding.StateAccepted{}},
+		},
+		StateMap: proto.NewStateMap(),
+	}
+
+	metaFrames, err = injector.Callback(context.Background(), params)
+	require.NoError(t, err)
+	require.Equal(t, passthrough(params), metaFrames)
+}
+
+func TestDispositionInjector_WrappedRanges(t *testing.T) {
+	injector := NewDispositionInjector(DispositionInjectorOptions{
+		State:          &encoding.StateReleased{},
+		LastDeliveryID: utils.Ptr(uint32(1)),
+	})
+
+	test := func(first uint32, last uint32) []frames.PerformDisposition {
+		metaFrames, err := injector.Callback(context.Background(), MirrorCallbackParams{
+			Frame: &frames.Frame{
+				Body: &frames.PerformDisposition{Role: encoding.RoleReceiver, First: first, Last: utils.Ptr(last), State: &encoding.StateAccepted{}},
+			},
+			StateMap: proto.NewStateMap(),
+		})
+		require.NoError(t, err)
+
+		var dispositions []frames.PerformDisposition
+
+		for _, mf := range metaFrames {
+			dispositions = append(dispositions, *mf.Frame.Body.(*frames.PerformDisposition))
+		}
+
+		return dispositions
+	}
+
+	// delivery-ids are sequence numbers, so the range wraps.
+	require.Equal(t, []frames.PerformDisposition{
+		{Role: encoding.RoleReceiver, First: math.MaxUint32 - 1, Last: utils.Ptr(uint32(math.MaxUint32)), State: &encoding.StateAccepted{}},
+		{Role: encoding.RoleReceiver, First: 0, Last: utils.Ptr(uint32(1)), State: &encoding.StateReleased{}},
+		{Role: encoding.RoleReceiver, First: 2, Last: utils.Ptr(uint32(2)), State: &encoding.StateAccepted{}},
+	}, test(math.MaxUint32-1, 2))
+
+	// every possible delivery-id, which we don't walk, one at a time.
+	require.Equal(t, []frames.PerformDisposition{
+		{Role: encoding.RoleReceiver, First: 0, Last: utils.Ptr(uint32(1)), State: &encoding.StateReleased{}},
+		{Role: encoding.RoleReceiver, First: 2, Last: utils.Ptr(uint32(math.MaxUint32)), State: &encoding.StateAccepted{}},
+	}, test(0, math.MaxUint32))
+}
+
+func TestDispositionInjector_SkipsPresettled(t *testing.T) {
+	sm := loadStateMap(t)
+
+	injector := NewDispositionInjector(DispositionInjectorOptions{
+		State:   &encoding.StateReleased{},
+		Address: "*",
+	})
+
+	transfer := func(deliveryID uint32, settled bool) {
+		_, err := injector.Callback(context.Background(), MirrorCallbackParams{
+			Out: true,
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: 200},
+				Body:   &frames.PerformTransfer{Handle: 200, DeliveryID: utils.Ptr(deliveryID), Settled: settled},
+			},
+			StateMap: sm,
+		})
+		require.NoError(t, err)
+	}
+
+	transfer(1, false)
+	transfer(2, true)
+
+	var tracked []uint32
+
+	injector.addresses.Range(func(key deliveryKey, address string) bool {
+		tracked = append(tracked, key.DeliveryID)
+		return true
+	})
+
+	require.Equal(t, []uint32{1}, tracked)
+}
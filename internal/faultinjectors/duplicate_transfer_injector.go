@@ -0,0 +1,459 @@
+package faultinjectors
+
+import (
+	"cmp"
+	"context"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type DuplicateTransferInjectorOptions struct {
+	// NewDeliveryID gives each duplicate its own delivery-id, like a redelivery from the service. Otherwise
+	// the duplicate has the same delivery-id as the original.
+	NewDeliveryID bool
+
+	// EveryN duplicates every Nth delivery, on each link. Defaults to 1, which duplicates every delivery.
+	EveryN int
+
+	// Address, if set, only duplicates deliveries on links with an address that matches this glob (see [path.Match]).
+	Address string
+}
+
+// NewDuplicateTransferInjector creates an injector that sends deliveries, from the service, to the client's
+// receivers twice. This simulates at-least-once redelivery, so you can check that consumers deduplicate messages.
+//
+// A duplicate is only sent if the receiver has credit left for it. The duplicates are hidden from the service, so
+// the delivery-count and link credit in the client's FLOW frames are adjusted, and, with NewDeliveryID, the client's
+// DISPOSITION frames for duplicates are absorbed.
+func NewDuplicateTransferInjector(options DuplicateTransferInjectorOptions) *DuplicateTransferInjector {
+	if options.EveryN < 0 {
+		utils.Panicf("EveryN must be greater than or equal to zero")
+	}
+
+	if options.EveryN == 0 {
+		options.EveryN = 1
+	}
+
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &DuplicateTransferInjector{
+		options:     options,
+		links:       map[linkID]*duplicateLink{},
+		sessions:    map[uint16]*duplicateSession{},
+		transferIDs: newTransferIDShifter(),
+	}
+}
+
+type DuplicateTransferInjector struct {
+	options DuplicateTransferInjectorOptions
+
+	mu sync.Mutex
+
+	// links, keyed by the client's channel and handle.
+	links map[linkID]*duplicateLink
+
+	// sessions, keyed by the client's channel.
+	sessions map[uint16]*duplicateSession
+
+	transferIDs *transferIDShifter
+}
+
+type duplicateLink struct {
+	// deliveryCount is the client's delivery-count, which includes the duplicates.
+	deliveryCount uint32
+
+	// creditLimit is the delivery-count where the client runs out of link credit.
+	creditLimit uint32
+
+	// duplicates is the number of duplicates we've sent on this link.
+	duplicates uint32
+
+	// deliveries is the number of deliveries, from the service, on this link.
+	deliveries int
+
+	// pending are the frames for the delivery that's in progress. Deliveries can span multiple frames, and we
+	// can't send a duplicate until we've seen all of them.
+	pending []*frames.Frame
+}
+
+// duplicateSession is only used with NewDeliveryID.
+type duplicateSession struct {
+	// nextDeliveryID is the next delivery-id the client expects.
+	nextDeliveryID uint32
+
+	// shift is the number of duplicates we've sent, which is how far the client's delivery-ids are ahead of
+	// the service's. Like delivery-ids, it wraps.
+	shift uint32
+
+	// duplicateIDs are the client's delivery-ids for unsettled duplicates.
+	duplicateIDs map[uint32]bool
+
+	// clientIDs maps the service's delivery-ids to the client's, for unsettled deliveries.
+	//
+	// NOTE: entries are removed when either side settles the delivery, so these only grow if the client never
+	// settles its deliveries, or detaches without settling them, until its session ends.
+	clientIDs map[uint32]uint32
+}
+
+func (inj *DuplicateTransferInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformTransfer:
+		if !params.Out {
+			return inj.inboundTransfer(ctx, params, body, triggersAllowed), nil
+		}
+	case *frames.PerformFlow:
+		return inj.flow(params, body), nil
+	case *frames.PerformDisposition:
+		if inj.options.NewDeliveryID {
+			return inj.disposition(params, body), nil
+		}
+	case *frames.PerformDetach:
+		if params.Out {
+			delete(inj.links, linkID{params.Channel(), body.Handle})
+		}
+	case *frames.PerformEnd:
+		inj.transferIDs.Intercept(params)
+
+		if params.Out {
+			delete(inj.sessions, params.Channel())
+		}
+	}
+
+	return passthrough(params), nil
+}
+
+// inboundTransfer keeps track of the deliveries the service sends, and duplicates them, if triggersAllowed.
+func (inj *DuplicateTransferInjector) inboundTransfer(ctx context.Context, params MirrorCallbackParams, transferBody *frames.PerformTransfer, triggersAllowed bool) []MetaFrame {
+	localAttach := params.StateMap.LookupCorrespondingAttachFrame(false, params.Channel(), transferBody.Handle)
+
+	if localAttach == nil {
+		return passthrough(params)
+	}
+
+	session := inj.session(localAttach.Header.Channel)
+	link := inj.links[linkID{localAttach.Header.Channel, localAttach.Body.Handle}]
+
+	action := MetaFrameActionPassthrough
+
+	if inj.options.NewDeliveryID && transferBody.DeliveryID != nil {
+		// make room for the duplicates we've already sent.
+		serviceID := *transferBody.DeliveryID
+		clientID := serviceID + session.shift
+
+		*transferBody.DeliveryID = clientID
+		session.nextDeliveryID = clientID + 1
+
+		if !transferBody.Settled {
+			session.clientIDs[serviceID] = clientID
+		}
+
+		action = MetaFrameActionModified
+	}
+
+	metaFrames := []MetaFrame{{Action: action, Frame: params.Frame}}
+
+	if link == nil {
+		// the client hasn't granted any credit, as far as we know, so we can't send it duplicates.
+		return metaFrames
+	}
+
+	if transferBody.Aborted {
+		link.pending = nil
+		return metaFrames
+	}
+
+	link.pending = append(link.pending, params.Frame)
+
+	if transferBody.More {
+		return metaFrames
+	}
+
+	pending := link.pending
+	link.pending = nil
+	link.deliveryCount++
+	link.deliveries++
+
+	if !triggersAllowed || link.deliveries%inj.options.EveryN != 0 || !globMatches(inj.options.Address, params.Address()) {
+		return metaFrames
+	}
+
+	// NOTE: delivery-counts are sequence numbers, so they can wrap.
+	if int32(link.creditLimit-link.deliveryCount) <= 0 {
+		logging.SloggerFromContext(ctx).Info("Not duplicating delivery, the receiver has no credit left", "address", params.Address())
+		return metaFrames
+	}
+
+	var deliveryID *uint32
+
+	if inj.options.NewDeliveryID {
+		deliveryID = utils.Ptr(session.nextDeliveryID)
+
+		// pre-settled duplicates never get a DISPOSITION, so there's nothing to track.
+		if !pending[0].Body.(*frames.PerformTransfer).Settled {
+			session.duplicateIDs[session.nextDeliveryID] = true
+		}
+
+		session.nextDeliveryID++
+		session.shift++
+	}
+
+	logging.SloggerFromContext(ctx).Info("Duplicating delivery", "address", params.Address(), "frames", len(pending), "deliveryID", deliveryID)
+
+	for i, fr := range pending {
+		dupBody := *fr.Body.(*frames.PerformTransfer)
+
+		if i == 0 && deliveryID != nil {
+			dupBody.DeliveryID = deliveryID
+		}
+
+		metaFrames = append(metaFrames, MetaFrame{
+			Action:      MetaFrameActionAdded,
+			Frame:       &frames.Frame{Header: fr.Header, Body: &dupBody},
+			Description: "duplicate delivery",
+		})
+	}
+
+	link.deliveryCount++
+	link.duplicates++
+	inj.transferIDs.Sent(params, 0, len(pending))
+
+	return metaFrames
+}
+
+// flow adjusts FLOW frames, so neither side can see the duplicates.
+func (inj *DuplicateTransferInjector) flow(params MirrorCallbackParams, flowBody *frames.PerformFlow) []MetaFrame {
+	var link *duplicateLink
+
+	if params.Out {
+		if flowBody.Handle != nil {
+			id := linkID{params.Channel(), *flowBody.Handle}
+			link = inj.links[id]
+
+			if link == nil && flowBody.DeliveryCount != nil && flowBody.LinkCredit != nil {
+				// we only need to track receivers, which are the only links that grant credit.
+				link = &duplicateLink{deliveryCount: *flowBody.DeliveryCount}
+				inj.links[id] = link
+			}
+		}
+	} else if flowBody.Handle != nil {
+		if localAttach := params.StateMap.LookupCorrespondingAttachFrame(false, params.Channel(), *flowBody.Handle); localAttach != nil {
+			link = inj.links[linkID{localAttach.Header.Channel, localAttach.Body.Handle}]
+		}
+	}
+
+	modified := inj.transferIDs.Intercept(params)
+
+	if link != nil && flowBody.DeliveryCount != nil {
+		if params.Out {
+			// NOTE: we don't take the client's delivery-count. We see deliveries before the client does,
+			// so ours is always up to date.
+			if flowBody.LinkCredit != nil {
+				link.creditLimit = *flowBody.DeliveryCount + *flowBody.LinkCredit
+			}
+
+			flowBody.DeliveryCount = utils.Ptr(*flowBody.DeliveryCount - link.duplicates)
+		} else {
+			flowBody.DeliveryCount = utils.Ptr(*flowBody.DeliveryCount + link.duplicates)
+		}
+
+		modified = modified || link.duplicates > 0
+	}
+
+	if !modified {
+		return passthrough(params)
+	}
+
+	return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "adjusted for duplicate deliveries"}}
+}
+
+// disposition converts delivery-ids in DISPOSITION frames between the client's delivery-ids, which include the
+// duplicates, and the service's.
+//
+// A DISPOSITION can cover any number of deliveries, so we never walk its range - only the unsettled deliveries
+// we're tracking. Deliveries that aren't tracked are already settled, so they're left out.
+func (inj *DuplicateTransferInjector) disposition(params MirrorCallbackParams, dispositionBody *frames.PerformDisposition) []MetaFrame {
+	// we only change the delivery-ids for deliveries that the service sent.
+	if (params.Out && dispositionBody.Role != encoding.RoleReceiver) || (!params.Out && dispositionBody.Role != encoding.RoleSender) {
+		return passthrough(params)
+	}
+
+	localChannel, ok := localChannelForFrame(params)
+
+	if !ok || inj.sessions[localChannel] == nil {
+		return passthrough(params)
+	}
+
+	session := inj.sessions[localChannel]
+	first := dispositionBody.First
+	size := dispositionLast(dispositionBody) - first
+
+	if session.shift == 0 {
+		// we haven't sent any duplicates, so the delivery-ids are the same on both sides.
+		if dispositionBody.Settled {
+			for serviceID := range session.clientIDs {
+				if serviceID-first <= size {
+					delete(session.clientIDs, serviceID)
+				}
+			}
+		}
+
+		return passthrough(params)
+	}
+
+	if !params.Out {
+		return inj.serviceDisposition(params, dispositionBody, session)
+	}
+
+	var serviceIDs []deliveryIDPair
+	var duplicateIDs []uint32
+
+	for serviceID, clientID := range session.clientIDs {
+		if clientID-first <= size {
+			serviceIDs = append(serviceIDs, deliveryIDPair{offset: clientID - first, id: serviceID})
+		}
+	}
+
+	for clientID := range session.duplicateIDs {
+		if clientID-first <= size {
+			duplicateIDs = append(duplicateIDs, clientID)
+		}
+	}
+
+	slices.Sort(duplicateIDs)
+
+	if dispositionBody.Settled {
+		for _, pair := range serviceIDs {
+			delete(session.clientIDs, pair.id)
+		}
+
+		for _, id := range duplicateIDs {
+			delete(session.duplicateIDs, id)
+		}
+	}
+
+	var metaFrames []MetaFrame
+
+	// removing the duplicates leaves the service's delivery-ids contiguous, unless some were already settled.
+	for _, run := range deliveryIDRuns(serviceIDs) {
+		newBody := *dispositionBody
+		newBody.First = run[0]
+		newBody.Last = utils.Ptr(run[1])
+
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: &frames.Frame{Header: params.Frame.Header, Body: &newBody}})
+	}
+
+	if len(metaFrames) == 0 {
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "disposition for duplicate, or settled, deliveries"})
+	}
+
+	if !dispositionBody.Settled && dispositionBody.State != nil && len(duplicateIDs) > 0 {
+		// the client is waiting for the service to settle the duplicates, which it never will, so we do it instead.
+		remoteChannel := params.StateMap.LookupCorrespondingChannel(true, localChannel)
+
+		for _, id := range duplicateIDs {
+			delete(session.duplicateIDs, id)
+
+			metaFrames = append(metaFrames, MetaFrame{
+				Action:      MetaFrameActionAdded,
+				OverrideOut: utils.Ptr(false),
+				Frame: &frames.Frame{
+					Header: frames.Header{Channel: *remoteChannel},
+					Body: &frames.PerformDisposition{
+						Role:    encoding.RoleSender,
+						First:   id,
+						Settled: true,
+						State:   dispositionBody.State,
+					},
+				},
+				Description: "settling duplicate delivery",
+			})
+		}
+	}
+
+	return metaFrames
+}
+
+// serviceDisposition converts the service's delivery-ids, in its DISPOSITION, to the client's.
+func (inj *DuplicateTransferInjector) serviceDisposition(params MirrorCallbackParams, dispositionBody *frames.PerformDisposition, session *duplicateSession) []MetaFrame {
+	first := dispositionBody.First
+	size := dispositionLast(dispositionBody) - first
+
+	var clientIDs []deliveryIDPair
+
+	for serviceID, clientID := range session.clientIDs {
+		if serviceID-first <= size {
+			clientIDs = append(clientIDs, deliveryIDPair{offset: serviceID - first, id: clientID})
+
+			if dispositionBody.Settled {
+				delete(session.clientIDs, serviceID)
+			}
+		}
+	}
+
+	var metaFrames []MetaFrame
+
+	// the client's delivery-ids are split up by the duplicates.
+	for _, run := range deliveryIDRuns(clientIDs) {
+		newBody := *dispositionBody
+		newBody.First = run[0]
+		newBody.Last = utils.Ptr(run[1])
+
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: &frames.Frame{Header: params.Frame.Header, Body: &newBody}})
+	}
+
+	if len(metaFrames) == 0 {
+		return passthrough(params)
+	}
+
+	return metaFrames
+}
+
+// deliveryIDPair is a delivery-id, and its offset from the start of the DISPOSITION it's in (on the other side).
+type deliveryIDPair struct {
+	offset uint32
+	id     uint32
+}
+
+// deliveryIDRuns sorts the pairs by their offset, and groups their delivery-ids into runs of consecutive
+// delivery-ids (first and last, inclusive).
+func deliveryIDRuns(pairs []deliveryIDPair) [][2]uint32 {
+	slices.SortFunc(pairs, func(a, b deliveryIDPair) int { return cmp.Compare(a.offset, b.offset) })
+
+	var runs [][2]uint32
+
+	for _, pair := range pairs {
+		// NOTE: delivery-ids are sequence numbers, so a run can wrap.
+		if len(runs) > 0 && runs[len(runs)-1][1]+1 == pair.id {
+			runs[len(runs)-1][1] = pair.id
+			continue
+		}
+
+		runs = append(runs, [2]uint32{pair.id, pair.id})
+	}
+
+	return runs
+}
+
+func (inj *DuplicateTransferInjector) session(localChannel uint16) *duplicateSession {
+	session := inj.sessions[localChannel]
+
+	if session == nil {
+		session = &duplicateSession{duplicateIDs: map[uint32]bool{}, clientIDs: map[uint32]uint32{}}
+		inj.sessions[localChannel] = session
+	}
+
+	return session
+}
@@ -0,0 +1,189 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestDuplicateTransferInjector(t *testing.T) {
+	for _, newDeliveryID := range []bool{false, true} {
+		t.Run(fmt.Sprintf("NewDeliveryID=%t", newDeliveryID), func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				injector := NewDuplicateTransferInjector(DuplicateTransferInjectorOptions{NewDeliveryID: newDeliveryID})
+				return injector.Callback
+			}, nil)
+
+			session := newSessionForTest(t, fi.ListenAddr())
+
+			sender, err := session.NewSender(context.Background(), "queue", nil)
+			require.NoError(t, err)
+
+			receiver, err := session.NewReceiver(context.Background(), "queue", &amqp.ReceiverOptions{Credit: 10})
+			require.NoError(t, err)
+
+			// each round checks that the delivery-ids and counts still line up, after the previous duplicates.
+			for round := range 3 {
+				messageID := fmt.Sprintf("message %d", round)
+				err = sender.Send(context.Background(), &amqp.Message{Data: [][]byte{[]byte("hello world")}, Properties: &amqp.MessageProperties{MessageID: messageID}}, nil)
+				require.NoError(t, err)
+
+				for range 2 {
+					msg, err := receiver.Receive(context.Background(), nil)
+					require.NoError(t, err)
+					require.Equal(t, messageID, msg.Properties.MessageID)
+					require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+				}
+			}
+
+			messages, err := broker.Messages("queue")
+			require.NoError(t, err)
+			require.Empty(t, messages)
+		})
+	}
+}
+
+func TestDuplicateTransferInjector_ReceiverSettleModeSecond(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDuplicateTransferInjector(DuplicateTransferInjectorOptions{NewDeliveryID: true})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", &amqp.ReceiverOptions{
+		Credit:         10,
+		SettlementMode: amqp.ReceiverSettleModeSecond.Ptr(),
+	})
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	// the client waits for the service to settle each delivery, including the duplicate, which we settle.
+	for range 2 {
+		msg, err := receiver.Receive(context.Background(), nil)
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		err = receiver.AcceptMessage(ctx, msg)
+		cancel()
+		require.NoError(t, err)
+	}
+}
+
+func TestDuplicateTransferInjector_HonorsCredit(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewDuplicateTransferInjector(DuplicateTransferInjectorOptions{})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", &amqp.ReceiverOptions{Credit: 1})
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	msg, err := receiver.Receive(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+
+	// the original delivery used up the receiver's only credit, so there's no duplicate.
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err = receiver.Receive(ctx, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestDuplicateTransferInjector_WrappedDeliveryIDs(t *testing.T) {
+	// the service sent deliveries MaxUint32-1, MaxUint32 and 0, and we sent a duplicate, with the client's
+	// delivery-id 0, before the last one. Delivery-ids wrap, so the client's delivery-ids are MaxUint32-1,
+	// MaxUint32, 0 (the duplicate) and 1.
+	newInjector := func() *DuplicateTransferInjector {
+		inj := NewDuplicateTransferInjector(DuplicateTransferInjectorOptions{NewDeliveryID: true})
+		session := inj.session(1)
+		session.shift = 1
+		session.duplicateIDs[0] = true
+		session.clientIDs[math.MaxUint32-1] = math.MaxUint32 - 1
+		session.clientIDs[math.MaxUint32] = math.MaxUint32
+		session.clientIDs[0] = 1
+		return inj
+	}
+
+	dispose := func(inj *DuplicateTransferInjector, out bool, first uint32, last uint32) []frames.PerformDisposition {
+		role, channel := encoding.RoleReceiver, uint16(1)
+		sm := proto.NewStateMap()
+
+		if !out {
+			// the service's DISPOSITION is on its own channel, for the session.
+			role, channel = encoding.RoleSender, 2
+			sm.AddFrame(true, &frames.Frame{Header: frames.Header{Channel: 1}, Body: &frames.PerformBegin{}})
+			sm.AddFrame(false, &frames.Frame{Header: frames.Header{Channel: 2}, Body: &frames.PerformBegin{RemoteChannel: utils.Ptr(uint16(1))}})
+		}
+
+		metaFrames, err := inj.Callback(context.Background(), MirrorCallbackParams{
+			Out: out,
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: channel},
+				Body:   &frames.PerformDisposition{Role: role, First: first, Last: utils.Ptr(last), Settled: true, State: &encoding.StateAccepted{}},
+			},
+			StateMap: sm,
+		})
+		require.NoError(t, err)
+
+		var dispositions []frames.PerformDisposition
+
+		for _, mf := range metaFrames {
+			require.Equal(t, MetaFrameActionModified, mf.Action)
+			dispositions = append(dispositions, *mf.Frame.Body.(*frames.PerformDisposition))
+		}
+
+		return dispositions
+	}
+
+	inj := newInjector()
+
+	// the client's DISPOSITION, without the duplicate, is contiguous for the service.
+	require.Equal(t, []frames.PerformDisposition{
+		{Role: encoding.RoleReceiver, First: math.MaxUint32 - 1, Last: utils.Ptr(uint32(0)), Settled: true, State: &encoding.StateAccepted{}},
+	}, dispose(inj, true, math.MaxUint32-1, 1))
+
+	// settled deliveries aren't tracked anymore.
+	require.Empty(t, inj.sessions[1].clientIDs)
+	require.Empty(t, inj.sessions[1].duplicateIDs)
+
+	inj = newInjector()
+
+	// the service's DISPOSITION is split around the duplicate, for the client.
+	require.Equal(t, []frames.PerformDisposition{
+		{Role: encoding.RoleSender, First: math.MaxUint32 - 1, Last: utils.Ptr(uint32(math.MaxUint32)), Settled: true, State: &encoding.StateAccepted{}},
+		{Role: encoding.RoleSender, First: 1, Last: utils.Ptr(uint32(1)), Settled: true, State: &encoding.StateAccepted{}},
+	}, dispose(inj, false, math.MaxUint32-1, 0))
+
+	require.Empty(t, inj.sessions[1].clientIDs)
+}
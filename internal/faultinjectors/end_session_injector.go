@@ -0,0 +1,73 @@
+package faultinjectors
+
+import (
+	"context"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+)
+
+type EndSessionInjectorOptions struct {
+	// EndAfter is how long to wait, after the session has started, before ending it. Defaults to 0, which
+	// ends the session as soon as the service has replied to the client's BEGIN.
+	EndAfter time.Duration
+
+	// Channel, if set, only ends the session with this channel. This is the client's channel for the session,
+	// which is usually also the order it was created in (ie: 0 is the client's first session).
+	// Otherwise every session is ended.
+	Channel *uint16
+
+	// Error is the error that the client sees, in the END frame.
+	Error *encoding.Error
+}
+
+// NewEndSessionInjector creates an injector that ends sessions, with an error.
+//
+// The END is sent to the service, as if the client sent it. When the service replies we add our error,
+// so the client thinks the service ended the session. The client's END reply is absorbed, since the service
+// has already ended the session, so neither side sees an unexpected frame.
+func NewEndSessionInjector(options EndSessionInjectorOptions) *EndSessionInjector {
+	return &EndSessionInjector{
+		options:    options,
+		terminator: newTerminator(),
+	}
+}
+
+type EndSessionInjector struct {
+	options    EndSessionInjectorOptions
+	terminator *terminator
+}
+
+func (inj *EndSessionInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	beginBody, isBegin := params.Frame.Body.(*frames.PerformBegin)
+
+	// the service's reply to the client's BEGIN has the client's channel as its remote channel.
+	if params.Out || !isBegin || beginBody.RemoteChannel == nil {
+		return passthrough(params), nil
+	}
+
+	localChannel := *beginBody.RemoteChannel
+
+	if inj.options.Channel != nil && *inj.options.Channel != localChannel {
+		return passthrough(params), nil
+	}
+
+	logging.SloggerFromContext(ctx).Info("Ending session", "channel", localChannel, "delay", inj.options.EndAfter)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+		inj.terminator.End(localChannel, inj.options.Error, inj.options.EndAfter),
+	}, nil
+}
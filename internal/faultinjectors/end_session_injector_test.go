@@ -0,0 +1,62 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEndSessionInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewEndSessionInjector(EndSessionInjectorOptions{
+			EndAfter: 500 * time.Millisecond,
+			// NOTE: our go-amqp fork starts its channels at 200, so this is the second session.
+			Channel: utils.Ptr(uint16(201)),
+			Error:   &encoding.Error{Condition: proto.ErrCondWindowViolation, Description: "ended by the fault injector"},
+		})
+		return injector.Callback
+	}, nil)
+
+	conn := newConnForTest(t, fi.ListenAddr())
+
+	var senders []*amqp.Sender
+
+	for range 2 {
+		session, err := conn.NewSession(context.Background(), nil)
+		require.NoError(t, err)
+
+		sender, err := session.NewSender(context.Background(), "queue", nil)
+		require.NoError(t, err)
+
+		senders = append(senders, sender)
+	}
+
+	var sessionErr *amqp.SessionError
+
+	require.Eventually(t, func() bool {
+		err := senders[1].Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		return errors.As(err, &sessionErr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, &amqp.Error{Condition: amqp.ErrCondWindowViolation, Description: "ended by the fault injector"}, sessionErr.RemoteErr)
+
+	// the client's END reply was absorbed, so the rest of the connection is still fine.
+	err := senders[0].Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	session, err := conn.NewSession(context.Background(), nil)
+	require.NoError(t, err)
+
+	_, err = session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+}
@@ -3,15 +3,18 @@ package faultinjectors
 import (
 	"context"
 	"crypto/tls"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
-	"strings"
+	"sync"
 	"sync/atomic"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/shared"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
@@ -22,11 +25,18 @@ type FaultInjector struct {
 	conn                          atomic.Pointer[net.Listener]
 	localEndpoint, remoteEndpoint string
 	options                       FaultInjectorOptions
-	callback                      MirrorCallback
+	injector                      injectorState
+	lastConnID                    atomic.Int64
 	tlsKeyLogWriter               io.Writer
 	frameLogger                   *logging.FrameLogger
 	closedByUser                  atomic.Bool
 
+	connsMu sync.Mutex
+	conns   map[int64]*activeConn
+
+	controlServer   atomic.Pointer[http.Server]
+	controlListener atomic.Pointer[net.Listener]
+
 	serverCtx    context.Context
 	cancelServer context.CancelFunc
 }
@@ -39,9 +49,69 @@ type FaultInjectorOptions struct {
 	// Folder where a certificate, for our TLS endpoint, is stored. If no certificate is present it is
 	// generated.
 	CertDir string
+
+	// DisableTLSForLocalEndpoint makes the fault injector accept plain AMQP connections from clients, so
+	// they don't have to trust its self-signed certificate, and CertDir isn't used. It doesn't change how we
+	// connect to the remote host - that's DisableTLSForRemoteEndpoint - so traffic to the service is still
+	// encrypted, unless that's set too.
+	DisableTLSForLocalEndpoint bool
+
+	// DisableTLSForRemoteEndpoint will disable TLS when communicating with the remote host. This is
+	// useful when the remote host is a local broker, or an emulator, listening on the plain AMQP port (5672).
+	DisableTLSForRemoteEndpoint bool
+
+	// ControlEndpoint, if set, starts the control API, an HTTP/JSON API for changing faults while the fault
+	// injector is running, on this address (ex: localhost:5680). See [FaultInjector.ControlAddr].
+	// NOTE: the control API has no authentication - only listen on local addresses.
+	ControlEndpoint string
+
+	// ConfigureInjector, if set, lets the control API replace the injector, using a new configuration. If it's not
+	// set, the control API can only enable, or disable, the injector. The faultinjector command only sets it for
+	// the scenario command, where the configuration is the scenario's rules.
+	ConfigureInjector InjectorConfigurer
+
+	// Shaping, if set, limits the bandwidth, and adds latency, to each connection, after the OPEN frames have
+	// been exchanged. See [ShapingOptions].
+	Shaping *ShapingOptions
+
+	// HandshakeFactory, if set, creates a callback for each connection's handshake: its protocol headers (see
+	// [frames.ProtocolHeader]) and SASL frames (ex: the service's SASL outcome). The handshake happens before the
+	// OPEN frames, so the callback's [ConnInfo] doesn't have a ContainerID, and it's only called for handshake
+	// frames. See [NewSASLInjector] and [NewProtocolHeaderInjector].
+	HandshakeFactory MirrorCallbackFactory
+}
+
+// ConnInfo describes a client's connection to the fault injector.
+type ConnInfo struct {
+	// ID identifies the connection. IDs start at 1, and are unique for the lifetime of the [FaultInjector].
+	ID int64
+
+	// ClientAddress is the client's network address (ex: 127.0.0.1:39607).
+	ClientAddress string
+
+	// ContainerID is the container-id, from the client's OPEN frame.
+	ContainerID string
 }
 
+// MirrorCallbackFactory creates the [MirrorCallback] for a single connection. It's called after the
+// client's OPEN frame has been forwarded, and the callback's first frame is the service's OPEN.
+//
+// Injectors that are created inside the factory have independent state, for each connection. Injectors
+// created outside of the factory, and captured, share their state across all connections. Injectors that only
+// fire once, or that track a connection's sessions and links, must be created inside the factory.
+type MirrorCallbackFactory func(connInfo ConnInfo) MirrorCallback
+
+// NewFaultInjector creates a FaultInjector, which uses the same injector callback for every connection.
+// Use [NewFaultInjectorWithFactory] if each connection needs its own injector.
 func NewFaultInjector(localEndpoint, remoteEndpoint string, injector MirrorCallback, options *FaultInjectorOptions) (*FaultInjector, error) {
+	return NewFaultInjectorWithFactory(localEndpoint, remoteEndpoint, func(connInfo ConnInfo) MirrorCallback {
+		return injector
+	}, options)
+}
+
+// NewFaultInjectorWithFactory creates a FaultInjector, which calls factory to create an injector callback for
+// each connection.
+func NewFaultInjectorWithFactory(localEndpoint, remoteEndpoint string, factory MirrorCallbackFactory, options *FaultInjectorOptions) (*FaultInjector, error) {
 	// okay, all we're going to do is just intersperse ourselves between the remote service and another client that's connecting.
 	if localEndpoint == "" {
 		panic("localEndpoint is not set")
@@ -51,21 +121,25 @@ func NewFaultInjector(localEndpoint, remoteEndpoint string, injector MirrorCallb
 		panic("remoteEndpoint is not set")
 	}
 
-	if !strings.Contains(remoteEndpoint, ":") {
-		remoteEndpoint += ":5671"
-	}
-
 	if options == nil {
 		options = &FaultInjectorOptions{}
 	}
 
+	if options.Shaping != nil {
+		if err := options.Shaping.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	remoteEndpoint = shared.RemoteEndpointWithPort(remoteEndpoint, options.DisableTLSForRemoteEndpoint)
+
 	serverCtx, cancelServer := context.WithCancel(context.Background())
 
 	fi := &FaultInjector{
 		localEndpoint:  localEndpoint,
 		remoteEndpoint: remoteEndpoint,
-		callback:       injector,
 		options:        *options,
+		conns:          map[int64]*activeConn{},
 
 		serverCtx:    serverCtx,
 		cancelServer: cancelServer,
@@ -81,6 +155,8 @@ func NewFaultInjector(localEndpoint, remoteEndpoint string, injector MirrorCallb
 		fi.frameLogger = fl
 	}
 
+	fi.injector.factory = factory
+
 	return fi, nil
 }
 
@@ -88,6 +164,10 @@ func (fi *FaultInjector) Close() error {
 	if fi.closedByUser.CompareAndSwap(false, true) {
 		fi.cancelServer()
 
+		if controlServer := fi.controlServer.Swap(nil); controlServer != nil {
+			utils.CloseWithLogging("control API", controlServer)
+		}
+
 		listener := fi.conn.Swap(nil)
 
 		if listener != nil {
@@ -118,14 +198,12 @@ func (fi *FaultInjector) ListenAndServe() error {
 
 	slog.Info("Listener started", "address", listener.Addr().String())
 
-	certFile, keyFile, cert, err := shared.LoadOrCreateCert(fi.options.CertDir)
-
-	if err != nil {
-		return err
+	if fi.options.ControlEndpoint != "" {
+		if err := fi.startControlServer(); err != nil {
+			return err
+		}
 	}
 
-	slog.Info("Certificate information:", "cert", certFile, "key", keyFile)
-
 	if fi.options.TLSKeyLogFile != "" {
 		tmpWriter, err := os.OpenFile(fi.options.TLSKeyLogFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
 
@@ -140,15 +218,27 @@ func (fi *FaultInjector) ListenAndServe() error {
 		fi.tlsKeyLogWriter = tmpWriter
 	}
 
-	listener = tls.NewListener(listener, &tls.Config{
-		Certificates: []tls.Certificate{
-			cert,
-		},
-	})
+	if !fi.options.DisableTLSForLocalEndpoint {
+		certFile, keyFile, cert, err := shared.LoadOrCreateCert(fi.options.CertDir)
+
+		if err != nil {
+			return err
+		}
+
+		slog.Info("Certificate information:", "cert", certFile, "key", keyFile)
+
+		listener = tls.NewListener(listener, &tls.Config{
+			Certificates: []tls.Certificate{
+				cert,
+			},
+		})
+	} else {
+		slog.Info("TLS is disabled for the local endpoint")
+	}
 
 	defer func() {
 		if !fi.closedByUser.Load() {
-			utils.CloseWithLogging("tls.Listener", listener)
+			utils.CloseWithLogging("listener", listener)
 		}
 	}()
 
@@ -167,7 +257,12 @@ func (fi *FaultInjector) ListenAndServe() error {
 		}
 
 		go func() {
-			if err := fi.mirrorConn(localConn); err != nil {
+			err := fi.mirrorConn(localConn)
+
+			switch {
+			case errors.Is(err, ErrDisconnect):
+				slog.Info("Connection was disconnected by the fault injector", "endpoint", fi.remoteEndpoint)
+			case err != nil:
 				slog.Error("Failure when mirroring connection", "endpoint", fi.remoteEndpoint, "err", err)
 			}
 		}()
@@ -188,49 +283,124 @@ func (fi *FaultInjector) ListenAddr() string {
 
 func (fi *FaultInjector) mirrorConn(localNetConn net.Conn) error {
 	defer utils.CloseWithLogging("local"+localNetConn.RemoteAddr().String(), localNetConn)
-	slog.Info("Connection started", "clientip", localNetConn.RemoteAddr())
+
+	connInfo := ConnInfo{
+		ID:            fi.lastConnID.Add(1),
+		ClientAddress: localNetConn.RemoteAddr().String(),
+	}
+
+	slog.Info("Connection started", "clientip", localNetConn.RemoteAddr(), "connid", connInfo.ID)
 
 	// open up connection to remote host
-	remoteNetConn, err := net.Dial("tcp4", fi.remoteEndpoint)
+	slog.Info("Connecting to remote host", "remote", fi.remoteEndpoint, "tls", !fi.options.DisableTLSForRemoteEndpoint)
+	remoteNetConn, err := shared.DialRemote(fi.remoteEndpoint, fi.options.DisableTLSForRemoteEndpoint, fi.tlsKeyLogWriter)
 
 	if err != nil {
 		return fmt.Errorf("failed to mirror connection: %w", err)
 	}
 
 	defer utils.CloseWithLogging("remote", remoteNetConn)
-	slog.Info("Setting up remote TLS connection", "remote", fi.remoteEndpoint)
-
-	remoteTLSConn := tls.Client(remoteNetConn, &tls.Config{
-		ServerName:   utils.HostOnly(fi.remoteEndpoint),
-		KeyLogWriter: fi.tlsKeyLogWriter,
-	})
 
 	localConn := frames.NewConnReadWriter(localNetConn)
-	remoteConn := frames.NewConnReadWriter(remoteTLSConn)
+	remoteConn := frames.NewConnReadWriter(remoteNetConn)
+
+	// the state map is shared by both phases, so the user's callback can see the client's OPEN frame.
+	sm := proto.NewStateMap()
+
+	ctx, _ := logging.ContextWithSloggerAndValues(fi.serverCtx, "connid", connInfo.ID)
+
+	// the user's callback is created after the client's OPEN, so ConnInfo has the client's container ID. It's
+	// first called for the service's OPEN, at the end of the first phase, so injectors can change what the
+	// service negotiates (ex: its idle-timeout).
+	var acMu sync.Mutex
+	var ac *activeConn
+	var callback MirrorCallback
+
+	userCallback := func() (*activeConn, MirrorCallback) {
+		acMu.Lock()
+		defer acMu.Unlock()
+
+		if ac == nil {
+			ac = &activeConn{info: connInfo, terminator: newTerminator()}
+			callback = fi.newConnCallback(ac)
+		}
+
+		return ac, callback
+	}
+
+	// the handshake callback is created when the client's protocol header arrives.
+	var handshakeCallback MirrorCallback
+	var handshakeCallbackOnce sync.Once
 
 	// run the mirroring logic until the connection is passed the OPEN frames.
-	if err := Mirror(fi.serverCtx, MirrorParams{
-		Callback:    mirrorConnUntilOpenFrame,
+	if err := Mirror(ctx, MirrorParams{
+		Callback: func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			openBody, isOpenFrame := params.Frame.Body.(*frames.PerformOpen)
+
+			switch {
+			case isHandshakeFrame(params.Frame) && fi.options.HandshakeFactory != nil:
+				handshakeCallbackOnce.Do(func() {
+					acMu.Lock()
+					info := connInfo
+					acMu.Unlock()
+
+					handshakeCallback = fi.options.HandshakeFactory(info)
+				})
+
+				return handshakeCallback(ctx, params)
+			case isOpenFrame && params.Out:
+				acMu.Lock()
+				connInfo.ContainerID = openBody.ContainerID
+				acMu.Unlock()
+			case isOpenFrame:
+				_, callback := userCallback()
+				metaFrames, err := callback(ctx, params)
+
+				if err == nil {
+					err = io.EOF
+				}
+
+				return metaFrames, err
+			}
+
+			return mirrorConnUntilOpenFrame(ctx, params)
+		},
 		FrameLogger: fi.frameLogger,
 		Local:       localConn,
 		Remote:      remoteConn,
+		StateMap:    sm,
 	}); err != nil {
 		return fmt.Errorf("failed mirroring till the OPEN frame: %w", err)
 	}
 
-	// from this point we run the user's callback
-	if err := Mirror(fi.serverCtx, MirrorParams{
-		Callback:    fi.callback,
+	// from this point we run the user's callback, for every frame.
+	userCallback()
+
+	ac.mirror = newMirror(MirrorParams{
+		Callback:    callback,
 		FrameLogger: fi.frameLogger,
 		Local:       localConn,
 		Remote:      remoteConn,
-	}); err != nil {
+		StateMap:    sm,
+		Shaping:     fi.options.Shaping,
+	})
+
+	fi.addConn(ac)
+	defer fi.removeConn(ac)
+
+	if err := ac.mirror.Serve(ctx); err != nil {
 		return fmt.Errorf("failed mirroring using the user's callback: %w", err)
 	}
 
 	return nil
 }
 
+// isHandshakeFrame is true for the frames that are exchanged before the OPEN frames: protocol headers and
+// SASL frames.
+func isHandshakeFrame(fr *frames.Frame) bool {
+	return fr.Header.FrameType == frames.FrameTypeSASL || fr.Body.Type() == frames.BodyTypeProtocolHeader
+}
+
 func mirrorConnUntilOpenFrame(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
 	retFrames := []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame}}
 
@@ -0,0 +1,204 @@
+package faultinjectors
+
+import (
+	"context"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultInjector_DisableTLS(t *testing.T) {
+	// a fake "service" - it just echoes back the AMQP preamble, which is enough to see that
+	// bytes are flowing, unencrypted, in both directions.
+	remoteListener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer remoteListener.Close()
+
+	go func() {
+		conn, err := remoteListener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+
+		preamble := make([]byte, 8)
+
+		if _, err := io.ReadFull(conn, preamble); err != nil {
+			return
+		}
+
+		_, _ = conn.Write(preamble)
+		_, _ = io.Copy(io.Discard, conn)
+	}()
+
+	fi, err := NewFaultInjector("127.0.0.1:0", remoteListener.Addr().String(), mirrorConnUntilOpenFrame, &FaultInjectorOptions{
+		DisableTLSForLocalEndpoint:  true,
+		DisableTLSForRemoteEndpoint: true,
+	})
+	require.NoError(t, err)
+
+	go func() { _ = fi.ListenAndServe() }()
+	defer fi.Close()
+
+	require.Eventually(t, func() bool { return fi.ListenAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+
+	conn, err := net.Dial("tcp4", fi.ListenAddr())
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("AMQP\x00\x01\x00\x00"))
+	require.NoError(t, err)
+
+	require.NoError(t, conn.SetReadDeadline(time.Now().Add(5*time.Second)))
+
+	preamble := make([]byte, 8)
+	_, err = io.ReadFull(conn, preamble)
+	require.NoError(t, err)
+	require.Equal(t, []byte("AMQP\x00\x01\x00\x00"), preamble)
+}
+
+func TestFaultInjector_Broker(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	passthrough := func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame}}, nil
+	}
+
+	fi := newFaultInjectorForTest(t, broker.ListenAddr(), passthrough)
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil))
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	msg, err := receiver.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(msg.GetData()))
+	require.NoError(t, receiver.AcceptMessage(ctx, msg))
+}
+
+func TestFaultInjector_BrokerDetachAfterTransfer(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	injector := NewDetachAfterTransferInjector(1, encoding.Error{Condition: proto.ErrCondDetachForced, Description: "detached by the fault injector"})
+	fi := newFaultInjectorForTest(t, broker.ListenAddr(), injector.Callback)
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+
+	var linkErr *amqp.LinkError
+	require.ErrorAs(t, err, &linkErr)
+	require.Equal(t, amqp.ErrCond(proto.ErrCondDetachForced), linkErr.RemoteErr.Condition)
+
+	// the TRANSFER was dropped, and replaced with the DETACH, so the message never made it to the broker.
+	messages, err := broker.Messages("queue")
+	require.NoError(t, err)
+	require.Empty(t, messages)
+}
+
+func TestFaultInjector_PerConnection(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	connInfos := make(chan ConnInfo, 2)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		connInfos <- connInfo
+
+		// each connection gets its own injector, so each of them gets detached, once.
+		injector := NewDetachAfterTransferInjector(1, encoding.Error{Condition: proto.ErrCondDetachForced})
+		return injector.Callback
+	}, nil)
+
+	for i, containerID := range []string{"first", "second"} {
+		conn, err := amqp.Dial(context.Background(), "amqp://"+fi.ListenAddr(), &amqp.ConnOptions{
+			SASLType:    amqp.SASLTypeAnonymous(),
+			ContainerID: containerID,
+		})
+		require.NoError(t, err)
+
+		t.Cleanup(func() { _ = conn.Close() })
+
+		connInfo := <-connInfos
+		require.Equal(t, int64(i+1), connInfo.ID)
+		require.Equal(t, containerID, connInfo.ContainerID)
+		require.NotEmpty(t, connInfo.ClientAddress)
+
+		session, err := conn.NewSession(context.Background(), nil)
+		require.NoError(t, err)
+
+		sender, err := session.NewSender(context.Background(), "queue", nil)
+		require.NoError(t, err)
+
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+
+		var linkErr *amqp.LinkError
+		require.ErrorAs(t, err, &linkErr)
+		require.Equal(t, amqp.ErrCond(proto.ErrCondDetachForced), linkErr.RemoteErr.Condition)
+	}
+}
+
+func newFaultInjectorForTest(t *testing.T, remoteEndpoint string, callback MirrorCallback) *FaultInjector {
+	return newFaultInjectorWithFactoryForTest(t, remoteEndpoint, func(connInfo ConnInfo) MirrorCallback { return callback }, nil)
+}
+
+// newFaultInjectorWithFactoryForTest starts a fault injector, with TLS disabled, for both the local and remote endpoints.
+func newFaultInjectorWithFactoryForTest(t *testing.T, remoteEndpoint string, factory MirrorCallbackFactory, options *FaultInjectorOptions) *FaultInjector {
+	if options == nil {
+		options = &FaultInjectorOptions{}
+	}
+
+	options.DisableTLSForLocalEndpoint = true
+	options.DisableTLSForRemoteEndpoint = true
+
+	fi, err := NewFaultInjectorWithFactory("127.0.0.1:0", remoteEndpoint, factory, options)
+	require.NoError(t, err)
+
+	go func() { _ = fi.ListenAndServe() }()
+	t.Cleanup(func() { _ = fi.Close() })
+
+	require.Eventually(t, func() bool { return fi.ListenAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+	return fi
+}
+
+func newSessionForTest(t *testing.T, addr string) *amqp.Session {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	session, err := newConnForTest(t, addr).NewSession(ctx, nil)
+	require.NoError(t, err)
+
+	return session
+}
+
+func newConnForTest(t *testing.T, addr string) *amqp.Conn {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := amqp.Dial(ctx, "amqp://"+addr, &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous()})
+	require.NoError(t, err)
+
+	t.Cleanup(func() { _ = conn.Close() })
+
+	return conn
+}
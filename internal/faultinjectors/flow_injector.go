@@ -0,0 +1,163 @@
+package faultinjectors
+
+import (
+	"context"
+	"path"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// FlowCreditAction is what a [FlowInjector] does with the link credit the service grants to senders.
+type FlowCreditAction string
+
+const (
+	// FlowCreditActionNone leaves the link credit alone.
+	FlowCreditActionNone = FlowCreditAction("")
+
+	// FlowCreditActionHold holds back the service's FLOW frames, for [FlowInjectorOptions.HoldFor].
+	FlowCreditActionHold = FlowCreditAction("hold")
+
+	// FlowCreditActionReduce caps the link credit at [FlowInjectorOptions.MaxCredit].
+	FlowCreditActionReduce = FlowCreditAction("reduce")
+
+	// FlowCreditActionZero sets the link credit to zero, so senders can't send anything.
+	FlowCreditActionZero = FlowCreditAction("zero")
+)
+
+// FlowDrainAction is what a [FlowInjector] does with drain requests from receivers.
+type FlowDrainAction string
+
+const (
+	// FlowDrainActionNone leaves drain requests alone.
+	FlowDrainActionNone = FlowDrainAction("")
+
+	// FlowDrainActionIgnore clears the drain flag, so the service never drains the link, or replies to the drain.
+	FlowDrainActionIgnore = FlowDrainAction("ignore")
+
+	// FlowDrainActionDelay delays drain requests by [FlowInjectorOptions.DrainDelay].
+	FlowDrainActionDelay = FlowDrainAction("delay")
+)
+
+type FlowInjectorOptions struct {
+	// Credit is what to do with the link credit the service grants to senders.
+	Credit FlowCreditAction
+
+	// MaxCredit is the most link credit a sender gets, for [FlowCreditActionReduce]. Once it's used up, the sender
+	// has to wait for the service's next FLOW.
+	MaxCredit uint32
+
+	// HoldFor is how long to hold back the service's FLOW frames, for [FlowCreditActionHold]. If it's zero they're
+	// never sent, and senders never get any credit.
+	HoldFor time.Duration
+
+	// Drain is what to do with drain requests from receivers.
+	Drain FlowDrainAction
+
+	// DrainDelay is how long to delay drain requests, for [FlowDrainActionDelay].
+	DrainDelay time.Duration
+
+	// Address, if set, only affects links with an address that matches this glob (see [path.Match]).
+	Address string
+}
+
+// NewFlowInjector creates an injector that manipulates link-level FLOW frames. It can starve senders of link
+// credit, to simulate the service throttling, and interfere with receivers draining their link credit.
+//
+// NOTE: the FLOW frames are only changed going to the client, so the service still thinks the sender has all the
+// credit it granted.
+func NewFlowInjector(options FlowInjectorOptions) *FlowInjector {
+	switch options.Credit {
+	case FlowCreditActionNone, FlowCreditActionHold, FlowCreditActionReduce, FlowCreditActionZero:
+	default:
+		utils.Panicf("invalid Credit action %q", options.Credit)
+	}
+
+	switch options.Drain {
+	case FlowDrainActionNone, FlowDrainActionIgnore:
+	case FlowDrainActionDelay:
+		if options.DrainDelay <= 0 {
+			utils.Panicf("DrainDelay must be greater than zero")
+		}
+	default:
+		utils.Panicf("invalid Drain action %q", options.Drain)
+	}
+
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &FlowInjector{options: options}
+}
+
+type FlowInjector struct {
+	options FlowInjectorOptions
+}
+
+func (inj *FlowInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	flowBody, isFlow := params.Frame.Body.(*frames.PerformFlow)
+
+	// session-level FLOW frames don't have a handle.
+	if !isFlow || flowBody.Handle == nil || params.Role() == nil || !globMatches(inj.options.Address, params.Address()) {
+		return passthrough(params), nil
+	}
+
+	// NOTE: for inbound frames, the role is for the service's end of the link.
+	if !params.Out && *params.Role() == encoding.RoleReceiver {
+		return inj.creditForSender(ctx, params, flowBody), nil
+	}
+
+	if params.Out && *params.Role() == encoding.RoleReceiver && flowBody.Drain {
+		return inj.drainForReceiver(ctx, params, flowBody), nil
+	}
+
+	return passthrough(params), nil
+}
+
+func (inj *FlowInjector) creditForSender(ctx context.Context, params MirrorCallbackParams, flowBody *frames.PerformFlow) []MetaFrame {
+	logger := logging.SloggerFromContext(ctx)
+
+	switch inj.options.Credit {
+	case FlowCreditActionHold:
+		if inj.options.HoldFor == 0 {
+			logger.Info("Holding FLOW, indefinitely", "address", params.Address())
+			return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "holding link credit"}}
+		}
+
+		logger.Info("Holding FLOW", "address", params.Address(), "duration", inj.options.HoldFor)
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: inj.options.HoldFor, Description: "holding link credit"}}
+	case FlowCreditActionReduce:
+		if flowBody.LinkCredit == nil || *flowBody.LinkCredit <= inj.options.MaxCredit {
+			return passthrough(params)
+		}
+
+		logger.Info("Reducing link credit", "address", params.Address(), "credit", *flowBody.LinkCredit, "newCredit", inj.options.MaxCredit)
+		flowBody.LinkCredit = utils.Ptr(inj.options.MaxCredit)
+	case FlowCreditActionZero:
+		logger.Info("Zeroing link credit", "address", params.Address())
+		flowBody.LinkCredit = utils.Ptr(uint32(0))
+	default:
+		return passthrough(params)
+	}
+
+	return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "changed link credit"}}
+}
+
+func (inj *FlowInjector) drainForReceiver(ctx context.Context, params MirrorCallbackParams, flowBody *frames.PerformFlow) []MetaFrame {
+	logger := logging.SloggerFromContext(ctx)
+
+	switch inj.options.Drain {
+	case FlowDrainActionIgnore:
+		logger.Info("Ignoring drain", "address", params.Address())
+		flowBody.Drain = false
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "ignoring drain"}}
+	case FlowDrainActionDelay:
+		logger.Info("Delaying drain", "address", params.Address(), "delay", inj.options.DrainDelay)
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: inj.options.DrainDelay, Description: "delaying drain"}}
+	default:
+		return passthrough(params)
+	}
+}
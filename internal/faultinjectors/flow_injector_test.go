@@ -0,0 +1,145 @@
+package faultinjectors
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowInjector_ZeroCredit(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewFlowInjector(FlowInjectorOptions{Credit: FlowCreditActionZero, Address: "starved"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	starvedSender, err := session.NewSender(context.Background(), "starved", nil)
+	require.NoError(t, err)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	// the sender never gets any credit, so it can't send.
+	requireNoCreditForTest(t, starvedSender)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+}
+
+func TestFlowInjector_ReduceCredit(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewFlowInjector(FlowInjectorOptions{Credit: FlowCreditActionReduce, MaxCredit: 2})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	for range 2 {
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		require.NoError(t, err)
+	}
+
+	// the broker granted plenty of credit, but the sender only got 2 of it, and the broker won't
+	// grant more until half of its credit is used up.
+	requireNoCreditForTest(t, sender)
+}
+
+func TestFlowInjector_HoldCredit(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewFlowInjector(FlowInjectorOptions{Credit: FlowCreditActionHold, HoldFor: time.Second})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	start := time.Now()
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+func TestFlowInjector_Drain(t *testing.T) {
+	newDrainParams := func() MirrorCallbackParams {
+		// handle/channel are 200 for our receiver, in the state map.
+		return MirrorCallbackParams{
+			Out: true,
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: 200},
+				Body: &frames.PerformFlow{
+					Handle:        utils.Ptr(uint32(200)),
+					DeliveryCount: utils.Ptr(uint32(0)),
+					LinkCredit:    utils.Ptr(uint32(10)),
+					Drain:         true,
+				},
+			},
+			StateMap: loadStateMap(t),
+		}
+	}
+
+	t.Run("ignore", func(t *testing.T) {
+		injector := NewFlowInjector(FlowInjectorOptions{Drain: FlowDrainActionIgnore})
+
+		params := newDrainParams()
+		metaFrames, err := injector.Callback(context.Background(), params)
+		require.NoError(t, err)
+		require.Len(t, metaFrames, 1)
+		require.Equal(t, MetaFrameActionModified, metaFrames[0].Action)
+		require.False(t, metaFrames[0].Frame.Body.(*frames.PerformFlow).Drain)
+	})
+
+	t.Run("delay", func(t *testing.T) {
+		injector := NewFlowInjector(FlowInjectorOptions{Drain: FlowDrainActionDelay, DrainDelay: time.Second})
+
+		params := newDrainParams()
+		metaFrames, err := injector.Callback(context.Background(), params)
+		require.NoError(t, err)
+		require.Len(t, metaFrames, 1)
+		require.Equal(t, MetaFrameActionPassthrough, metaFrames[0].Action)
+		require.Equal(t, time.Second, metaFrames[0].Delay)
+		require.True(t, metaFrames[0].Frame.Body.(*frames.PerformFlow).Drain)
+	})
+
+	t.Run("not draining", func(t *testing.T) {
+		injector := NewFlowInjector(FlowInjectorOptions{Drain: FlowDrainActionIgnore})
+
+		params := newDrainParams()
+		params.Frame.Body.(*frames.PerformFlow).Drain = false
+
+		metaFrames, err := injector.Callback(context.Background(), params)
+		require.NoError(t, err)
+		require.Equal(t, passthrough(params), metaFrames)
+	})
+}
+
+// requireNoCreditForTest checks that the sender can't send, because it has no link credit. The sender waits
+// for credit until the context is cancelled.
+func requireNoCreditForTest(t *testing.T, sender *amqp.Sender) {
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	err := sender.Send(ctx, amqp.NewMessage([]byte("hello world")), nil)
+
+	var amqpErr *amqp.Error
+	require.ErrorAs(t, err, &amqpErr)
+	require.Equal(t, amqp.ErrCondTransferLimitExceeded, amqpErr.Condition)
+}
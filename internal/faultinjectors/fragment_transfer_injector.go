@@ -0,0 +1,139 @@
+package faultinjectors
+
+import (
+	"context"
+	"path"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type FragmentTransferInjectorOptions struct {
+	// Out, if set, only fragments deliveries going in one direction: true for deliveries the client sends, false
+	// for deliveries the client receives. If nil, deliveries going in both directions are fragmented.
+	Out *bool
+
+	// Address, if set, only fragments deliveries on links with an address that matches this glob (see
+	// [path.Match]). If it's empty, deliveries on all links are fragmented, apart from $cbs and $management links.
+	Address string
+
+	// FragmentSize is the most payload, in bytes, each TRANSFER frame carries. Deliveries are split into as
+	// many frames as it takes, with more=true on all but the last.
+	FragmentSize int
+
+	// AbortAfter, if set, aborts each delivery after sending this many of its frames, by sending a TRANSFER
+	// with aborted=true instead of the rest of them. The receiver throws away what it's received so far, so
+	// the delivery is lost.
+	AbortAfter int
+}
+
+// NewFragmentTransferInjector creates an injector that splits deliveries into lots of small TRANSFER frames,
+// and (optionally) aborts them part way through. Useful for exercising the receiver's reassembly, and its
+// handling of aborted deliveries.
+//
+// Deliveries that are already split across multiple TRANSFER frames are held until the last frame arrives, and
+// then re-split. The transfer-ids in the session's FLOW frames are adjusted for the frames we've added, or removed.
+//
+// NOTE: the service doesn't reply to an aborted delivery, so a client that's waiting for the delivery's outcome
+// (ex: a sender, using an unsettled delivery) waits until it gives up. When the client is the receiver the
+// service still considers the delivery to be in flight, until the link is closed.
+func NewFragmentTransferInjector(options FragmentTransferInjectorOptions) *FragmentTransferInjector {
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	if options.FragmentSize <= 0 {
+		utils.Panicf("FragmentSize must be greater than zero")
+	}
+
+	if options.AbortAfter < 0 {
+		utils.Panicf("AbortAfter cannot be negative")
+	}
+
+	return &FragmentTransferInjector{
+		options:     options,
+		assembler:   newTransferAssembler(),
+		transferIDs: newTransferIDShifter(),
+	}
+}
+
+type FragmentTransferInjector struct {
+	options     FragmentTransferInjectorOptions
+	assembler   *transferAssembler
+	transferIDs *transferIDShifter
+}
+
+func (inj *FragmentTransferInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if inj.transferIDs.Intercept(params) {
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "adjusted for fragmented deliveries"}}, nil
+	}
+
+	transferBody, isTransfer := params.Frame.Body.(*frames.PerformTransfer)
+
+	if !isTransfer || (inj.options.Out != nil && *inj.options.Out != params.Out) || !deliveryAddressMatches(inj.options.Address, params) {
+		return passthrough(params), nil
+	}
+
+	// a delivery we've started holding is finished off, even if its later frames are filtered out.
+	if !triggersAllowed && !inj.assembler.Holding(params, transferBody) {
+		return passthrough(params), nil
+	}
+
+	delivery := inj.assembler.Add(params, transferBody)
+
+	if delivery == nil {
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "holding until the rest of the delivery arrives"}}, nil
+	}
+
+	if transferBody.Aborted {
+		return passthroughDelivery(delivery), nil
+	}
+
+	payload := transferPayload(delivery)
+	fragments := (len(payload) + inj.options.FragmentSize - 1) / inj.options.FragmentSize
+
+	split, err := splitTransfer(delivery[0], payload, fragments, maxFrameSize(params))
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	var metaFrames []MetaFrame
+
+	if inj.options.AbortAfter == 0 {
+		logger.Info("Fragmenting delivery", "address", params.Address(), "frames", len(delivery), "newFrames", len(split))
+
+		for _, fr := range split {
+			metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: fr, Description: "fragmented delivery"})
+		}
+
+		inj.transferIDs.Sent(params, len(delivery), len(split))
+		return metaFrames, nil
+	}
+
+	split = split[:min(inj.options.AbortAfter, len(split))]
+	logger.Info("Aborting delivery", "address", params.Address(), "frames", len(delivery), "sentFrames", len(split))
+
+	for _, fr := range split {
+		// even if it's the delivery's last frame, the receiver has to expect more, or there'd be nothing to abort.
+		fr.Body.(*frames.PerformTransfer).More = true
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: fr, Description: "fragmented delivery"})
+	}
+
+	metaFrames = append(metaFrames, MetaFrame{
+		Action: MetaFrameActionAdded,
+		Frame: &frames.Frame{
+			Header: frames.Header{FrameType: params.Frame.Header.FrameType, Channel: params.Channel()},
+			Body:   &frames.PerformTransfer{Handle: transferBody.Handle, Aborted: true},
+		},
+		Description: "aborted delivery",
+	})
+
+	inj.transferIDs.Sent(params, len(delivery), len(metaFrames))
+	return metaFrames, nil
+}
@@ -0,0 +1,102 @@
+package faultinjectors
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFragmentTransferInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	// counts the TRANSFER frames that are actually sent, in each direction.
+	var outTransfers, inTransfers atomic.Int32
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewFragmentTransferInjector(FragmentTransferInjectorOptions{FragmentSize: 100})
+
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			metaFrames, err := injector.Callback(ctx, params)
+
+			for _, mf := range metaFrames {
+				if mf.Action != MetaFrameActionDropped && mf.Frame.Body.Type() == frames.BodyTypeTransfer {
+					if params.Out {
+						outTransfers.Add(1)
+					} else {
+						inTransfers.Add(1)
+					}
+				}
+			}
+
+			return metaFrames, err
+		}
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	body := strings.Repeat("0123456789", 100)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil))
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	msg, err := receiver.Receive(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+	require.Equal(t, body, string(msg.GetData()))
+
+	// the encoded message is a little bigger than the body, so it needs at least one more frame.
+	require.Greater(t, outTransfers.Load(), int32(10))
+	require.Greater(t, inTransfers.Load(), int32(10))
+}
+
+func TestFragmentTransferInjector_Abort(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewFragmentTransferInjector(FragmentTransferInjectorOptions{Out: utils.Ptr(false), FragmentSize: 100, AbortAfter: 3})
+
+		// only the first delivery is aborted.
+		return When(And(IsInbound, IsType(frames.BodyTypeTransfer)), Once(injector.Callback))
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	aborted := strings.Repeat("0123456789", 100)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(aborted)), nil))
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", &amqp.ReceiverOptions{Credit: 10})
+	require.NoError(t, err)
+
+	// the client throws away the aborted delivery, and gets the next one.
+	msg, err := receiver.Receive(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+	require.Equal(t, "hello", string(msg.GetData()))
+
+	// the broker still thinks the aborted delivery is in flight, until the link's closed.
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	require.NoError(t, receiver.Close(ctx))
+
+	messages, err := broker.Messages("queue")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, aborted, string(messages[0].GetData()))
+}
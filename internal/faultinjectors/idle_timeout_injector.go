@@ -0,0 +1,54 @@
+package faultinjectors
+
+import (
+	"context"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+)
+
+type IdleTimeoutInjectorOptions struct {
+	// Out, if set, only drops empty frames going in one direction: true for frames from the client to the service,
+	// false for frames from the service to the client. If nil, empty frames are dropped in both directions.
+	Out *bool
+
+	// IdleTimeout, if set, replaces the idle-timeout in the service's OPEN frame. The client sends empty frames at
+	// half this interval, or not at all if it's zero.
+	//
+	// NOTE: the client's OPEN frame is sent before any injectors are created, so its idle-timeout can't be changed.
+	IdleTimeout *time.Duration
+}
+
+// NewIdleTimeoutInjector creates an injector that drops empty frames, which peers send as keep-alives when there's
+// no other traffic. Once they stop, the peer's idle timer fires and it should consider the connection dead.
+func NewIdleTimeoutInjector(options IdleTimeoutInjectorOptions) *IdleTimeoutInjector {
+	return &IdleTimeoutInjector{options: options}
+}
+
+type IdleTimeoutInjector struct {
+	options IdleTimeoutInjectorOptions
+}
+
+func (inj *IdleTimeoutInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformOpen:
+		if params.Out || inj.options.IdleTimeout == nil {
+			return passthrough(params), nil
+		}
+
+		logging.SloggerFromContext(ctx).Info("Changing idle-timeout in OPEN", "idleTimeout", body.IdleTimeout, "newIdleTimeout", *inj.options.IdleTimeout)
+		body.IdleTimeout = *inj.options.IdleTimeout
+
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "changed idle-timeout"}}, nil
+	case *frames.EmptyFrame:
+		if inj.options.Out != nil && *inj.options.Out != params.Out {
+			return passthrough(params), nil
+		}
+
+		logging.SloggerFromContext(ctx).Info("Dropping empty frame")
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "suppressed keep-alive"}}, nil
+	default:
+		return passthrough(params), nil
+	}
+}
@@ -0,0 +1,116 @@
+package faultinjectors
+
+import (
+	"context"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIdleTimeoutInjector(t *testing.T) {
+	for _, drop := range []bool{false, true} {
+		t.Run(map[bool]string{false: "keep-alives", true: "no keep-alives"}[drop], func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				if !drop {
+					return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+						return passthrough(params), nil
+					}
+				}
+
+				injector := NewIdleTimeoutInjector(IdleTimeoutInjectorOptions{Out: utils.Ptr(false)})
+				return injector.Callback
+			}, nil)
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// the broker sends keep-alives at a quarter of this, since the client advertises half of it.
+			conn, err := amqp.Dial(ctx, "amqp://"+fi.ListenAddr(), &amqp.ConnOptions{
+				SASLType:    amqp.SASLTypeAnonymous(),
+				IdleTimeout: time.Second,
+			})
+			require.NoError(t, err)
+
+			t.Cleanup(func() { _ = conn.Close() })
+
+			session, err := conn.NewSession(ctx, nil)
+			require.NoError(t, err)
+
+			sender, err := session.NewSender(ctx, "queue", nil)
+			require.NoError(t, err)
+
+			time.Sleep(2 * time.Second)
+
+			err = sender.Send(ctx, amqp.NewMessage([]byte("hello world")), nil)
+
+			if !drop {
+				require.NoError(t, err)
+				return
+			}
+
+			// the client didn't hear from the broker within its idle timeout, so it gave up on the connection.
+			requireDisconnectedForTest(t, err)
+		})
+	}
+}
+
+func TestIdleTimeoutInjector_RewriteOpen(t *testing.T) {
+	injector := NewIdleTimeoutInjector(IdleTimeoutInjectorOptions{Out: utils.Ptr(true), IdleTimeout: utils.Ptr(time.Duration(0))})
+
+	metaFrames, err := injector.Callback(context.Background(), MirrorCallbackParams{
+		Frame:    &frames.Frame{Body: &frames.PerformOpen{ContainerID: "service", IdleTimeout: time.Minute}},
+		StateMap: proto.NewStateMap(),
+	})
+	require.NoError(t, err)
+	require.Len(t, metaFrames, 1)
+	require.Equal(t, MetaFrameActionModified, metaFrames[0].Action)
+	require.Zero(t, metaFrames[0].Frame.Body.(*frames.PerformOpen).IdleTimeout)
+
+	// only empty frames going the right direction are dropped.
+	for _, out := range []bool{false, true} {
+		params := MirrorCallbackParams{Out: out, Frame: &frames.Frame{Body: &frames.EmptyFrame{}}, StateMap: proto.NewStateMap()}
+
+		metaFrames, err := injector.Callback(context.Background(), params)
+		require.NoError(t, err)
+
+		if out {
+			require.Equal(t, []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "suppressed keep-alive"}}, metaFrames)
+		} else {
+			require.Equal(t, passthrough(params), metaFrames)
+		}
+	}
+}
+
+func TestIdleTimeoutInjector_IdleTimeout(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	var keepAlives atomic.Int64
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewIdleTimeoutInjector(IdleTimeoutInjectorOptions{Out: utils.Ptr(false), IdleTimeout: utils.Ptr(200 * time.Millisecond)})
+
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			if _, isEmpty := params.Frame.Body.(*frames.EmptyFrame); isEmpty && params.Out {
+				keepAlives.Add(1)
+			}
+
+			return injector.Callback(ctx, params)
+		}
+	}, nil)
+
+	// the broker doesn't have an idle-timeout, so the client only sends keep-alives (every 100ms, half the
+	// idle-timeout) if it got the one we put in the service's OPEN.
+	_ = newConnForTest(t, fi.ListenAddr())
+
+	time.Sleep(time.Second)
+	require.GreaterOrEqual(t, keepAlives.Load(), int64(5))
+}
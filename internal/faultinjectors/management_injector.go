@@ -0,0 +1,322 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// ManagementAction is what a [ManagementInjector] does with the responses to matching $management requests.
+type ManagementAction string
+
+const (
+	// ManagementActionRewrite rewrites the response's status, and optionally its body.
+	ManagementActionRewrite = ManagementAction("rewrite")
+
+	// ManagementActionDelay delays the response, by [ManagementInjectorOptions.Delay].
+	ManagementActionDelay = ManagementAction("delay")
+
+	// ManagementActionDrop drops the response, so the client never gets it. The service still counts it against the
+	// client receiver's link credit. If the response isn't settled we accept it, on the client's behalf, so the
+	// service isn't left waiting for it.
+	ManagementActionDrop = ManagementAction("drop")
+)
+
+type ManagementInjectorOptions struct {
+	// Operation, if set, only affects requests with this operation application property
+	// (ex: com.microsoft:renew-lock). Otherwise every request is affected.
+	Operation string
+
+	// Address, if set, only affects $management links with an address that matches this glob (see [path.Match]),
+	// ex: "myqueue/$management".
+	Address string
+
+	// Action is what to do with the response.
+	Action ManagementAction
+
+	// StatusCode replaces the response's status code, for [ManagementActionRewrite] (ex: 410, for a lost lock).
+	StatusCode int32
+
+	// StatusDescription replaces the response's status description, for [ManagementActionRewrite].
+	StatusDescription string
+
+	// ErrorCondition, if set, is added to the response as its errorCondition, for [ManagementActionRewrite]
+	// (ex: com.microsoft:message-lock-lost).
+	ErrorCondition string
+
+	// Body, if set, replaces the response's body (its AMQP value section), for [ManagementActionRewrite].
+	Body any
+
+	// Delay is how long to delay the response, for [ManagementActionDelay].
+	Delay time.Duration
+}
+
+// NewManagementInjector creates an injector that manipulates the responses to $management requests, like the
+// ones Service Bus and Event Hubs use to renew locks, peek messages or schedule messages. Requests are matched by
+// their operation, and their responses are found using the response's correlation-id.
+//
+// NOTE: responses that are split across multiple TRANSFER frames are passed through, unchanged.
+func NewManagementInjector(options ManagementInjectorOptions) *ManagementInjector {
+	switch options.Action {
+	case ManagementActionRewrite:
+		if options.StatusCode == 0 {
+			utils.Panicf("StatusCode must be set")
+		}
+	case ManagementActionDelay:
+		if options.Delay <= 0 {
+			utils.Panicf("Delay must be greater than zero")
+		}
+	case ManagementActionDrop:
+	default:
+		utils.Panicf("invalid Action %q", options.Action)
+	}
+
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &ManagementInjector{
+		options:  options,
+		requests: map[linkID][]byte{},
+		multi:    map[linkID]bool{},
+		pending:  map[string]pendingRequest{},
+	}
+}
+
+type ManagementInjector struct {
+	options ManagementInjectorOptions
+
+	mu sync.Mutex
+
+	// requests has the payload so far, for requests that are split across multiple TRANSFER frames. It's
+	// keyed by the client's channel and handle.
+	requests map[linkID][]byte
+
+	// multi is true for links that are in the middle of a response that's split across multiple TRANSFER
+	// frames. It's keyed by the service's channel and handle.
+	multi map[linkID]bool
+
+	// pending are the matched requests that haven't had a response, keyed by their message-id.
+	pending map[string]pendingRequest
+}
+
+type pendingRequest struct {
+	operation string
+
+	// link is the client's channel and handle, for the link that sent the request.
+	link linkID
+}
+
+func (inj *ManagementInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformDetach:
+		inj.forget(params.Out, func(id linkID) bool { return id == linkID{params.Channel(), body.Handle} })
+		return passthrough(params), nil
+	case *frames.PerformEnd:
+		inj.forget(params.Out, func(id linkID) bool { return id.Channel == params.Channel() })
+		return passthrough(params), nil
+	}
+
+	transferBody, isTransfer := params.Frame.Body.(*frames.PerformTransfer)
+
+	if !isTransfer || !strings.HasSuffix(params.Address(), ManagementEntityPathSuffix) || !globMatches(inj.options.Address, params.Address()) {
+		return passthrough(params), nil
+	}
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if params.Out {
+		inj.trackRequest(ctx, params, transferBody)
+		return passthrough(params), nil
+	}
+
+	return inj.handleResponse(ctx, params, transferBody, triggersAllowed)
+}
+
+// trackRequest records the message-id of requests with a matching operation, so we can find their response.
+func (inj *ManagementInjector) trackRequest(ctx context.Context, params MirrorCallbackParams, transferBody *frames.PerformTransfer) {
+	id := linkID{params.Channel(), transferBody.Handle}
+	payload := append(inj.requests[id], transferBody.Payload...)
+
+	if transferBody.More {
+		inj.requests[id] = payload
+		return
+	}
+
+	delete(inj.requests, id)
+
+	if transferBody.Aborted {
+		return
+	}
+
+	req := &models.Message{}
+
+	if err := req.UnmarshalBinary(payload); err != nil {
+		logging.SloggerFromContext(ctx).Warn("Failed to unmarshal $management request", "error", err)
+		return
+	}
+
+	operation, _ := req.ApplicationProperties["operation"].(string)
+
+	if req.Properties == nil || req.Properties.MessageID == nil || (inj.options.Operation != "" && operation != inj.options.Operation) {
+		return
+	}
+
+	inj.pending[correlationKey(req.Properties.MessageID)] = pendingRequest{operation: operation, link: id}
+}
+
+// forget removes the state for links that have been detached, or are in a session that's ended. The client's
+// frames end its own links (out is true), and the service's frames end the service's.
+func (inj *ManagementInjector) forget(out bool, ended func(id linkID) bool) {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if !out {
+		maps.DeleteFunc(inj.multi, func(id linkID, _ bool) bool { return ended(id) })
+		return
+	}
+
+	maps.DeleteFunc(inj.requests, func(id linkID, _ []byte) bool { return ended(id) })
+
+	// the service won't respond to requests on a link that's gone.
+	maps.DeleteFunc(inj.pending, func(_ string, req pendingRequest) bool { return ended(req.link) })
+}
+
+// handleResponse changes the response to a pending request. If triggersAllowed is false the request is no longer
+// pending, but its response is passed through.
+func (inj *ManagementInjector) handleResponse(ctx context.Context, params MirrorCallbackParams, transferBody *frames.PerformTransfer, triggersAllowed bool) ([]MetaFrame, error) {
+	logger := logging.SloggerFromContext(ctx)
+	id := linkID{params.Channel(), transferBody.Handle}
+
+	if inj.multi[id] || transferBody.More {
+		if transferBody.More {
+			inj.multi[id] = true
+		} else {
+			delete(inj.multi, id)
+		}
+
+		logger.Debug("Not changing $management response, it's split across multiple TRANSFER frames")
+		return passthrough(params), nil
+	}
+
+	resp := &models.Message{}
+
+	if err := resp.UnmarshalBinary(transferBody.Payload); err != nil {
+		logger.Warn("Failed to unmarshal $management response", "error", err)
+		return passthrough(params), nil
+	}
+
+	if resp.Properties == nil || resp.Properties.CorrelationID == nil {
+		return passthrough(params), nil
+	}
+
+	key := correlationKey(resp.Properties.CorrelationID)
+	req, isPending := inj.pending[key]
+
+	if !isPending {
+		return passthrough(params), nil
+	}
+
+	delete(inj.pending, key)
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	switch inj.options.Action {
+	case ManagementActionDelay:
+		logger.Info("Delaying $management response", "operation", req.operation, "delay", inj.options.Delay)
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: inj.options.Delay, Description: "delaying $management response"}}, nil
+	case ManagementActionDrop:
+		logger.Info("Dropping $management response", "operation", req.operation)
+		return inj.drop(params, transferBody), nil
+	default:
+		logger.Info("Rewriting $management response", "operation", req.operation, "statusCode", inj.options.StatusCode)
+		inj.rewrite(resp)
+
+		payload, err := resp.MarshalBinary()
+
+		if err != nil {
+			return nil, err
+		}
+
+		transferBody.Payload = payload
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "rewriting $management response"}}, nil
+	}
+}
+
+// drop drops the response. If it's not settled, the service is waiting for the client to settle it, which it never
+// will, so we accept it instead.
+func (inj *ManagementInjector) drop(params MirrorCallbackParams, transferBody *frames.PerformTransfer) []MetaFrame {
+	metaFrames := []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "dropping $management response"}}
+
+	if transferBody.Settled || transferBody.DeliveryID == nil {
+		return metaFrames
+	}
+
+	// the DISPOSITION is sent to the service, so we need the client's channel for the session.
+	localChannel := params.StateMap.LookupCorrespondingChannel(false, params.Channel())
+
+	if localChannel == nil {
+		return metaFrames
+	}
+
+	return append(metaFrames, MetaFrame{
+		Action:      MetaFrameActionAdded,
+		OverrideOut: utils.Ptr(true),
+		Frame: &frames.Frame{
+			Header: frames.Header{Channel: *localChannel},
+			Body: &frames.PerformDisposition{
+				Role:    encoding.RoleReceiver,
+				First:   *transferBody.DeliveryID,
+				Settled: true,
+				State:   &encoding.StateAccepted{},
+			},
+		},
+		Description: "settling dropped $management response",
+	})
+}
+
+// rewrite changes the response's status, and body. Service Bus uses statusCode and statusDescription, and Event
+// Hubs uses status-code and status-description, so we update whichever the response already has.
+func (inj *ManagementInjector) rewrite(resp *models.Message) {
+	if resp.ApplicationProperties == nil {
+		resp.ApplicationProperties = map[string]any{}
+	}
+
+	codeKey, descKey := "statusCode", "statusDescription"
+
+	if _, isHyphenated := resp.ApplicationProperties["status-code"]; isHyphenated {
+		codeKey, descKey = "status-code", "status-description"
+	}
+
+	resp.ApplicationProperties[codeKey] = inj.options.StatusCode
+	resp.ApplicationProperties[descKey] = inj.options.StatusDescription
+
+	if inj.options.ErrorCondition != "" {
+		resp.ApplicationProperties["errorCondition"] = inj.options.ErrorCondition
+	}
+
+	if inj.options.Body != nil {
+		resp.Value = inj.options.Body
+	}
+}
+
+// correlationKey turns a message-id, or correlation-id, into a map key. They can be strings, UUIDs, integers or
+// binary, so we include the type, so (for example) the string "1" and the integer 1 are different.
+func correlationKey(id any) string {
+	return fmt.Sprintf("%T:%v", id, id)
+}
@@ -0,0 +1,183 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestManagementInjector_Rewrite(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewManagementInjector(ManagementInjectorOptions{
+			Operation:         "com.microsoft:renew-lock",
+			Action:            ManagementActionRewrite,
+			StatusCode:        410,
+			StatusDescription: "The lock was lost",
+			ErrorCondition:    "com.microsoft:message-lock-lost",
+		})
+		return injector.Callback
+	}, nil)
+
+	rpc := newManagementLinkForTest(t, fi.ListenAddr())
+
+	resp := rpc.Call(t, context.Background(), "com.microsoft:renew-lock")
+	require.Equal(t, map[string]any{
+		"statusCode":        int32(410),
+		"statusDescription": "The lock was lost",
+		"errorCondition":    "com.microsoft:message-lock-lost",
+	}, resp.ApplicationProperties)
+
+	// other operations are left alone.
+	resp = rpc.Call(t, context.Background(), "com.microsoft:peek-message")
+	require.Equal(t, int32(200), resp.ApplicationProperties["statusCode"])
+}
+
+func TestManagementInjector_Drop(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	var settled atomic.Int32
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewManagementInjector(ManagementInjectorOptions{Operation: "com.microsoft:renew-lock", Action: ManagementActionDrop})
+
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			metaFrames, err := injector.Callback(ctx, params)
+
+			for _, mf := range metaFrames {
+				if disposition, ok := mf.Frame.Body.(*frames.PerformDisposition); ok && mf.Action == MetaFrameActionAdded && disposition.Settled {
+					settled.Add(1)
+				}
+			}
+
+			return metaFrames, err
+		}
+	}, nil)
+
+	rpc := newManagementLinkForTest(t, fi.ListenAddr())
+
+	rpc.Send(t, "com.microsoft:renew-lock")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+
+	_, err := rpc.receiver.Receive(ctx, nil)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	// the service is still waiting for the dropped response to be settled, so we settle it.
+	require.Equal(t, int32(1), settled.Load())
+
+	// the next response, for a different operation, still gets through.
+	resp := rpc.Call(t, context.Background(), "com.microsoft:schedule-message")
+	require.Equal(t, int32(200), resp.ApplicationProperties["statusCode"])
+}
+
+func TestManagementInjector_ForgetsDetachedLinks(t *testing.T) {
+	injector := NewManagementInjector(ManagementInjectorOptions{Action: ManagementActionDrop})
+	injector.requests[linkID{1, 2}] = []byte("partial request")
+	injector.pending["string:request 1"] = pendingRequest{operation: "com.microsoft:renew-lock", link: linkID{1, 2}}
+	injector.pending["string:request 2"] = pendingRequest{operation: "com.microsoft:renew-lock", link: linkID{1, 3}}
+	injector.multi[linkID{1, 2}] = true
+
+	detach := func(out bool, channel uint16, handle uint32) {
+		_, err := injector.Callback(context.Background(), MirrorCallbackParams{
+			Out:   out,
+			Frame: &frames.Frame{Header: frames.Header{Channel: channel}, Body: &frames.PerformDetach{Handle: handle, Closed: true}},
+		})
+		require.NoError(t, err)
+	}
+
+	// the client's DETACH only ends the client's link.
+	detach(true, 1, 2)
+	require.Empty(t, injector.requests)
+	require.Equal(t, map[string]pendingRequest{"string:request 2": {operation: "com.microsoft:renew-lock", link: linkID{1, 3}}}, injector.pending)
+	require.Equal(t, map[linkID]bool{{1, 2}: true}, injector.multi)
+
+	detach(false, 1, 2)
+	require.Empty(t, injector.multi)
+
+	// ending the session forgets all of its links.
+	_, err := injector.Callback(context.Background(), MirrorCallbackParams{
+		Out:   true,
+		Frame: &frames.Frame{Header: frames.Header{Channel: 1}, Body: &frames.PerformEnd{}},
+	})
+	require.NoError(t, err)
+	require.Empty(t, injector.pending)
+}
+
+func TestManagementInjector_Delay(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewManagementInjector(ManagementInjectorOptions{Action: ManagementActionDelay, Delay: time.Second})
+		return injector.Callback
+	}, nil)
+
+	rpc := newManagementLinkForTest(t, fi.ListenAddr())
+
+	start := time.Now()
+
+	resp := rpc.Call(t, context.Background(), "com.microsoft:renew-lock")
+	require.Equal(t, int32(200), resp.ApplicationProperties["statusCode"])
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+}
+
+// managementLinkForTest is a minimal $management client, a sender for requests and a receiver for
+// their responses.
+type managementLinkForTest struct {
+	sender   *amqp.Sender
+	receiver *amqp.Receiver
+	requests int
+}
+
+func newManagementLinkForTest(t *testing.T, addr string) *managementLinkForTest {
+	session := newSessionForTest(t, addr)
+
+	sender, err := session.NewSender(context.Background(), "queue/$management", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue/$management", &amqp.ReceiverOptions{
+		// dropped responses still use up the receiver's credit.
+		Credit:        10,
+		TargetAddress: "reply-to-address",
+	})
+	require.NoError(t, err)
+
+	return &managementLinkForTest{sender: sender, receiver: receiver}
+}
+
+// Send sends a request, and returns its message-id.
+func (rpc *managementLinkForTest) Send(t *testing.T, operation string) string {
+	rpc.requests++
+	messageID := fmt.Sprintf("request %d", rpc.requests)
+
+	err := rpc.sender.Send(context.Background(), &amqp.Message{
+		Properties:            &amqp.MessageProperties{MessageID: messageID, ReplyTo: utils.Ptr("reply-to-address")},
+		ApplicationProperties: map[string]any{"operation": operation},
+		Value:                 map[string]any{},
+	}, nil)
+	require.NoError(t, err)
+
+	return messageID
+}
+
+// Call sends a request, and waits for its response.
+func (rpc *managementLinkForTest) Call(t *testing.T, ctx context.Context, operation string) *amqp.Message {
+	messageID := rpc.Send(t, operation)
+
+	resp, err := rpc.receiver.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, rpc.receiver.AcceptMessage(ctx, resp))
+	require.Equal(t, messageID, resp.Properties.CorrelationID)
+
+	return resp
+}
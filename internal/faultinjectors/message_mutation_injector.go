@@ -0,0 +1,228 @@
+package faultinjectors
+
+import (
+	"context"
+	"math/rand/v2"
+	"path"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type MessageMutationInjectorOptions struct {
+	// Out, if set, only mutates messages going in one direction: true for messages the client sends, false for
+	// messages the client receives. If nil, messages going in both directions are mutated.
+	Out *bool
+
+	// Address, if set, only mutates messages on links with an address that matches this glob (see [path.Match]).
+	// If it's empty, messages on all links are mutated, apart from $cbs and $management links.
+	Address string
+
+	// SetApplicationProperties are added to the message's application properties, replacing any existing values.
+	SetApplicationProperties map[string]any
+
+	// RemoveApplicationProperties are removed from the message's application properties.
+	RemoveApplicationProperties []string
+
+	// MessageID, if set, replaces the message's message-id.
+	MessageID any
+
+	// ContentType, if set, replaces the message's content-type.
+	ContentType *string
+
+	// TruncateData, if set, truncates the message's data sections so there's at most this many bytes, in total.
+	TruncateData *int
+
+	// BumpDeliveryCount is added to the delivery-count in the message's header.
+	BumpDeliveryCount uint32
+
+	// FlipBytes is the number of randomly chosen bytes to flip, in the encoded message. This happens after all
+	// the other mutations, and usually makes the message impossible to decode.
+	FlipBytes int
+
+	// Seed seeds the random number generator used for FlipBytes, so the same bytes are flipped each run. If it's
+	// zero, a random seed is used.
+	Seed uint64
+}
+
+// NewMessageMutationInjector creates an injector that decodes messages from TRANSFER frames, mutates them, and
+// re-encodes them.
+//
+// Messages that are split across multiple TRANSFER frames are held until the last frame arrives. The mutated
+// message is re-split, to fit the receiving peer's max frame size, using the same number of frames if it can. If it
+// needs more, the transfer-ids in the session's FLOW frames are adjusted to match.
+func NewMessageMutationInjector(options MessageMutationInjectorOptions) *MessageMutationInjector {
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	if options.TruncateData != nil && *options.TruncateData < 0 {
+		utils.Panicf("TruncateData cannot be negative")
+	}
+
+	if options.FlipBytes < 0 {
+		utils.Panicf("FlipBytes cannot be negative")
+	}
+
+	seed := options.Seed
+
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	return &MessageMutationInjector{
+		options:     options,
+		assembler:   newTransferAssembler(),
+		transferIDs: newTransferIDShifter(),
+		rnd:         rand.New(rand.NewPCG(seed, seed)),
+	}
+}
+
+type MessageMutationInjector struct {
+	options     MessageMutationInjectorOptions
+	assembler   *transferAssembler
+	transferIDs *transferIDShifter
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+}
+
+func (inj *MessageMutationInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if inj.transferIDs.Intercept(params) {
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "adjusted for mutated messages"}}, nil
+	}
+
+	transferBody, isTransfer := params.Frame.Body.(*frames.PerformTransfer)
+
+	if !isTransfer || (inj.options.Out != nil && *inj.options.Out != params.Out) || !deliveryAddressMatches(inj.options.Address, params) {
+		return passthrough(params), nil
+	}
+
+	// a delivery we've started holding is finished off, even if its later frames are filtered out.
+	if !triggersAllowed && !inj.assembler.Holding(params, transferBody) {
+		return passthrough(params), nil
+	}
+
+	delivery := inj.assembler.Add(params, transferBody)
+
+	if delivery == nil {
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "holding until the rest of the message arrives"}}, nil
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	if transferBody.Aborted {
+		return passthroughDelivery(delivery), nil
+	}
+
+	msg := &models.Message{}
+
+	if err := msg.UnmarshalBinary(transferPayload(delivery)); err != nil {
+		logger.Warn("Not mutating message, failed to unmarshal it", "address", params.Address(), "error", err)
+		return passthroughDelivery(delivery), nil
+	}
+
+	inj.mutate(msg)
+
+	payload, err := msg.MarshalBinary()
+
+	if err != nil {
+		return nil, err
+	}
+
+	inj.flipBytes(payload)
+
+	mutated, err := splitTransfer(delivery[0], payload, len(delivery), maxFrameSize(params))
+
+	if err != nil {
+		return nil, err
+	}
+
+	logger.Info("Mutated message", "address", params.Address(), "frames", len(delivery), "newFrames", len(mutated))
+	inj.transferIDs.Sent(params, len(delivery), len(mutated))
+
+	var metaFrames []MetaFrame
+
+	for _, fr := range mutated {
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: fr, Description: "mutated message"})
+	}
+
+	return metaFrames, nil
+}
+
+func (inj *MessageMutationInjector) mutate(msg *models.Message) {
+	if len(inj.options.SetApplicationProperties) > 0 || len(inj.options.RemoveApplicationProperties) > 0 {
+		if msg.ApplicationProperties == nil {
+			msg.ApplicationProperties = map[string]any{}
+		}
+
+		for name, value := range inj.options.SetApplicationProperties {
+			msg.ApplicationProperties[name] = value
+		}
+
+		for _, name := range inj.options.RemoveApplicationProperties {
+			delete(msg.ApplicationProperties, name)
+		}
+	}
+
+	if inj.options.MessageID != nil || inj.options.ContentType != nil {
+		if msg.Properties == nil {
+			msg.Properties = &models.MessageProperties{}
+		}
+
+		if inj.options.MessageID != nil {
+			msg.Properties.MessageID = inj.options.MessageID
+		}
+
+		if inj.options.ContentType != nil {
+			msg.Properties.ContentType = inj.options.ContentType
+		}
+	}
+
+	if inj.options.TruncateData != nil {
+		remaining := *inj.options.TruncateData
+
+		for i, data := range msg.Data {
+			msg.Data[i] = data[:min(remaining, len(data))]
+			remaining -= len(msg.Data[i])
+		}
+	}
+
+	if inj.options.BumpDeliveryCount > 0 {
+		if msg.Header == nil {
+			msg.Header = &models.MessageHeader{}
+		}
+
+		msg.Header.DeliveryCount += inj.options.BumpDeliveryCount
+	}
+}
+
+func (inj *MessageMutationInjector) flipBytes(payload []byte) {
+	if len(payload) == 0 {
+		return
+	}
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	for range inj.options.FlipBytes {
+		// XOR'ing with a non-zero value always changes the byte.
+		payload[inj.rnd.IntN(len(payload))] ^= byte(1 + inj.rnd.IntN(255))
+	}
+}
+
+// passthroughDelivery sends all of a delivery's TRANSFER frames, unchanged.
+func passthroughDelivery(delivery []*frames.Frame) []MetaFrame {
+	var metaFrames []MetaFrame
+
+	for _, fr := range delivery {
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionPassthrough, Frame: fr})
+	}
+
+	return metaFrames
+}
@@ -0,0 +1,206 @@
+package faultinjectors
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageMutationInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewMessageMutationInjector(MessageMutationInjectorOptions{
+			Out:                         utils.Ptr(true),
+			Address:                     "queue",
+			SetApplicationProperties:    map[string]any{"added": "added value", "replaced": int64(2)},
+			RemoveApplicationProperties: []string{"removed"},
+			MessageID:                   "mutated message id",
+			ContentType:                 utils.Ptr("application/mutated"),
+			TruncateData:                utils.Ptr(100000),
+			BumpDeliveryCount:           2,
+		})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	// big enough that it's split across multiple TRANSFER frames.
+	body := strings.Repeat("0123456789", 20000)
+
+	err = sender.Send(context.Background(), &amqp.Message{
+		Data:                  [][]byte{[]byte(body)},
+		Properties:            &amqp.MessageProperties{MessageID: "message id"},
+		ApplicationProperties: map[string]any{"removed": "removed value", "replaced": int64(1), "kept": "kept value"},
+	}, nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	msg, err := receiver.Receive(context.Background(), nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+
+	require.Equal(t, body[:100000], string(msg.GetData()))
+	require.Equal(t, "mutated message id", msg.Properties.MessageID)
+	require.Equal(t, "application/mutated", *msg.Properties.ContentType)
+	require.Equal(t, uint32(2), msg.Header.DeliveryCount)
+	require.Equal(t, map[string]any{"added": "added value", "replaced": int64(2), "kept": "kept value"}, msg.ApplicationProperties)
+}
+
+func TestMessageMutationInjector_Resplit(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		// the new property doesn't fit in the message's original frames, so it has to be re-split.
+		injector := NewMessageMutationInjector(MessageMutationInjectorOptions{
+			Out:                      utils.Ptr(false),
+			SetApplicationProperties: map[string]any{"big": strings.Repeat("a", 5000)},
+		})
+		return injector.Callback
+	}, nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	conn, err := amqp.Dial(ctx, "amqp://"+fi.ListenAddr(), &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous(), MaxFrameSize: 1024})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = conn.Close() })
+
+	session, err := conn.NewSession(ctx, nil)
+	require.NoError(t, err)
+
+	sender, err := session.NewSender(ctx, "queue", nil)
+	require.NoError(t, err)
+
+	body := strings.Repeat("0123456789", 200)
+	require.NoError(t, sender.Send(ctx, amqp.NewMessage([]byte(body)), nil))
+
+	receiver, err := session.NewReceiver(ctx, "queue", nil)
+	require.NoError(t, err)
+
+	msg, err := receiver.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(ctx, msg))
+
+	require.Equal(t, body, string(msg.GetData()))
+	require.Equal(t, strings.Repeat("a", 5000), msg.ApplicationProperties["big"])
+
+	// and the session's still usable, afterwards.
+	require.NoError(t, sender.Send(ctx, amqp.NewMessage([]byte("hello")), nil))
+
+	msg, err = receiver.Receive(ctx, nil)
+	require.NoError(t, err)
+	require.NoError(t, receiver.AcceptMessage(ctx, msg))
+	require.Equal(t, "hello", string(msg.GetData()))
+}
+
+func TestMessageMutationInjector_FlipBytes(t *testing.T) {
+	flip := func() []byte {
+		injector := NewMessageMutationInjector(MessageMutationInjectorOptions{FlipBytes: 3, Seed: 42})
+		payload := []byte("hello world")
+		injector.flipBytes(payload)
+		return payload
+	}
+
+	flipped := flip()
+	require.NotEqual(t, []byte("hello world"), flipped)
+
+	// the same seed flips the same bytes.
+	require.Equal(t, flipped, flip())
+}
+
+func TestSplitTransfer(t *testing.T) {
+	first := &frames.Frame{
+		Header: frames.Header{FrameType: 0, Channel: 1},
+		Body:   &frames.PerformTransfer{Handle: 2, DeliveryID: utils.Ptr(uint32(3)), DeliveryTag: []byte("tag"), Settled: true},
+	}
+
+	payload := []byte(strings.Repeat("0123456789", 100))
+
+	delivery, err := splitTransfer(first, payload, 1, 256)
+	require.NoError(t, err)
+	require.Greater(t, len(delivery), 4)
+
+	for i, fr := range delivery {
+		body := fr.Body.(*frames.PerformTransfer)
+
+		raw, err := fr.MarshalAMQP()
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(raw), 256)
+
+		require.Equal(t, uint16(1), fr.Header.Channel)
+		require.Equal(t, uint32(2), body.Handle)
+		require.True(t, body.Settled)
+		require.Equal(t, i < len(delivery)-1, body.More)
+
+		if i == 0 {
+			require.Equal(t, []byte("tag"), body.DeliveryTag)
+		} else {
+			require.Nil(t, body.DeliveryID)
+		}
+	}
+
+	require.Equal(t, payload, transferPayload(delivery))
+
+	// if it fits, the delivery keeps the number of frames it asks for.
+	delivery, err = splitTransfer(first, []byte("hello"), 3, 256)
+	require.NoError(t, err)
+	require.Equal(t, 3, len(delivery))
+	require.Equal(t, []byte("hello"), transferPayload(delivery))
+
+	_, err = splitTransfer(first, payload, 1, 10)
+	require.Error(t, err)
+}
+
+func TestTransferIDShifter(t *testing.T) {
+	sm := proto.NewStateMap()
+	sm.AddFrame(false, &frames.Frame{Header: frames.Header{Channel: 2}, Body: &frames.PerformBegin{RemoteChannel: utils.Ptr(uint16(1))}})
+
+	shifter := newTransferIDShifter()
+
+	flow := func(out bool, nextIncomingID uint32, nextOutgoingID uint32) (*frames.PerformFlow, bool) {
+		channel := uint16(2)
+
+		if out {
+			channel = 1
+		}
+
+		body := &frames.PerformFlow{NextIncomingID: utils.Ptr(nextIncomingID), NextOutgoingID: nextOutgoingID}
+		modified := shifter.Intercept(MirrorCallbackParams{Out: out, StateMap: sm, Frame: &frames.Frame{Header: frames.Header{Channel: channel}, Body: body}})
+		return body, modified
+	}
+
+	_, modified := flow(true, 100, 200)
+	require.False(t, modified)
+
+	// the client's delivery was split into 3 frames, and the service's was merged into 1.
+	shifter.Sent(MirrorCallbackParams{Out: true, StateMap: sm, Frame: &frames.Frame{Header: frames.Header{Channel: 1}, Body: &frames.PerformTransfer{}}}, 1, 3)
+	shifter.Sent(MirrorCallbackParams{Out: false, StateMap: sm, Frame: &frames.Frame{Header: frames.Header{Channel: 2}, Body: &frames.PerformTransfer{}}}, 2, 1)
+
+	body, modified := flow(true, 100, 200)
+	require.True(t, modified)
+	require.Equal(t, uint32(101), *body.NextIncomingID)
+	require.Equal(t, uint32(202), body.NextOutgoingID)
+
+	body, modified = flow(false, 300, 400)
+	require.True(t, modified)
+	require.Equal(t, uint32(298), *body.NextIncomingID)
+	require.Equal(t, uint32(399), body.NextOutgoingID)
+
+	// once the client ends the session, it's forgotten.
+	shifter.Intercept(MirrorCallbackParams{Out: true, StateMap: sm, Frame: &frames.Frame{Header: frames.Header{Channel: 1}, Body: &frames.PerformEnd{}}})
+	require.Empty(t, shifter.shifts)
+}
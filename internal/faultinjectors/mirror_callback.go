@@ -13,6 +13,7 @@ import (
 // MirrorCallback's take a frame and decide what to send afterwards.
 // - To stop mirroring immediately, return (nil, io.EOF)
 // - To stop mirroring but send some last packets, return (<metaframes>, io.EOF)
+// - To terminate the connections, without an AMQP CLOSE, return a [MetaFrameActionDisconnect]
 // - Otherwise, return <metaframes>, nil
 //
 // NOTE, for actual mirroring, see [Mirror].
@@ -101,3 +102,9 @@ func (mcp *MirrorCallbackParams) ManagementOrCBS() bool {
 	return strings.HasSuffix(attachFrame.Body.Address(mcp.Out), ManagementEntityPathSuffix) ||
 		attachFrame.Body.Address(mcp.Out) == CBSEntityPath
 }
+
+// CBS returns true if the link is connected to the $cbs endpoint, false if the frame isn't a link
+// frame (ie, BEGIN) or otherwise.
+func (mcp *MirrorCallbackParams) CBS() bool {
+	return mcp.Address() == CBSEntityPath
+}
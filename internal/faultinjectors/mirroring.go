@@ -7,6 +7,7 @@ import (
 	"io"
 	"log/slog"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
@@ -14,16 +15,36 @@ import (
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
 )
 
+// ErrDisconnect is returned by [Mirror] when a [MetaFrameActionDisconnect] has terminated the connections.
+var ErrDisconnect = errors.New("disconnected by the fault injector")
+
 type MirrorParams struct {
 	Callback    MirrorCallback
 	FrameLogger *logging.FrameLogger
 
 	Local  *frames.ConnReadWriter
 	Remote *frames.ConnReadWriter
+
+	// StateMap, if set, is used to track the connection's state, instead of a new [proto.StateMap]. This lets
+	// state carry over from one [Mirror] to the next, for the same connection.
+	StateMap *proto.StateMap
+
+	// Shaping, if set, limits the bandwidth, and adds latency, to the frames the mirror sends.
+	// See [ShapingOptions].
+	Shaping *ShapingOptions
 }
 
 // Mirror mirrors frames, bidirectionally, between local <-> remote.
 // See [MirrorCallback] for the expected contract, including how to terminate mirroring.
+//
+// Ordering: in each direction, the frames a callback returns, without a [MetaFrame.Delay], are sent in the order
+// they're returned, before the next frame is read. They're sent as a batch - delayed frames, and frames injected
+// using the control API, are never sent in the middle of them. So an injector can reorder frames by holding on to
+// them, and returning them (in a different order) from a later callback. See [CanReorder] for the frames that
+// are safe to hold.
+//
+// Shaped frames (see [MirrorParams.Shaping]) are queued, after the callback returns them, and keep their order
+// within each shaping queue.
 func Mirror(ctx context.Context, params MirrorParams) error {
 	m := newMirror(params)
 	return m.Serve(ctx)
@@ -34,20 +55,53 @@ type mirror struct {
 	frameLogger   *logging.FrameLogger
 	sm            *proto.StateMap
 	callback      MirrorCallback
+
+	// disconnected is set once a [MetaFrameActionDisconnect] has been processed. From then on,
+	// nothing is mirrored.
+	disconnected atomic.Bool
+
+	// batchMus are held while sending a batch of frames for a direction (0 is inbound, 1 is outbound),
+	// so frames sent from elsewhere (delayed, or injected) can't end up in the middle of the batch.
+	batchMus [2]sync.Mutex
+
+	// shaper, if set, queues frames so they're sent with the configured bandwidth and latency.
+	shaper *shaper
 }
 
 func newMirror(params MirrorParams) *mirror {
-	return &mirror{
+	sm := params.StateMap
+
+	if sm == nil {
+		sm = proto.NewStateMap()
+	}
+
+	m := &mirror{
 		callback:    params.Callback,
 		frameLogger: params.FrameLogger,
 		local:       params.Local,
 		remote:      params.Remote,
-		sm:          proto.NewStateMap(),
+		sm:          sm,
 	}
+
+	if params.Shaping != nil {
+		m.shaper = newShaper(*params.Shaping, func(out bool, metaFrame *MetaFrame) error {
+			batchMu := m.batchMu(out)
+			batchMu.Lock()
+			defer batchMu.Unlock()
+
+			return m.processMetaFrame(out, metaFrame)
+		})
+	}
+
+	return m
 }
 
 // Serve starts the bidirectional mirroring between source <-> dest.
 func (m *mirror) Serve(ctx context.Context) error {
+	if m.shaper != nil {
+		defer m.shaper.Close()
+	}
+
 	wg := sync.WaitGroup{}
 
 	var localErr, remoteErr error
@@ -57,6 +111,11 @@ func (m *mirror) Serve(ctx context.Context) error {
 		defer wg.Done()
 		localErr = m.uniMirror(ctx, true)
 		slog.Info("Done mirroring local -> remote", "error", localErr)
+
+		// if we've disconnected, each connection has already been terminated the way the callback asked.
+		if localErr != nil && !m.disconnected.Load() {
+			m.closeConns()
+		}
 	}()
 
 	wg.Add(1)
@@ -64,10 +123,19 @@ func (m *mirror) Serve(ctx context.Context) error {
 		defer wg.Done()
 		remoteErr = m.uniMirror(ctx, false)
 		slog.Info("Done mirroring remote -> local", "error", remoteErr)
+
+		// if we've disconnected, each connection has already been terminated the way the callback asked.
+		if remoteErr != nil && !m.disconnected.Load() {
+			m.closeConns()
+		}
 	}()
 
 	wg.Wait()
 
+	if m.disconnected.Load() {
+		return ErrDisconnect
+	}
+
 	if localErr != nil {
 		return localErr
 	}
@@ -79,9 +147,24 @@ func (m *mirror) Serve(ctx context.Context) error {
 	return nil
 }
 
+// closeConns closes both connections. Once one direction has failed the connection is unusable, and
+// the other direction would otherwise be blocked, waiting on a read.
+func (m *mirror) closeConns() {
+	_ = m.local.Close()
+	_ = m.remote.Close()
+}
+
 // processMetaFrame takes cares of logging and sending the frame to the appropriate destination.
 func (m *mirror) processMetaFrame(out bool, metaFrame *MetaFrame) error {
-	if m.frameLogger != nil {
+	if m.disconnected.Load() {
+		// the connections are gone, or should appear to be.
+		return nil
+	}
+
+	// unchanged protocol headers are constant, so there's no point logging them.
+	isUnchangedHeader := metaFrame.Action == MetaFrameActionPassthrough && metaFrame.Frame != nil && metaFrame.Frame.Body.Type() == frames.BodyTypeProtocolHeader
+
+	if m.frameLogger != nil && metaFrame.Frame != nil && !isUnchangedHeader {
 		// TODO: make this better too - I just want to log all the metadata attributes, apart
 		// from the frame itself.
 		md := *metaFrame
@@ -96,6 +179,8 @@ func (m *mirror) processMetaFrame(out bool, metaFrame *MetaFrame) error {
 	case MetaFrameActionDropped:
 		// logged only, does not get sent.
 		return nil
+	case MetaFrameActionDisconnect:
+		return m.disconnect(metaFrame.Disconnect)
 	case MetaFrameActionPassthrough:
 		m.sm.AddFrame(out, metaFrame.Frame)
 
@@ -139,14 +224,47 @@ func (m *mirror) processMetaFrame(out bool, metaFrame *MetaFrame) error {
 	return nil
 }
 
+// disconnect terminates the local and remote connections, without an AMQP CLOSE.
+func (m *mirror) disconnect(disconnect *Disconnect) error {
+	if disconnect == nil {
+		return errors.New("MetaFrame.Disconnect must be set for a MetaFrameActionDisconnect")
+	}
+
+	if !m.disconnected.CompareAndSwap(false, true) {
+		return nil
+	}
+
+	slog.Info("Disconnecting", "local", disconnect.Local, "remote", disconnect.Remote)
+
+	return errors.Join(
+		terminateConn(m.local, disconnect.Local),
+		terminateConn(m.remote, disconnect.Remote),
+	)
+}
+
+func terminateConn(conn *frames.ConnReadWriter, mode DisconnectMode) error {
+	switch mode {
+	case DisconnectModeNone:
+		return nil
+	case DisconnectModeClose:
+		return conn.Close()
+	case DisconnectModeReset:
+		return conn.Reset()
+	case DisconnectModeHalfClose:
+		return conn.CloseWrite()
+	default:
+		return fmt.Errorf("unknown DisconnectMode %q", mode)
+	}
+}
+
 // uniMirror mirrors from one connection to another, in a single direction.
 func (m *mirror) uniMirror(ctx context.Context, out bool) error {
 	ctx, _ = logging.ContextWithSloggerAndValues(ctx, "out", out)
 
-	source, dest := m.remote, m.local
+	source := m.remote
 
 	if out {
-		source, dest = m.local, m.remote
+		source = m.local
 	}
 
 	for item, err := range source.Iter() {
@@ -154,14 +272,19 @@ func (m *mirror) uniMirror(ctx context.Context, out bool) error {
 			return fmt.Errorf("failed to read next item in mirroring loop: %w", err)
 		}
 
+		if m.disconnected.Load() {
+			// discard anything that's still being sent to us.
+			continue
+		}
+
 		fr, isFrame := item.(*frames.Frame)
 
-		if !isFrame { // ie, an AMQP preamble
-			if err := dest.Write(item); err != nil { // just write it, no mirror-er cares to inspect it.
-				return fmt.Errorf("failed to write preamble in mirroring loop: %w", err)
-			}
+		if !isFrame { // ie, an AMQP preamble, which callbacks get as a pseudo-frame.
+			fr, err = frames.NewProtocolHeaderFrame(item.(frames.Preamble))
 
-			continue
+			if err != nil {
+				return fmt.Errorf("failed to parse preamble in mirroring loop: %w", err)
+			}
 		}
 
 		metaFrames, err := m.callback(ctx, MirrorCallbackParams{
@@ -179,14 +302,39 @@ func (m *mirror) uniMirror(ctx context.Context, out bool) error {
 		if stop {
 			return nil
 		}
+
+		if m.shaper != nil {
+			m.shaper.Wait(ctx, out)
+		}
 	}
 
 	return nil
 }
 
+// inject sends metaFrames, as if a callback had returned them for a frame going in the out direction. It's
+// used to send frames that aren't a reply to any particular frame, like one-shot faults from the control API.
+func (m *mirror) inject(out bool, metaFrames []MetaFrame) error {
+	_, err := m.handleCallbackResult(out, metaFrames, nil)
+	return err
+}
+
+// batchMu is the mutex that's held while sending a batch of frames, returned by a callback for a frame going
+// in the out direction.
+func (m *mirror) batchMu(out bool) *sync.Mutex {
+	if out {
+		return &m.batchMus[1]
+	}
+
+	return &m.batchMus[0]
+}
+
 func (m *mirror) handleCallbackResult(out bool, metaFrames []MetaFrame, err error) (bool, error) {
 	stop := false
 
+	batchMu := m.batchMu(out)
+	batchMu.Lock()
+	defer batchMu.Unlock()
+
 	switch {
 	case errors.Is(err, io.EOF):
 		slog.Debug("callback has returned io.EOF")
@@ -200,12 +348,15 @@ func (m *mirror) handleCallbackResult(out bool, metaFrames []MetaFrame, err erro
 
 	for _, metaFrame := range metaFrames {
 		if metaFrame.Delay == 0 {
-			if err := m.processMetaFrame(out, &metaFrame); err != nil {
+			if err := m.shapeOrProcessMetaFrame(out, &metaFrame); err != nil {
 				return false, fmt.Errorf("failed to processMetaFrame: %w", err)
 			}
 		} else {
 			time.AfterFunc(metaFrame.Delay, func() {
-				if err := m.processMetaFrame(out, &metaFrame); err != nil {
+				batchMu.Lock()
+				defer batchMu.Unlock()
+
+				if err := m.shapeOrProcessMetaFrame(out, &metaFrame); err != nil {
 					slog.Error("failed to processMetaFrame", "error", err)
 				}
 			})
@@ -214,3 +365,27 @@ func (m *mirror) handleCallbackResult(out bool, metaFrames []MetaFrame, err erro
 
 	return stop, nil
 }
+
+// shapeOrProcessMetaFrame queues the frame, if it's shaped, or sends it immediately if it isn't.
+func (m *mirror) shapeOrProcessMetaFrame(out bool, metaFrame *MetaFrame) error {
+	if m.shaper != nil && m.shaper.Queue(out, metaFrame) {
+		return nil
+	}
+
+	return m.processMetaFrame(out, metaFrame)
+}
+
+// CanReorder is true for frames that are safe for an injector to hold on to, and send later, after frames that
+// arrived after them (see [Mirror] for the ordering guarantees).
+//
+// Protocol headers, OPEN and CLOSE frames start and end the connection, so everything else has to come between
+// them, and empty (keep-alive) frames are only useful if they're sent when they arrive, so none of those can be
+// reordered.
+func CanReorder(fr *frames.Frame) bool {
+	switch fr.Body.Type() {
+	case frames.BodyTypeProtocolHeader, frames.BodyTypeOpen, frames.BodyTypeClose, frames.BodyTypeEmptyFrame:
+		return false
+	default:
+		return true
+	}
+}
@@ -148,6 +148,16 @@ func TestMirroring(t *testing.T) {
 	})
 }
 
+func TestCanReorder(t *testing.T) {
+	for _, body := range []frames.Body{&frames.PerformOpen{}, &frames.PerformClose{}, &frames.EmptyFrame{}} {
+		require.False(t, CanReorder(&frames.Frame{Body: body}), "%T", body)
+	}
+
+	for _, body := range []frames.Body{&frames.PerformBegin{}, &frames.PerformAttach{}, &frames.PerformFlow{}, &frames.PerformTransfer{}, &frames.PerformDisposition{}, &frames.PerformDetach{}, &frames.PerformEnd{}} {
+		require.True(t, CanReorder(&frames.Frame{Body: body}), "%T", body)
+	}
+}
+
 func TestMirrorParams_Address_AlreadyAnAttachFrame(t *testing.T) {
 	td := []struct {
 		Out             bool
@@ -0,0 +1,101 @@
+package faultinjectors
+
+import (
+	"context"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// ProtocolHeaderMode is what a [ProtocolHeaderInjector] does with the service's protocol header.
+type ProtocolHeaderMode string
+
+const (
+	// ProtocolHeaderModeReplace sends [ProtocolHeaderInjectorOptions.Header] instead (ex: a different
+	// protocol id, or version).
+	ProtocolHeaderModeReplace = ProtocolHeaderMode("replace")
+
+	// ProtocolHeaderModeGarbage sends [ProtocolHeaderInjectorOptions.Garbage] instead.
+	ProtocolHeaderModeGarbage = ProtocolHeaderMode("garbage")
+
+	// ProtocolHeaderModeClose closes the connections, without sending anything.
+	ProtocolHeaderModeClose = ProtocolHeaderMode("close")
+)
+
+type ProtocolHeaderInjectorOptions struct {
+	// Mode is what to do with the service's protocol header.
+	Mode ProtocolHeaderMode
+
+	// Protocol, if set, only changes the service's protocol header for this protocol. For instance,
+	// [frames.ProtocolIDSASL] leaves the AMQP protocol header, that's sent after SASL, alone.
+	Protocol *frames.ProtocolID
+
+	// Header is the protocol header to send, for [ProtocolHeaderModeReplace].
+	Header frames.ProtocolHeader
+
+	// Garbage are the bytes to send, for [ProtocolHeaderModeGarbage].
+	Garbage []byte
+}
+
+// NewProtocolHeaderInjector creates an injector that replaces the protocol header (preamble) the service sends
+// back to the client, or closes the connection instead. Useful for checking that clients handle protocol
+// negotiation failures.
+//
+// Protocol headers are exchanged before the OPEN frames, so use this with [FaultInjectorOptions.HandshakeFactory].
+func NewProtocolHeaderInjector(options ProtocolHeaderInjectorOptions) *ProtocolHeaderInjector {
+	switch options.Mode {
+	case ProtocolHeaderModeReplace, ProtocolHeaderModeClose:
+	case ProtocolHeaderModeGarbage:
+		if len(options.Garbage) == 0 {
+			utils.Panicf("Garbage must be set, for ProtocolHeaderModeGarbage")
+		}
+	default:
+		utils.Panicf("invalid Mode %q", options.Mode)
+	}
+
+	return &ProtocolHeaderInjector{options: options}
+}
+
+type ProtocolHeaderInjector struct {
+	options ProtocolHeaderInjectorOptions
+}
+
+func (inj *ProtocolHeaderInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	header, isHeader := params.Frame.Body.(*frames.ProtocolHeader)
+
+	if !isHeader || params.Out || (inj.options.Protocol != nil && *inj.options.Protocol != header.ProtocolID) {
+		return passthrough(params), nil
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	switch inj.options.Mode {
+	case ProtocolHeaderModeReplace:
+		logger.Info("Replacing protocol header", "header", header.String(), "newHeader", inj.options.Header.String())
+
+		newHeader := inj.options.Header
+
+		return []MetaFrame{{
+			Action:      MetaFrameActionModified,
+			Frame:       &frames.Frame{Header: params.Frame.Header, Body: &newHeader},
+			Description: "replacing protocol header",
+		}}, nil
+	case ProtocolHeaderModeGarbage:
+		logger.Info("Replacing protocol header with garbage", "header", header.String(), "garbage", inj.options.Garbage)
+
+		return []MetaFrame{
+			{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "replaced with garbage"},
+			{Action: MetaFrameActionAdded, Frame: frames.NewRawFrame(inj.options.Garbage), Description: "garbage protocol header"},
+		}, nil
+	default:
+		logger.Info("Closing connection, instead of sending the protocol header", "header", header.String())
+
+		return []MetaFrame{{
+			Action:      MetaFrameActionDisconnect,
+			Frame:       params.Frame,
+			Disconnect:  &Disconnect{Local: DisconnectModeClose, Remote: DisconnectModeClose},
+			Description: "closed instead of sending the protocol header",
+		}}, nil
+	}
+}
@@ -0,0 +1,86 @@
+package faultinjectors
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProtocolHeaderInjector(t *testing.T) {
+	td := []struct {
+		Name     string
+		Options  ProtocolHeaderInjectorOptions
+		Expected string
+	}{
+		{
+			Name:     "different protocol id",
+			Options:  ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeReplace, Header: frames.ProtocolHeader{ProtocolID: frames.ProtocolIDAMQP, Major: 1}},
+			Expected: "unexpected protocol header 0x0, expected 0x3",
+		},
+		{
+			Name:     "different version",
+			Options:  ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeReplace, Header: frames.ProtocolHeader{ProtocolID: frames.ProtocolIDSASL, Major: 2}},
+			Expected: "unexpected protocol version 2.0.0",
+		},
+		{
+			Name:     "garbage",
+			Options:  ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeGarbage, Garbage: []byte("HTTP/1.1 400 Bad Request\r\n\r\n")},
+			Expected: `unexpected protocol "HTTP"`,
+		},
+		{
+			Name:     "after SASL",
+			Options:  ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeReplace, Protocol: utils.Ptr(frames.ProtocolIDAMQP), Header: frames.ProtocolHeader{ProtocolID: frames.ProtocolIDTLS, Major: 1}},
+			Expected: "unexpected protocol header 0x2, expected 0x0",
+		},
+		{
+			Name:     "close",
+			Options:  ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeClose},
+			Expected: "EOF",
+		},
+	}
+
+	for _, d := range td {
+		t.Run(d.Name, func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				return passthroughCallbackForTest
+			}, &FaultInjectorOptions{
+				HandshakeFactory: func(connInfo ConnInfo) MirrorCallback {
+					return NewProtocolHeaderInjector(d.Options).Callback
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			_, err := amqp.Dial(ctx, "amqp://"+fi.ListenAddr(), &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous()})
+			require.ErrorContains(t, err, d.Expected)
+		})
+	}
+}
+
+func TestProtocolHeaderInjector_Unchanged(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		HandshakeFactory: func(connInfo ConnInfo) MirrorCallback {
+			// there's no TLS header, since TLS is handled before the fault injector sees anything.
+			return NewProtocolHeaderInjector(ProtocolHeaderInjectorOptions{Mode: ProtocolHeaderModeClose, Protocol: utils.Ptr(frames.ProtocolIDTLS)}).Callback
+		},
+	})
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+}
@@ -0,0 +1,167 @@
+package faultinjectors
+
+import (
+	"context"
+	"path"
+	"sync/atomic"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// RedirectTarget is the endpoint that a redirect error points the client at. Unset fields are left out
+// of the error's info map.
+type RedirectTarget struct {
+	// Hostname is the DNS hostname of the endpoint, which the client uses for TLS (SNI) and in its OPEN frame.
+	Hostname string
+
+	// NetworkHost is the DNS hostname, or IP address, the client connects to.
+	NetworkHost string
+
+	// Port is the port the client connects to.
+	Port uint16
+
+	// Address is the address of the node the client should attach to. Only used by link redirects.
+	Address string
+}
+
+// redirectError creates a redirect error, with an info map that has the target's hostname, network-host, port and,
+// for link redirects, the address.
+func (target RedirectTarget) redirectError(cond encoding.ErrCond, description string) *encoding.Error {
+	info := map[string]any{}
+
+	if target.Hostname != "" {
+		info["hostname"] = target.Hostname
+	}
+
+	if target.NetworkHost != "" {
+		info["network-host"] = target.NetworkHost
+	}
+
+	if target.Port != 0 {
+		info["port"] = target.Port
+	}
+
+	if cond == proto.ErrCondLinkRedirect && target.Address != "" {
+		info["address"] = target.Address
+	}
+
+	return &encoding.Error{Condition: cond, Description: description, Info: info}
+}
+
+type LinkRedirectInjectorOptions struct {
+	// Target is the endpoint the links are redirected to.
+	Target RedirectTarget
+
+	// After is how long to wait, after the client has sent its ATTACH, before redirecting the link. Defaults to 0,
+	// which redirects the link as soon as it's attached.
+	After time.Duration
+
+	// Address, if set, only redirects links with an address that matches this glob (see [path.Match]). Otherwise
+	// every link is redirected.
+	Address string
+}
+
+// NewLinkRedirectInjector creates an injector that detaches links with an amqp:link:redirect error, pointing
+// the client at [LinkRedirectInjectorOptions.Target].
+//
+// The DETACH is sent to the service, as if the client sent it. When the service replies we add the redirect
+// error, so the client thinks the service redirected the link.
+func NewLinkRedirectInjector(options LinkRedirectInjectorOptions) *LinkRedirectInjector {
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &LinkRedirectInjector{
+		options:    options,
+		err:        options.Target.redirectError(proto.ErrCondLinkRedirect, "Link redirected by the fault injector"),
+		terminator: newTerminator(),
+	}
+}
+
+type LinkRedirectInjector struct {
+	options    LinkRedirectInjectorOptions
+	err        *encoding.Error
+	terminator *terminator
+}
+
+func (inj *LinkRedirectInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	attachBody, isAttach := params.Frame.Body.(*frames.PerformAttach)
+
+	if !params.Out || !isAttach || !globMatches(inj.options.Address, attachBody.Address(true)) {
+		return passthrough(params), nil
+	}
+
+	logging.SloggerFromContext(ctx).Info("Redirecting link", "address", attachBody.Address(true), "delay", inj.options.After, "info", inj.err.Info)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+		inj.terminator.Detach(params.Channel(), attachBody.Handle, inj.err, inj.options.After),
+	}, nil
+}
+
+type ConnectionRedirectInjectorOptions struct {
+	// Target is the endpoint the connection is redirected to. Its Address isn't used.
+	Target RedirectTarget
+
+	// After is how long to wait, after the connection's opened, before redirecting it. Defaults to 0, which
+	// redirects the connection as soon as it's open.
+	After time.Duration
+}
+
+// NewConnectionRedirectInjector creates an injector that closes the connection with an amqp:connection:redirect
+// error, pointing the client at [ConnectionRedirectInjectorOptions.Target].
+//
+// The connection is closed the same way as [NewCloseAfterDelayInjector].
+func NewConnectionRedirectInjector(options ConnectionRedirectInjectorOptions) *ConnectionRedirectInjector {
+	return &ConnectionRedirectInjector{
+		options:    options,
+		err:        options.Target.redirectError(proto.ErrCondConnectionRedirect, "Connection redirected by the fault injector"),
+		terminator: newTerminator(),
+	}
+}
+
+type ConnectionRedirectInjector struct {
+	options    ConnectionRedirectInjectorOptions
+	err        *encoding.Error
+	closing    atomic.Bool
+	terminator *terminator
+}
+
+func (inj *ConnectionRedirectInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	// we only close once, and the delay starts from the service's OPEN.
+	if !inj.closing.CompareAndSwap(false, true) {
+		return passthrough(params), nil
+	}
+
+	logging.SloggerFromContext(ctx).Info("Redirecting connection", "delay", inj.options.After, "info", inj.err.Info)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionPassthrough, Frame: params.Frame},
+		inj.terminator.Close(inj.err, inj.options.After),
+	}, nil
+}
@@ -0,0 +1,109 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLinkRedirectInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	redirectBroker := testhelpers.NewBrokerForTest(t, nil)
+
+	target := redirectTargetForTest(t, redirectBroker.ListenAddr())
+	target.Address = "redirected-queue"
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewLinkRedirectInjector(LinkRedirectInjectorOptions{Target: target, Address: "moved-*"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	movedSender, err := session.NewSender(context.Background(), "moved-queue", nil)
+	require.NoError(t, err)
+
+	var linkErr *amqp.LinkError
+
+	require.Eventually(t, func() bool {
+		err := movedSender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		return errors.As(err, &linkErr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, &amqp.Error{
+		Condition:   amqp.ErrCondLinkRedirect,
+		Description: "Link redirected by the fault injector",
+		Info: map[string]any{
+			"hostname":     target.Hostname,
+			"network-host": target.NetworkHost,
+			"port":         target.Port,
+			"address":      "redirected-queue",
+		},
+	}, linkErr.RemoteErr)
+
+	// links that aren't redirected are fine.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	// follow the redirect, to the other broker.
+	info := linkErr.RemoteErr.Info
+	redirectedSession := newSessionForTest(t, net.JoinHostPort(info["network-host"].(string), fmt.Sprint(info["port"])))
+
+	redirectedSender, err := redirectedSession.NewSender(context.Background(), info["address"].(string), nil)
+	require.NoError(t, err)
+
+	err = redirectedSender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	messages, err := redirectBroker.Messages("redirected-queue")
+	require.NoError(t, err)
+	require.Len(t, messages, 1)
+}
+
+func TestConnectionRedirectInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	redirectBroker := testhelpers.NewBrokerForTest(t, nil)
+
+	target := redirectTargetForTest(t, redirectBroker.ListenAddr())
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewConnectionRedirectInjector(ConnectionRedirectInjectorOptions{Target: target, After: 500 * time.Millisecond})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	requireConnClosedForTest(t, sender, &amqp.Error{
+		Condition:   amqp.ErrCondConnectionRedirect,
+		Description: "Connection redirected by the fault injector",
+		Info: map[string]any{
+			"hostname":     target.Hostname,
+			"network-host": target.NetworkHost,
+			"port":         target.Port,
+		},
+	})
+}
+
+func redirectTargetForTest(t *testing.T, addr string) RedirectTarget {
+	host, portStr, err := net.SplitHostPort(addr)
+	require.NoError(t, err)
+
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	require.NoError(t, err)
+
+	return RedirectTarget{Hostname: "localhost", NetworkHost: host, Port: uint16(port)}
+}
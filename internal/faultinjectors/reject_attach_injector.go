@@ -0,0 +1,183 @@
+package faultinjectors
+
+import (
+	"context"
+	"math"
+	"path"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type RejectAttachInjectorOptions struct {
+	// Address, if set, only rejects links with an address that matches this glob (see [path.Match]). Otherwise
+	// every link is rejected.
+	Address string
+
+	// Error is the error that the client sees, in the DETACH frame. Defaults to amqp:not-found.
+	Error *encoding.Error
+}
+
+// NewRejectAttachInjector creates an injector that rejects the client's links, without involving the service.
+//
+// The client's ATTACH is never sent to the service. Instead, we reply with an ATTACH that has no source or target,
+// followed by a DETACH with an error, which is how a service refuses a link (ex: amqp:not-found, or
+// amqp:unauthorized-access). The client's DETACH reply is absorbed.
+func NewRejectAttachInjector(options RejectAttachInjectorOptions) *RejectAttachInjector {
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	if options.Error == nil {
+		options.Error = &encoding.Error{
+			Condition:   proto.ErrCondNotFound,
+			Description: "link rejected by the fault injector",
+		}
+	}
+
+	return &RejectAttachInjector{
+		options:   options,
+		handleMax: map[uint16]uint32{},
+		rejected:  map[linkID]uint32{},
+	}
+}
+
+type RejectAttachInjector struct {
+	options RejectAttachInjectorOptions
+
+	mu sync.Mutex
+
+	// handleMax is the client's handle-max, keyed by the client's channel.
+	handleMax map[uint16]uint32
+
+	// rejected are the links we've rejected, keyed by the client's channel and handle, until the
+	// client's replied with its DETACH. The value is the handle we used, for the service's end of the link.
+	rejected map[linkID]uint32
+}
+
+func (inj *RejectAttachInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if !params.Out {
+		return passthrough(params), nil
+	}
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformBegin:
+		inj.handleMax[params.Channel()] = body.HandleMax
+	case *frames.PerformAttach:
+		if triggersAllowed && globMatches(inj.options.Address, body.Address(true)) {
+			return inj.reject(ctx, params, body), nil
+		}
+	default:
+		if params.Handle() == nil {
+			break
+		}
+
+		id := linkID{params.Channel(), *params.Handle()}
+
+		if _, isRejected := inj.rejected[id]; !isRejected {
+			break
+		}
+
+		// the service doesn't know about this link, so nothing the client sends for it can be forwarded.
+		if _, isDetach := body.(*frames.PerformDetach); isDetach {
+			logging.SloggerFromContext(ctx).Info("Absorbing client's reply", "type", params.Type(), "channel", params.Channel())
+			delete(inj.rejected, id)
+		}
+
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "link was rejected"}}, nil
+	}
+
+	return passthrough(params), nil
+}
+
+func (inj *RejectAttachInjector) reject(ctx context.Context, params MirrorCallbackParams, attachBody *frames.PerformAttach) []MetaFrame {
+	// our replies go out on the service's channel for the session, which the client already knows from the
+	// service's BEGIN.
+	remoteChannel := params.StateMap.LookupCorrespondingChannel(true, params.Channel())
+
+	if remoteChannel == nil {
+		return passthrough(params)
+	}
+
+	handle, ok := inj.freeHandle(params, *remoteChannel)
+
+	if !ok {
+		logging.SloggerFromContext(ctx).Warn("Can't reject ATTACH, the client has no free handles", "address", attachBody.Address(true))
+		return passthrough(params)
+	}
+
+	inj.rejected[linkID{params.Channel(), attachBody.Handle}] = handle
+
+	// the ATTACH isn't forwarded, but we record it so our reply can be matched up with it.
+	params.StateMap.AddFrame(true, params.Frame)
+
+	logging.SloggerFromContext(ctx).Info("Rejecting ATTACH", "address", attachBody.Address(true), "name", attachBody.Name, "error", inj.options.Error)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "rejecting link"},
+		{
+			Action:      MetaFrameActionAdded,
+			OverrideOut: utils.Ptr(false),
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: *remoteChannel},
+				// no source or target means the link was refused.
+				Body: &frames.PerformAttach{Name: attachBody.Name, Handle: handle, Role: !attachBody.Role},
+			},
+			Description: "refusing link",
+		},
+		{
+			Action:      MetaFrameActionAdded,
+			OverrideOut: utils.Ptr(false),
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: *remoteChannel},
+				Body:   &frames.PerformDetach{Handle: handle, Closed: true, Error: inj.options.Error},
+			},
+			Description: "detaching refused link",
+		},
+	}
+}
+
+// freeHandle finds a handle for the service's end of a rejected link. The service never allocates one, so we
+// count down from the highest handle the client allows, which is the least likely to clash with the handles
+// the service allocates later, skipping the ones the client already has for the session's other links.
+func (inj *RejectAttachInjector) freeHandle(params MirrorCallbackParams, remoteChannel uint16) (uint32, bool) {
+	inUse := map[uint32]bool{}
+
+	for _, link := range params.StateMap.Links() {
+		if link.RemoteAttach != nil && link.RemoteAttach.Header.Channel == remoteChannel && !link.Detached {
+			inUse[link.RemoteAttach.Body.Handle] = true
+		}
+	}
+
+	// our DETACH has been sent, but the client's still using the handle until it replies.
+	for id, handle := range inj.rejected {
+		if id.Channel == params.Channel() {
+			inUse[handle] = true
+		}
+	}
+
+	handle, ok := inj.handleMax[params.Channel()]
+
+	if !ok {
+		handle = math.MaxUint32
+	}
+
+	for inUse[handle] {
+		if handle == 0 {
+			return 0, false
+		}
+
+		handle--
+	}
+
+	return handle, true
+}
@@ -0,0 +1,115 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRejectAttachInjector(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewRejectAttachInjector(RejectAttachInjectorOptions{Address: "missing-*"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	_, err := session.NewSender(context.Background(), "missing-queue", nil)
+	require.Equal(t, &amqp.Error{Condition: amqp.ErrCondNotFound, Description: "link rejected by the fault injector"}, err)
+
+	_, err = session.NewReceiver(context.Background(), "missing-queue", nil)
+	require.Equal(t, &amqp.Error{Condition: amqp.ErrCondNotFound, Description: "link rejected by the fault injector"}, err)
+
+	// the client's DETACH replies were absorbed, so the session's still fine, and the rejected links' handles
+	// can be reused.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	require.NoError(t, err)
+
+	msg, err := receiver.Receive(context.Background(), nil)
+	require.NoError(t, err)
+	require.Equal(t, []byte("hello world"), msg.GetData())
+}
+
+func TestRejectAttachInjector_Unauthorized(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	sm := make(chan *proto.StateMap, 1)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewRejectAttachInjector(RejectAttachInjectorOptions{
+			Error: &encoding.Error{Condition: proto.ErrCondUnauthorizedAccess, Description: "unauthorized"},
+		})
+
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			select {
+			case sm <- params.StateMap:
+			default:
+			}
+
+			return injector.Callback(ctx, params)
+		}
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+	require.Equal(t, &amqp.Error{Condition: amqp.ErrCondUnauthorizedAccess, Description: "unauthorized"}, err)
+
+	// the state map has the rejected link, matched up with our reply.
+	links := (<-sm).Links()
+	require.Len(t, links, 1)
+	require.Equal(t, "queue", links[0].LocalAttach.Body.Address(true))
+	require.NotNil(t, links[0].RemoteAttach)
+	require.Empty(t, links[0].RemoteAttach.Body.Address(false))
+	require.True(t, links[0].Detached)
+}
+
+func TestRejectAttachInjector_FreeHandles(t *testing.T) {
+	sm := proto.NewStateMap()
+	sm.AddFrame(false, &frames.Frame{Header: frames.Header{Channel: 2}, Body: &frames.PerformBegin{RemoteChannel: utils.Ptr(uint16(1))}})
+
+	injector := NewRejectAttachInjector(RejectAttachInjectorOptions{Address: "missing-*"})
+
+	send := func(body frames.Body) []MetaFrame {
+		metaFrames, err := injector.Callback(context.Background(), MirrorCallbackParams{
+			Out:      true,
+			Frame:    &frames.Frame{Header: frames.Header{Channel: 1}, Body: body},
+			StateMap: sm,
+		})
+		require.NoError(t, err)
+		return metaFrames
+	}
+
+	send(&frames.PerformBegin{HandleMax: 10})
+
+	// the service is already using handle 10, for a link the client attached.
+	sm.AddFrame(true, &frames.Frame{Header: frames.Header{Channel: 1}, Body: &frames.PerformAttach{Name: "link", Handle: 0, Role: encoding.RoleSender}})
+	sm.AddFrame(false, &frames.Frame{Header: frames.Header{Channel: 2}, Body: &frames.PerformAttach{Name: "link", Handle: 10, Role: encoding.RoleReceiver}})
+
+	var handles []uint32
+
+	// each rejected link gets its own handle, until the client's replied to our DETACH.
+	for i := range 2 {
+		metaFrames := send(&frames.PerformAttach{Name: fmt.Sprintf("missing-%d", i), Handle: uint32(i + 1), Role: encoding.RoleSender, Target: &frames.Target{Address: "missing-queue"}})
+		require.Len(t, metaFrames, 3)
+		handles = append(handles, metaFrames[1].Frame.Body.(*frames.PerformAttach).Handle)
+	}
+
+	require.Equal(t, []uint32{9, 8}, handles)
+}
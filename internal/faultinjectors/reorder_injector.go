@@ -0,0 +1,133 @@
+package faultinjectors
+
+import (
+	"context"
+	"math/rand/v2"
+	"slices"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// ReorderMode is how a [ReorderInjector] reorders a window of frames.
+type ReorderMode string
+
+const (
+	// ReorderModePermute sends the frames in a random order.
+	ReorderModePermute = ReorderMode("permute")
+
+	// ReorderModeReverse sends the frames in the reverse order.
+	ReorderModeReverse = ReorderMode("reverse")
+)
+
+type ReorderInjectorOptions struct {
+	// Window is the number of frames that are held, and then reordered. It must be at least 2.
+	Window int
+
+	// Mode is how each window of frames is reordered.
+	Mode ReorderMode
+
+	// Match, if set, only reorders frames it matches (ex: IsType(frames.BodyTypeFlow, frames.BodyTypeAttach)).
+	// Otherwise every frame that can be reordered is (see [CanReorder]).
+	Match Predicate
+
+	// Seed seeds the random number generator used for [ReorderModePermute], so frames are reordered the same way
+	// each run. If it's zero, a random seed is used.
+	Seed uint64
+}
+
+// NewReorderInjector creates an injector that holds on to a window of matching frames, for each direction, and
+// then sends them in a different order. Useful for hitting ordering bugs, like a DISPOSITION arriving before the
+// TRANSFER it settles has finished, or a FLOW arriving before the ATTACH for its link.
+//
+// Frames that aren't matched are sent as they arrive, which can also move them ahead of the frames being held. A
+// window is only sent once it's full, or when a CLOSE is sent in the same direction, so pick a Match, and Window,
+// that the peer will fill without waiting for a reply.
+func NewReorderInjector(options ReorderInjectorOptions) *ReorderInjector {
+	if options.Window < 2 {
+		utils.Panicf("Window must be at least 2")
+	}
+
+	switch options.Mode {
+	case ReorderModePermute, ReorderModeReverse:
+	default:
+		utils.Panicf("invalid Mode %q", options.Mode)
+	}
+
+	seed := options.Seed
+
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	return &ReorderInjector{
+		options: options,
+		rnd:     rand.New(rand.NewPCG(seed, seed)),
+		windows: map[bool][]*frames.Frame{},
+	}
+}
+
+type ReorderInjector struct {
+	options ReorderInjectorOptions
+
+	mu  sync.Mutex
+	rnd *rand.Rand
+
+	// windows are the frames being held, for each direction (keyed by Out).
+	windows map[bool][]*frames.Frame
+}
+
+func (inj *ReorderInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	if params.Type() == frames.BodyTypeClose {
+		// whatever we're holding has to go out before the connection's closed.
+		return append(inj.release(ctx, params.Out), MetaFrame{Action: MetaFrameActionPassthrough, Frame: params.Frame}), nil
+	}
+
+	if !triggersAllowed || !CanReorder(params.Frame) || (inj.options.Match != nil && !inj.options.Match(&params)) {
+		return passthrough(params), nil
+	}
+
+	inj.windows[params.Out] = append(inj.windows[params.Out], params.Frame)
+
+	if len(inj.windows[params.Out]) < inj.options.Window {
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "holding until the window is full"}}, nil
+	}
+
+	return inj.release(ctx, params.Out), nil
+}
+
+// release reorders, and sends, the frames being held for a direction.
+func (inj *ReorderInjector) release(ctx context.Context, out bool) []MetaFrame {
+	window := inj.windows[out]
+	delete(inj.windows, out)
+
+	if len(window) == 0 {
+		return nil
+	}
+
+	switch inj.options.Mode {
+	case ReorderModeReverse:
+		slices.Reverse(window)
+	default:
+		inj.rnd.Shuffle(len(window), func(i, j int) { window[i], window[j] = window[j], window[i] })
+	}
+
+	var types []frames.BodyType
+	var metaFrames []MetaFrame
+
+	for _, fr := range window {
+		types = append(types, fr.Body.Type())
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionPassthrough, Frame: fr, Description: "reordered"})
+	}
+
+	logging.SloggerFromContext(ctx).Info("Reordering frames", "mode", inj.options.Mode, "types", types)
+
+	return metaFrames
+}
@@ -0,0 +1,131 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReorderInjector(t *testing.T) {
+	transfer := func(deliveryID uint32) *frames.Frame {
+		return &frames.Frame{Body: &frames.PerformTransfer{DeliveryID: &deliveryID}}
+	}
+
+	deliveryIDs := func(metaFrames []MetaFrame) []uint32 {
+		var ids []uint32
+
+		for _, mf := range metaFrames {
+			require.Equal(t, MetaFrameActionPassthrough, mf.Action)
+			ids = append(ids, *mf.Frame.Body.(*frames.PerformTransfer).DeliveryID)
+		}
+
+		return ids
+	}
+
+	// sends frames, with delivery-ids from 0 to n-1, and returns the delivery-ids of the frames that were released.
+	send := func(t *testing.T, inj *ReorderInjector, out bool, n int) []uint32 {
+		var released []MetaFrame
+
+		for i := range n {
+			metaFrames, err := inj.Callback(context.Background(), MirrorCallbackParams{Out: out, Frame: transfer(uint32(i))})
+			require.NoError(t, err)
+
+			if len(metaFrames) == 1 && metaFrames[0].Action == MetaFrameActionDropped {
+				continue
+			}
+
+			released = append(released, metaFrames...)
+		}
+
+		return deliveryIDs(released)
+	}
+
+	t.Run("reverse", func(t *testing.T) {
+		inj := NewReorderInjector(ReorderInjectorOptions{Window: 3, Mode: ReorderModeReverse})
+		require.Equal(t, []uint32{2, 1, 0, 5, 4, 3}, send(t, inj, true, 7))
+
+		// the 7th frame is held until the connection's closed.
+		metaFrames, err := inj.Callback(context.Background(), MirrorCallbackParams{Out: true, Frame: &frames.Frame{Body: &frames.PerformClose{}}})
+		require.NoError(t, err)
+		require.Equal(t, 2, len(metaFrames))
+		require.Equal(t, []uint32{6}, deliveryIDs(metaFrames[:1]))
+		require.IsType(t, &frames.PerformClose{}, metaFrames[1].Frame.Body)
+	})
+
+	t.Run("permute", func(t *testing.T) {
+		permute := func() []uint32 {
+			inj := NewReorderInjector(ReorderInjectorOptions{Window: 10, Mode: ReorderModePermute, Seed: 42})
+			return send(t, inj, false, 10)
+		}
+
+		permuted := permute()
+		require.ElementsMatch(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, permuted)
+		require.NotEqual(t, []uint32{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}, permuted)
+
+		// the same seed reorders the frames the same way.
+		require.Equal(t, permuted, permute())
+	})
+
+	t.Run("windows are per direction", func(t *testing.T) {
+		inj := NewReorderInjector(ReorderInjectorOptions{Window: 2, Mode: ReorderModeReverse})
+		require.Empty(t, send(t, inj, true, 1))
+		require.Empty(t, send(t, inj, false, 1))
+		require.Equal(t, []uint32{0, 0}, send(t, inj, true, 1))
+	})
+
+	t.Run("unmatched frames are passed through", func(t *testing.T) {
+		inj := NewReorderInjector(ReorderInjectorOptions{Window: 2, Mode: ReorderModeReverse, Match: IsType(frames.BodyTypeFlow)})
+
+		for _, fr := range []*frames.Frame{transfer(0), {Body: &frames.PerformOpen{}}, {Body: &frames.EmptyFrame{}}} {
+			metaFrames, err := inj.Callback(context.Background(), MirrorCallbackParams{Out: true, Frame: fr})
+			require.NoError(t, err)
+			require.True(t, isUnchanged(fr, metaFrames))
+		}
+	})
+}
+
+func TestReorderInjector_Dispositions(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewReorderInjector(ReorderInjectorOptions{
+			Window: 3,
+			Mode:   ReorderModeReverse,
+			Match:  IsType(frames.BodyTypeDisposition),
+		})
+		// the sender waits for the service's DISPOSITION for each message, so we only hold the client's.
+		return When(IsOutbound, injector.Callback)
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	for i := range 3 {
+		require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(fmt.Sprintf("message %d", i))), nil))
+	}
+
+	receiver, err := session.NewReceiver(context.Background(), "queue", &amqp.ReceiverOptions{Credit: 10})
+	require.NoError(t, err)
+
+	for i := range 3 {
+		msg, err := receiver.Receive(context.Background(), nil)
+		require.NoError(t, err)
+		require.Equal(t, fmt.Sprintf("message %d", i), string(msg.GetData()))
+		require.NoError(t, receiver.AcceptMessage(context.Background(), msg))
+	}
+
+	// the broker settles each message, even though their dispositions arrived in the reverse order.
+	require.Eventually(t, func() bool {
+		messages, err := broker.Messages("queue")
+		require.NoError(t, err)
+		return len(messages) == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,88 @@
+package faultinjectors
+
+import (
+	"context"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+type SASLInjectorOptions struct {
+	// Outcome, if set, replaces the code in the service's SASL outcome. Any code, apart from
+	// [encoding.CodeSASLOK], fails the client's authentication, even if the service accepted it.
+	Outcome *encoding.SASLCode
+
+	// AdditionalData, if set, replaces the additional data in the service's SASL outcome. Some services use
+	// it to explain why authentication failed.
+	AdditionalData []byte
+
+	// MechanismsDelay, if set, is how long to wait before sending the service's SASL mechanisms frame to
+	// the client. Useful for checking that clients time out, and retry, slow connections.
+	MechanismsDelay time.Duration
+}
+
+// NewSASLInjector creates an injector that replaces the service's SASL outcome, and delays its SASL mechanisms.
+// Useful for checking that clients classify authentication failures (auth, sys-perm) and transient failures
+// (sys, sys-temp) correctly.
+//
+// SASL is negotiated before the OPEN frames, so use this with [FaultInjectorOptions.HandshakeFactory].
+func NewSASLInjector(options SASLInjectorOptions) *SASLInjector {
+	if options.Outcome == nil && options.AdditionalData == nil && options.MechanismsDelay == 0 {
+		utils.Panicf("at least one of Outcome, AdditionalData or MechanismsDelay must be set")
+	}
+
+	if options.MechanismsDelay < 0 {
+		utils.Panicf("MechanismsDelay cannot be negative")
+	}
+
+	return &SASLInjector{options: options}
+}
+
+type SASLInjector struct {
+	options SASLInjectorOptions
+}
+
+func (inj *SASLInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	logger := logging.SloggerFromContext(ctx)
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.SASLMechanisms:
+		if inj.options.MechanismsDelay == 0 {
+			return passthrough(params), nil
+		}
+
+		logger.Info("Delaying SASL mechanisms", "mechanisms", body.Mechanisms, "delay", inj.options.MechanismsDelay)
+
+		return []MetaFrame{{
+			Action:      MetaFrameActionPassthrough,
+			Frame:       params.Frame,
+			Delay:       inj.options.MechanismsDelay,
+			Description: "delaying SASL mechanisms",
+		}}, nil
+	case *frames.SASLOutcome:
+		if inj.options.Outcome == nil && inj.options.AdditionalData == nil {
+			return passthrough(params), nil
+		}
+
+		code := body.Code
+
+		if inj.options.Outcome != nil {
+			code = *inj.options.Outcome
+		}
+
+		logger.Info("Replacing SASL outcome", "code", body.Code.String(), "newCode", code.String())
+
+		body.Code = code
+
+		if inj.options.AdditionalData != nil {
+			body.AdditionalData = inj.options.AdditionalData
+		}
+
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "replacing SASL outcome"}}, nil
+	default:
+		return passthrough(params), nil
+	}
+}
@@ -0,0 +1,58 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSASLInjector_Outcome(t *testing.T) {
+	for _, code := range []encoding.SASLCode{encoding.CodeSASLAuth, encoding.CodeSASLSys, encoding.CodeSASLSysPerm, encoding.CodeSASLSysTemp} {
+		t.Run(code.String(), func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				return passthroughCallbackForTest
+			}, &FaultInjectorOptions{
+				HandshakeFactory: func(connInfo ConnInfo) MirrorCallback {
+					return NewSASLInjector(SASLInjectorOptions{Outcome: utils.Ptr(code)}).Callback
+				},
+			})
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			// the service accepted the client, but the client only sees our outcome.
+			_, err := amqp.Dial(ctx, "amqp://"+fi.ListenAddr(), &amqp.ConnOptions{SASLType: amqp.SASLTypeAnonymous()})
+			require.ErrorContains(t, err, fmt.Sprintf("failed with code %#00x", uint8(code)))
+		})
+	}
+}
+
+func TestSASLInjector_MechanismsDelay(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		HandshakeFactory: func(connInfo ConnInfo) MirrorCallback {
+			return NewSASLInjector(SASLInjectorOptions{MechanismsDelay: time.Second}).Callback
+		},
+	})
+
+	start := time.Now()
+	session := newSessionForTest(t, fi.ListenAddr())
+	require.GreaterOrEqual(t, time.Since(start), time.Second)
+
+	// the rest of the connection is untouched.
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+}
@@ -0,0 +1,303 @@
+package faultinjectors
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"gopkg.in/yaml.v3"
+)
+
+// Scenario is a list of rules, which match frames and apply faults to them. Scenarios are
+// usually loaded from a YAML file, using [LoadScenario], and run using a [ScenarioInjector].
+//
+// Example:
+//
+//	rules:
+//	  - name: detach the sender, on the third message
+//	    match:
+//	      direction: out
+//	      frameType: Transfer
+//	      address: "myqueue"
+//	      nth: 3
+//	    action:
+//	      type: detach
+//	      error:
+//	        condition: amqp:link:detach-forced
+//	        description: detached by the fault injector
+type Scenario struct {
+	Rules []ScenarioRule `yaml:"rules"`
+}
+
+type ScenarioRule struct {
+	// Name is used when logging. Optional.
+	Name string `yaml:"name"`
+
+	Match  ScenarioMatch  `yaml:"match"`
+	Action ScenarioAction `yaml:"action"`
+}
+
+type ScenarioMatch struct {
+	// Direction is "out" (client -> service), "in" (service -> client), or empty, to match both.
+	Direction string `yaml:"direction"`
+
+	// FrameType is the type of frame (ex: "Transfer", "Flow"). Empty matches all frames.
+	FrameType frames.BodyType `yaml:"frameType"`
+
+	// Address is a glob (see [path.Match]) that's matched against the address of the frame's link. Frames that
+	// aren't part of a link (ex: BEGIN) never match if this is set.
+	//
+	// If Address is empty, frames on $cbs and $management links are not matched.
+	Address string `yaml:"address"`
+
+	// LinkName is a glob (see [path.Match]) that's matched against the name of the frame's link. Frames that
+	// aren't part of a link (ex: BEGIN) never match if this is set.
+	LinkName string `yaml:"linkName"`
+
+	// Nth, if set, only matches the nth (starting at 1) frame that matches all the other fields.
+	Nth int `yaml:"nth"`
+}
+
+type ScenarioActionType string
+
+const (
+	// ScenarioActionDrop drops the frame.
+	ScenarioActionDrop ScenarioActionType = "drop"
+
+	// ScenarioActionDelay delays the frame by [ScenarioAction.Delay].
+	ScenarioActionDelay ScenarioActionType = "delay"
+
+	// ScenarioActionModify sets the fields in [ScenarioAction.Fields] on the frame.
+	ScenarioActionModify ScenarioActionType = "modify"
+
+	// ScenarioActionDetach forwards the frame, and then detaches its link, with [ScenarioAction.Error].
+	ScenarioActionDetach ScenarioActionType = "detach"
+
+	// ScenarioActionEnd forwards the frame, and then ends its session, with [ScenarioAction.Error].
+	ScenarioActionEnd ScenarioActionType = "end"
+
+	// ScenarioActionClose forwards the frame, and then closes the connection, with [ScenarioAction.Error].
+	ScenarioActionClose ScenarioActionType = "close"
+
+	// ScenarioActionDisconnect drops the frame, and terminates the client and service's network connections, as
+	// described by [ScenarioAction.Disconnect].
+	ScenarioActionDisconnect ScenarioActionType = "disconnect"
+)
+
+type ScenarioAction struct {
+	Type ScenarioActionType `yaml:"type"`
+
+	// Delay is how long to delay the frame, for the "delay" action.
+	Delay time.Duration `yaml:"delay"`
+
+	// Fields are set on the frame's body, for the "modify" action. The names are the same as the
+	// fields in the Go types, in the frames package (ex: LinkCredit, for a FLOW frame).
+	Fields map[string]any `yaml:"fields"`
+
+	// Error is the AMQP error that the client sees, for the "detach", "end" and "close" actions. If
+	// it's not set, a default error is used.
+	Error *encoding.Error `yaml:"error"`
+
+	// Disconnect is how the client's (local) and service's (remote) connections are terminated, for the
+	// "disconnect" action (ex: { local: reset, remote: close }). If it's not set, both are closed.
+	Disconnect *Disconnect `yaml:"disconnect"`
+}
+
+// LoadScenario loads a [Scenario] from a YAML file.
+func LoadScenario(file string) (*Scenario, error) {
+	data, err := os.ReadFile(file)
+
+	if err != nil {
+		return nil, err
+	}
+
+	scenario, err := ParseScenario(data)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid scenario in %s: %w", file, err)
+	}
+
+	return scenario, nil
+}
+
+// ParseScenario parses and validates a [Scenario], from YAML.
+func ParseScenario(data []byte) (*Scenario, error) {
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+
+	var scenario *Scenario
+
+	if err := decoder.Decode(&scenario); err != nil {
+		return nil, err
+	}
+
+	if scenario == nil {
+		return nil, errors.New("scenario is empty")
+	}
+
+	if err := scenario.Validate(); err != nil {
+		return nil, err
+	}
+
+	return scenario, nil
+}
+
+// Validate checks the scenario's rules, and fills in any defaults.
+func (s *Scenario) Validate() error {
+	if len(s.Rules) == 0 {
+		return errors.New("scenario has no rules")
+	}
+
+	for i := range s.Rules {
+		rule := &s.Rules[i]
+
+		if rule.Name == "" {
+			rule.Name = fmt.Sprintf("rule %d", i+1)
+		}
+
+		if err := rule.validate(); err != nil {
+			return fmt.Errorf("%s: %w", rule.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (r *ScenarioRule) validate() error {
+	switch r.Match.Direction {
+	case "", "in", "out":
+	default:
+		return fmt.Errorf("invalid direction %q, must be 'in', 'out' or empty", r.Match.Direction)
+	}
+
+	if r.Match.FrameType != "" {
+		frameType, err := ParseFrameType(string(r.Match.FrameType))
+
+		if err != nil {
+			return err
+		}
+
+		// normalize the casing, so we can compare against [frames.Body.Type] later.
+		r.Match.FrameType = frameType
+	}
+
+	for _, glob := range []string{r.Match.Address, r.Match.LinkName} {
+		if _, err := path.Match(glob, ""); err != nil {
+			return fmt.Errorf("invalid glob %q: %w", glob, err)
+		}
+	}
+
+	if r.Match.Nth < 0 {
+		return fmt.Errorf("nth must be greater than zero, was %d", r.Match.Nth)
+	}
+
+	switch r.Action.Type {
+	case ScenarioActionDrop:
+	case ScenarioActionDisconnect:
+		if r.Action.Disconnect == nil {
+			r.Action.Disconnect = &Disconnect{Local: DisconnectModeClose, Remote: DisconnectModeClose}
+		}
+
+		if err := r.Action.Disconnect.Validate(); err != nil {
+			return err
+		}
+	case ScenarioActionDelay:
+		if r.Action.Delay <= 0 {
+			return errors.New("delay action requires a delay")
+		}
+	case ScenarioActionModify:
+		if r.Match.FrameType == "" {
+			return errors.New("modify action requires a frameType, in the match")
+		}
+
+		if len(r.Action.Fields) == 0 {
+			return errors.New("modify action requires fields")
+		}
+
+		// check the fields are valid for this type of frame, now, rather than when frames start flowing.
+		if err := setFields(newBodyForType(r.Match.FrameType), r.Action.Fields); err != nil {
+			return err
+		}
+	case ScenarioActionDetach:
+		r.Action.Error = defaultError(r.Action.Error, proto.ErrCondDetachForced, "Detached by the fault injector")
+	case ScenarioActionEnd:
+		r.Action.Error = defaultError(r.Action.Error, proto.ErrCondInternalError, "Session ended by the fault injector")
+	case ScenarioActionClose:
+		r.Action.Error = defaultError(r.Action.Error, proto.ErrCondConnectionForced, "Connection closed by the fault injector")
+	default:
+		return fmt.Errorf("invalid action type %q", r.Action.Type)
+	}
+
+	return nil
+}
+
+func defaultError(err *encoding.Error, cond encoding.ErrCond, desc string) *encoding.Error {
+	if err != nil {
+		return err
+	}
+
+	return &encoding.Error{Condition: cond, Description: desc}
+}
+
+// setFields sets fields on a frame body, using the same names as the fields in the Go struct.
+func setFields(body frames.Body, fields map[string]any) error {
+	jsonBytes, err := json.Marshal(fields)
+
+	if err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonBytes))
+	decoder.DisallowUnknownFields()
+
+	if err := decoder.Decode(body); err != nil {
+		return fmt.Errorf("invalid fields for %s frame: %w", body.Type(), err)
+	}
+
+	return nil
+}
+
+// ParseFrameType checks that frameType is an AMQP performative, or Empty, and returns it with the casing
+// [frames.Body.Type] uses. The type is case-insensitive.
+func ParseFrameType(frameType string) (frames.BodyType, error) {
+	body := newBodyForType(frames.BodyType(frameType))
+
+	if body == nil {
+		return "", fmt.Errorf("invalid frame type %q", frameType)
+	}
+
+	return body.Type(), nil
+}
+
+// newBodyForType creates an empty body for an AMQP performative. Returns nil if the type is unknown. The
+// type is case-insensitive.
+func newBodyForType(bodyType frames.BodyType) frames.Body {
+	bodies := []frames.Body{
+		&frames.PerformOpen{},
+		&frames.PerformBegin{},
+		&frames.PerformAttach{},
+		&frames.PerformFlow{},
+		&frames.PerformTransfer{},
+		&frames.PerformDisposition{},
+		&frames.PerformDetach{},
+		&frames.PerformEnd{},
+		&frames.PerformClose{},
+		&frames.EmptyFrame{},
+	}
+
+	for _, body := range bodies {
+		if strings.EqualFold(string(body.Type()), string(bodyType)) {
+			return body
+		}
+	}
+
+	return nil
+}
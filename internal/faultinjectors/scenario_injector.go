@@ -0,0 +1,186 @@
+package faultinjectors
+
+import (
+	"context"
+	"path"
+	"slices"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// NewScenarioInjector creates an injector that runs a [Scenario]'s rules against each frame.
+//
+// Rules are checked in order, and the first rule that matches a frame is applied. Frames that
+// don't match any rule are passed through, unchanged.
+func NewScenarioInjector(scenario *Scenario) *ScenarioInjector {
+	// validating fills in defaults, so we work on our own copy. The same scenario can be shared by several injectors.
+	scenario = &Scenario{Rules: slices.Clone(scenario.Rules)}
+
+	if err := scenario.Validate(); err != nil {
+		utils.Panicf("invalid scenario: %w", err)
+	}
+
+	return &ScenarioInjector{
+		rules:      scenario.Rules,
+		matches:    make([]int, len(scenario.Rules)),
+		terminator: newTerminator(),
+	}
+}
+
+type ScenarioInjector struct {
+	rules []ScenarioRule
+
+	// mu protects matches
+	mu sync.Mutex
+
+	// matches are the number of frames that have matched each rule, for [ScenarioMatch.Nth].
+	matches []int
+
+	terminator *terminator
+}
+
+func (inj *ScenarioInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	rule := inj.findRule(&params)
+
+	if rule == nil {
+		return passthrough(params), nil
+	}
+
+	slogger := logging.SloggerFromContext(ctx)
+	slogger.Info("Rule matched", "rule", rule.Name, "action", rule.Action.Type, "type", params.Type(), "channel", params.Channel())
+
+	description := "Rule: " + rule.Name
+
+	switch rule.Action.Type {
+	case ScenarioActionDrop:
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: description}}, nil
+	case ScenarioActionDelay:
+		return []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Delay: rule.Action.Delay, Description: description}}, nil
+	case ScenarioActionModify:
+		if err := setFields(params.Frame.Body, rule.Action.Fields); err != nil {
+			return nil, err
+		}
+
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: description}}, nil
+	case ScenarioActionDetach:
+		return inj.detach(ctx, params, rule, description), nil
+	case ScenarioActionEnd:
+		return inj.end(ctx, params, rule, description), nil
+	case ScenarioActionClose:
+		return []MetaFrame{
+			{Action: MetaFrameActionPassthrough, Frame: params.Frame, Description: description},
+			inj.terminator.Close(rule.Action.Error, 0),
+		}, nil
+	case ScenarioActionDisconnect:
+		return []MetaFrame{{Action: MetaFrameActionDisconnect, Frame: params.Frame, Disconnect: rule.Action.Disconnect, Description: description}}, nil
+	default:
+		utils.Panicf("unhandled action type %q", rule.Action.Type)
+		return nil, nil
+	}
+}
+
+// findRule returns the first rule that matches the frame, or nil if no rules match.
+func (inj *ScenarioInjector) findRule(params *MirrorCallbackParams) *ScenarioRule {
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	for i := range inj.rules {
+		rule := &inj.rules[i]
+
+		if !rule.Match.matches(params) {
+			continue
+		}
+
+		inj.matches[i]++
+
+		if rule.Match.Nth != 0 && inj.matches[i] != rule.Match.Nth {
+			continue
+		}
+
+		return rule
+	}
+
+	return nil
+}
+
+func (inj *ScenarioInjector) detach(ctx context.Context, params MirrorCallbackParams, rule *ScenarioRule, description string) []MetaFrame {
+	passthrough := []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Description: description}}
+	localAttach := params.AttachFrame()
+
+	if localAttach != nil && !params.Out {
+		// the DETACH is sent to the service, so we need our own channel and handle for the link.
+		localAttach = params.StateMap.LookupCorrespondingAttachFrame(false, params.Channel(), localAttach.Body.Handle)
+	}
+
+	if localAttach == nil {
+		logging.SloggerFromContext(ctx).Warn("Can't detach, frame isn't for an attached link", "rule", rule.Name, "type", params.Type())
+		return passthrough
+	}
+
+	return append(passthrough, inj.terminator.Detach(localAttach.Header.Channel, localAttach.Body.Handle, rule.Action.Error, 0))
+}
+
+func (inj *ScenarioInjector) end(ctx context.Context, params MirrorCallbackParams, rule *ScenarioRule, description string) []MetaFrame {
+	passthrough := []MetaFrame{{Action: MetaFrameActionPassthrough, Frame: params.Frame, Description: description}}
+	localChannel := utils.Ptr(params.Channel())
+
+	if !params.Out {
+		// the END is sent to the service, so we need our own channel for the session.
+		localChannel = params.StateMap.LookupCorrespondingChannel(false, params.Channel())
+	}
+
+	if localChannel == nil {
+		logging.SloggerFromContext(ctx).Warn("Can't end session, frame isn't for a known session", "rule", rule.Name, "type", params.Type())
+		return passthrough
+	}
+
+	return append(passthrough, inj.terminator.End(*localChannel, rule.Action.Error, 0))
+}
+
+func (m *ScenarioMatch) matches(params *MirrorCallbackParams) bool {
+	switch {
+	case m.Direction == "out" && !params.Out,
+		m.Direction == "in" && params.Out,
+		m.FrameType != "" && m.FrameType != params.Type():
+		return false
+	}
+
+	if m.Address == "" && m.LinkName == "" {
+		return !params.ManagementOrCBS()
+	}
+
+	attachFrame := params.AttachFrame()
+
+	if attachFrame == nil {
+		return false
+	}
+
+	if m.Address == "" && params.ManagementOrCBS() {
+		return false
+	}
+
+	return globMatches(m.Address, params.Address()) && globMatches(m.LinkName, attachFrame.Body.Name)
+}
+
+// globMatches checks value against a glob pattern. An empty pattern matches everything.
+func globMatches(pattern string, value string) bool {
+	if pattern == "" {
+		return true
+	}
+
+	// the pattern was validated when the scenario was loaded.
+	matched, _ := path.Match(pattern, value)
+	return matched
+}
@@ -0,0 +1,220 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseScenario(t *testing.T) {
+	scenario, err := ParseScenario([]byte(`
+rules:
+  - match:
+      direction: out
+      frameType: flow
+      linkName: "receiver-*"
+    action:
+      type: modify
+      fields:
+        LinkCredit: 1
+  - name: detach
+    match:
+      frameType: Transfer
+      address: myqueue
+      nth: 2
+    action:
+      type: detach
+`))
+	require.NoError(t, err)
+
+	require.Equal(t, []ScenarioRule{
+		{
+			Name:   "rule 1",
+			Match:  ScenarioMatch{Direction: "out", FrameType: frames.BodyTypeFlow, LinkName: "receiver-*"},
+			Action: ScenarioAction{Type: ScenarioActionModify, Fields: map[string]any{"LinkCredit": 1}},
+		},
+		{
+			Name:  "detach",
+			Match: ScenarioMatch{FrameType: frames.BodyTypeTransfer, Address: "myqueue", Nth: 2},
+			Action: ScenarioAction{Type: ScenarioActionDetach, Error: &encoding.Error{
+				Condition:   proto.ErrCondDetachForced,
+				Description: "Detached by the fault injector",
+			}},
+		},
+	}, scenario.Rules)
+}
+
+func TestParseScenario_Invalid(t *testing.T) {
+	testData := []struct {
+		Rule string
+		Err  string
+	}{
+		{Rule: "{ match: { direction: sideways }, action: { type: drop } }", Err: `invalid direction "sideways"`},
+		{Rule: "{ match: { frameType: Teleport }, action: { type: drop } }", Err: `invalid frame type "Teleport"`},
+		{Rule: "{ match: { address: '[' }, action: { type: drop } }", Err: `invalid glob "["`},
+		{Rule: "{ match: { nth: -1 }, action: { type: drop } }", Err: "nth must be greater than zero"},
+		{Rule: "{ action: { type: explode } }", Err: `invalid action type "explode"`},
+		{Rule: "{ action: { type: delay } }", Err: "delay action requires a delay"},
+		{Rule: "{ action: { type: modify, fields: { LinkCredit: 1 } } }", Err: "modify action requires a frameType"},
+		{Rule: "{ match: { frameType: Flow }, action: { type: modify } }", Err: "modify action requires fields"},
+		{Rule: "{ match: { frameType: Flow }, action: { type: modify, fields: { Bogus: 1 } } }", Err: `unknown field "Bogus"`},
+		{Rule: "{ match: { frameTyp: Flow }, action: { type: drop } }", Err: "field frameTyp not found"},
+		{Rule: "{ action: { type: disconnect, disconnect: { local: explode } } }", Err: `invalid disconnect mode "explode"`},
+	}
+
+	for _, td := range testData {
+		t.Run(td.Err, func(t *testing.T) {
+			scenario, err := ParseScenario([]byte("rules:\n  - " + td.Rule))
+			require.ErrorContains(t, err, td.Err)
+			require.Nil(t, scenario)
+		})
+	}
+
+	_, err := ParseScenario([]byte("rules: []"))
+	require.EqualError(t, err, "scenario has no rules")
+
+	_, err = ParseScenario([]byte("null"))
+	require.EqualError(t, err, "scenario is empty")
+}
+
+func TestLoadScenario_Sample(t *testing.T) {
+	scenario, err := LoadScenario("../../samples/scenarios/faults.yaml")
+	require.NoError(t, err)
+	require.NotEmpty(t, scenario.Rules)
+}
+
+func TestScenarioInjector_Detach(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Transfer, address: queue, nth: 2 }
+    action:
+      type: detach
+      error: { condition: "amqp:link:stolen", description: "detached by the scenario" }
+`)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	// the second TRANSFER is forwarded, and then the link is detached.
+	for range 2 {
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		require.NoError(t, err)
+	}
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+
+	var linkErr *amqp.LinkError
+	require.ErrorAs(t, err, &linkErr)
+	require.Equal(t, &amqp.Error{Condition: "amqp:link:stolen", Description: "detached by the scenario"}, linkErr.RemoteErr)
+
+	messages, err := broker.Messages("queue")
+	require.NoError(t, err)
+	require.Len(t, messages, 2)
+}
+
+func TestScenarioInjector_Drop(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Transfer, nth: 1 }
+    action: { type: drop }
+`)
+
+	sender, err := session.NewSender(context.Background(), "queue", &amqp.SenderOptions{
+		SettlementMode: amqp.SenderSettleModeSettled.Ptr(),
+	})
+	require.NoError(t, err)
+
+	for _, body := range []string{"dropped", "forwarded"} {
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil)
+		require.NoError(t, err)
+	}
+
+	require.Eventually(t, func() bool {
+		messages, err := broker.Messages("queue")
+		require.NoError(t, err)
+		return len(messages) == 1 && string(messages[0].Data[0]) == "forwarded"
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestScenarioInjector_End(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Transfer }
+    action: { type: end }
+`)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	var sessionErr *amqp.SessionError
+
+	require.Eventually(t, func() bool {
+		err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+		return errors.As(err, &sessionErr)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.Equal(t, amqp.ErrCond(proto.ErrCondInternalError), sessionErr.RemoteErr.Condition)
+}
+
+func TestScenarioInjector_Close(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Transfer }
+    action: { type: close, error: { condition: "amqp:connection:forced", description: "closed by the scenario" } }
+`)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	requireConnClosedForTest(t, sender, &amqp.Error{Condition: amqp.ErrCondConnectionForced, Description: "closed by the scenario"})
+}
+
+func TestScenarioInjector_Disconnect(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Attach }
+    action: { type: disconnect }
+`)
+
+	_, err := session.NewSender(context.Background(), "queue", nil)
+
+	var connErr *amqp.ConnError
+	require.ErrorAs(t, err, &connErr)
+	require.Nil(t, connErr.RemoteErr)
+}
+
+func TestScenarioInjector_DisconnectWithReset(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+	session := newScenarioSessionForTest(t, broker.ListenAddr(), `
+rules:
+  - match: { direction: out, frameType: Transfer }
+    action: { type: disconnect, disconnect: { local: reset, remote: reset } }
+`)
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte("hello world")), nil)
+	requireDisconnectedForTest(t, err)
+}
+
+func newScenarioSessionForTest(t *testing.T, remoteEndpoint string, yaml string) *amqp.Session {
+	scenario, err := ParseScenario([]byte(yaml))
+	require.NoError(t, err)
+
+	fi := newFaultInjectorForTest(t, remoteEndpoint, NewScenarioInjector(scenario).Callback)
+	return newSessionForTest(t, fi.ListenAddr())
+}
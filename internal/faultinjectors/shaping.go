@@ -0,0 +1,494 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+)
+
+// JitterDistribution is how the jitter, for [DirectionShaping], is distributed.
+type JitterDistribution string
+
+const (
+	// JitterDistributionUniform adds a random amount, between -Jitter and +Jitter, to the latency.
+	JitterDistributionUniform = JitterDistribution("uniform")
+
+	// JitterDistributionNormal adds a normally distributed random amount, with a standard deviation of Jitter,
+	// to the latency.
+	JitterDistributionNormal = JitterDistribution("normal")
+)
+
+// ShapingOptions simulate a slow, or far away, network by limiting the bandwidth, and adding latency, to the frames
+// the fault injector sends.
+//
+// Shaped frames are queued, and sent in the background, so the mirror keeps reading (and sending) frames that
+// aren't shaped. Frames in the same queue are always sent in the order they were queued, and a CLOSE waits
+// until the frames queued ahead of it, for every session, have been sent.
+type ShapingOptions struct {
+	// In shapes frames sent to the client, from the service.
+	In *DirectionShaping
+
+	// Out shapes frames sent to the service, from the client.
+	Out *DirectionShaping
+
+	// Address, if set, only shapes frames for links with an address that matches this glob (see [path.Match]).
+	// Each session gets its own queue, so a shaped link doesn't block links on other sessions, even once its
+	// queue is full (see QueueLimit).
+	//
+	// NOTE: this doesn't isolate links on the same session. They share the session's queue, so a session's
+	// other links aren't shaped, but their frames still wait behind the shaped frames ahead of them. A session's
+	// FLOW frames count the TRANSFER frames for all of its links, and a DISPOSITION can settle deliveries from
+	// several links, so letting one link's frames overtake another's would break the session's flow control.
+	//
+	// If it's empty, every frame is shaped, using a single queue for each direction, like a real network.
+	Address string
+
+	// QueueLimit is the most frames a queue holds. Once a queue's full the mirror stops reading from the peer
+	// that's sending to it, like a full TCP window, until there's room. Defaults to 1000.
+	//
+	// It isn't used if Address is set. Every session's frames are read from the same connection, so stopping
+	// the reads for one session would stop them for all of them. Instead, a session's queue is limited by the
+	// session's flow control - the peer can't send more TRANSFER frames than the other side has made room for,
+	// and the other side doesn't see them until they've been shaped.
+	QueueLimit int
+
+	// Seed seeds the random number generator used for jitter, so it's the same each run. If it's zero, a random
+	// seed is used.
+	Seed uint64
+}
+
+// DirectionShaping shapes the frames going in a single direction.
+type DirectionShaping struct {
+	// BytesPerSecond, if set, limits the bandwidth, using a token bucket.
+	BytesPerSecond int64
+
+	// Burst is the size of the token bucket, in bytes - how much can be sent, at full speed, after the
+	// connection's been idle. Defaults to 0, so every frame is limited to BytesPerSecond.
+	Burst int64
+
+	// Latency is added to every frame.
+	Latency time.Duration
+
+	// Jitter varies the latency for each frame, using JitterDistribution. The latency never goes below zero.
+	Jitter time.Duration
+
+	// JitterDistribution is how the jitter is distributed. Defaults to [JitterDistributionUniform].
+	JitterDistribution JitterDistribution
+}
+
+func (ds *DirectionShaping) validate() error {
+	if ds == nil {
+		return nil
+	}
+
+	if ds.BytesPerSecond < 0 || ds.Burst < 0 || ds.Latency < 0 || ds.Jitter < 0 {
+		return fmt.Errorf("shaping values cannot be negative")
+	}
+
+	switch ds.JitterDistribution {
+	case "", JitterDistributionUniform, JitterDistributionNormal:
+		return nil
+	default:
+		return fmt.Errorf("invalid JitterDistribution %q", ds.JitterDistribution)
+	}
+}
+
+// Validate checks that the options are valid.
+func (so *ShapingOptions) Validate() error {
+	if _, err := path.Match(so.Address, ""); err != nil {
+		return fmt.Errorf("invalid glob %q: %w", so.Address, err)
+	}
+
+	if so.QueueLimit < 0 {
+		return fmt.Errorf("QueueLimit cannot be negative")
+	}
+
+	if err := so.In.validate(); err != nil {
+		return err
+	}
+
+	return so.Out.validate()
+}
+
+// defaultShapingQueueLimit is the default for [ShapingOptions.QueueLimit].
+const defaultShapingQueueLimit = 1000
+
+// shaper queues frames, and sends them once their latency, and bandwidth limit, allows.
+type shaper struct {
+	options    ShapingOptions
+	queueLimit int
+
+	// send sends a frame, returned by a callback for a frame going in the out direction.
+	send func(out bool, metaFrame *MetaFrame) error
+
+	// done is closed when the mirror's finished. Anything still queued is dropped.
+	done chan struct{}
+
+	mu      sync.Mutex
+	rnd     *rand.Rand
+	buckets [2]*tokenBucket
+
+	// cond is signalled, using mu, when a queued frame's been sent, or the shaper's closed.
+	cond   *sync.Cond
+	closed bool
+
+	// queues are keyed by direction and, if [ShapingOptions.Address] is set, the channel.
+	queues map[shapingKey]*shapingQueue
+
+	// links are the links that match [ShapingOptions.Address], keyed by the direction and the channel and handle
+	// of the peer that's sending.
+	links map[shapingLinkKey]bool
+}
+
+type shapingKey struct {
+	Out     bool
+	Channel uint16
+}
+
+type shapingLinkKey struct {
+	Out bool
+	linkID
+}
+
+func newShaper(options ShapingOptions, send func(out bool, metaFrame *MetaFrame) error) *shaper {
+	seed := options.Seed
+
+	if seed == 0 {
+		seed = rand.Uint64()
+	}
+
+	s := &shaper{
+		options:    options,
+		queueLimit: options.QueueLimit,
+		send:       send,
+		done:       make(chan struct{}),
+		rnd:        rand.New(rand.NewPCG(seed, seed)),
+		queues:     map[shapingKey]*shapingQueue{},
+		links:      map[shapingLinkKey]bool{},
+	}
+
+	if s.queueLimit == 0 {
+		s.queueLimit = defaultShapingQueueLimit
+	}
+
+	s.cond = sync.NewCond(&s.mu)
+
+	for i, ds := range []*DirectionShaping{options.In, options.Out} {
+		if ds != nil && ds.BytesPerSecond > 0 {
+			s.buckets[i] = newTokenBucket(ds.BytesPerSecond, ds.Burst)
+		}
+	}
+
+	return s
+}
+
+func (s *shaper) direction(out bool) *DirectionShaping {
+	if out {
+		return s.options.Out
+	}
+
+	return s.options.In
+}
+
+func (s *shaper) bucket(out bool) *tokenBucket {
+	if out {
+		return s.buckets[1]
+	}
+
+	return s.buckets[0]
+}
+
+// Queue queues a frame, returned by a callback for a frame going in the out direction, if it's shaped. It
+// returns false if the frame isn't shaped, and should be sent immediately.
+func (s *shaper) Queue(out bool, metaFrame *MetaFrame) bool {
+	finalOut := out
+
+	switch metaFrame.Action {
+	case MetaFrameActionPassthrough:
+	case MetaFrameActionAdded, MetaFrameActionModified:
+		if metaFrame.OverrideOut != nil {
+			finalOut = *metaFrame.OverrideOut
+		}
+	default:
+		// dropped frames aren't sent, and disconnects happen immediately, like a cable being pulled.
+		return false
+	}
+
+	ds := s.direction(finalOut)
+
+	if ds == nil {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key, isShaped := s.queueKey(finalOut, metaFrame.Frame)
+	q := s.queues[key]
+
+	var after []queueMark
+
+	if metaFrame.Frame.Body.Type() == frames.BodyTypeClose {
+		// a CLOSE ends every session, so it can't overtake the frames that are queued for them.
+		after = s.marks(finalOut, q)
+	}
+
+	if !isShaped && q == nil && len(after) == 0 {
+		return false
+	}
+
+	sendAt := time.Now()
+
+	if isShaped {
+		if bucket := s.bucket(finalOut); bucket != nil {
+			sendAt = bucket.Reserve(sendAt, frameSize(metaFrame))
+		}
+
+		sendAt = sendAt.Add(s.latency(ds))
+	}
+
+	if q == nil {
+		q = &shapingQueue{}
+		s.queues[key] = q
+	}
+
+	// frames can't overtake the frames ahead of them, in the same queue.
+	sendAt = maxTime(sendAt, q.lastSendAt)
+	q.lastSendAt = sendAt
+	q.items = append(q.items, shapedFrame{out: out, sendAt: sendAt, metaFrame: metaFrame, after: after})
+
+	if !q.running {
+		q.running = true
+		go s.run(key, q)
+	}
+
+	return true
+}
+
+// Wait blocks until the queue for frames going in the out direction has room, so the mirror stops reading
+// from a peer that's sending faster than its frames can be shaped. It returns early if ctx is cancelled, or the
+// shaper's closed. If [ShapingOptions.Address] is set it never blocks, so other sessions aren't held up.
+func (s *shaper) Wait(ctx context.Context, out bool) {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for !s.closed && ctx.Err() == nil && s.full(out) {
+		s.cond.Wait()
+	}
+}
+
+// full is true if the queue, for frames going in the out direction, is full. The per-session queues, used when
+// [ShapingOptions.Address] is set, are never full.
+func (s *shaper) full(out bool) bool {
+	if s.options.Address != "" {
+		return false
+	}
+
+	q := s.queues[shapingKey{Out: out}]
+	return q != nil && len(q.items) >= s.queueLimit
+}
+
+// marks returns the frames that are queued, in the out direction, in every queue apart from q.
+func (s *shaper) marks(out bool, q *shapingQueue) []queueMark {
+	var marks []queueMark
+
+	for key, other := range s.queues {
+		if key.Out == out && other != q && len(other.items) > 0 {
+			marks = append(marks, queueMark{queue: other, sent: other.sent + len(other.items)})
+		}
+	}
+
+	return marks
+}
+
+// waitFor waits until each queue has sent the frames that were queued, when its mark was taken. It returns
+// false if the shaper's closed.
+func (s *shaper) waitFor(marks []queueMark) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, mark := range marks {
+		for !s.closed && mark.queue.sent < mark.sent {
+			s.cond.Wait()
+		}
+	}
+
+	return !s.closed
+}
+
+// queueKey returns the queue for the frame, and whether the frame is shaped. Frames that aren't shaped still
+// have to wait behind the frames already in their queue.
+func (s *shaper) queueKey(out bool, fr *frames.Frame) (shapingKey, bool) {
+	if s.options.Address == "" {
+		return shapingKey{Out: out}, true
+	}
+
+	key := shapingKey{Out: out, Channel: fr.Header.Channel}
+	handle := fr.Body.GetHandle()
+
+	if handle == nil {
+		return key, false
+	}
+
+	id := shapingLinkKey{Out: out, linkID: linkID{fr.Header.Channel, *handle}}
+
+	if attachBody, isAttach := fr.Body.(*frames.PerformAttach); isAttach {
+		s.links[id] = globMatches(s.options.Address, attachBody.Address(out))
+	}
+
+	return key, s.links[id]
+}
+
+func (s *shaper) latency(ds *DirectionShaping) time.Duration {
+	latency := ds.Latency
+
+	if ds.Jitter > 0 {
+		switch ds.JitterDistribution {
+		case JitterDistributionNormal:
+			latency += time.Duration(s.rnd.NormFloat64() * float64(ds.Jitter))
+		default:
+			latency += time.Duration((s.rnd.Float64()*2 - 1) * float64(ds.Jitter))
+		}
+	}
+
+	return max(latency, 0)
+}
+
+// run sends the frames in q, as each one is due. It stops once the queue's empty.
+func (s *shaper) run(key shapingKey, q *shapingQueue) {
+	for {
+		s.mu.Lock()
+
+		if len(q.items) == 0 {
+			q.running = false
+			delete(s.queues, key)
+			s.mu.Unlock()
+			return
+		}
+
+		item := q.items[0]
+		s.mu.Unlock()
+
+		timer := time.NewTimer(time.Until(item.sendAt))
+
+		select {
+		case <-s.done:
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+
+		if !s.waitFor(item.after) {
+			return
+		}
+
+		if err := s.send(item.out, item.metaFrame); err != nil {
+			slog.Error("failed to send shaped frame", "error", err)
+		}
+
+		s.mu.Lock()
+		q.items = q.items[1:]
+		q.sent++
+		s.cond.Broadcast()
+		s.mu.Unlock()
+	}
+}
+
+// Close stops sending frames. Anything that's still queued is dropped.
+func (s *shaper) Close() {
+	close(s.done)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.closed = true
+	s.cond.Broadcast()
+}
+
+type shapingQueue struct {
+	items      []shapedFrame
+	lastSendAt time.Time
+	running    bool
+
+	// sent is the number of frames the queue has sent.
+	sent int
+}
+
+type shapedFrame struct {
+	out       bool
+	sendAt    time.Time
+	metaFrame *MetaFrame
+
+	// after are the frames, in other queues, that have to be sent before this one.
+	after []queueMark
+}
+
+// queueMark is a point in a queue: the frame is sent once the queue has sent this many frames.
+type queueMark struct {
+	queue *shapingQueue
+	sent  int
+}
+
+// frameSize is the number of bytes a frame takes up, on the wire.
+func frameSize(metaFrame *MetaFrame) int {
+	if metaFrame.Action == MetaFrameActionPassthrough && metaFrame.Frame.Raw() != nil {
+		return len(metaFrame.Frame.Raw())
+	}
+
+	raw, err := metaFrame.Frame.MarshalAMQP()
+
+	if err != nil {
+		// it'll fail again when it's sent, which is where we report it.
+		return 0
+	}
+
+	return len(raw)
+}
+
+func maxTime(a, b time.Time) time.Time {
+	if a.After(b) {
+		return a
+	}
+
+	return b
+}
+
+// tokenBucket limits bandwidth. Tokens (bytes) are added at a fixed rate, up to the bucket's size, and
+// each frame takes out as many tokens as it has bytes. If there aren't enough, the frame waits until there are.
+type tokenBucket struct {
+	rate   float64 // bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(bytesPerSecond int64, burst int64) *tokenBucket {
+	return &tokenBucket{rate: float64(bytesPerSecond), burst: float64(burst), tokens: float64(burst), last: time.Now()}
+}
+
+// Reserve takes n tokens out of the bucket, and returns when they'll have been added. The bucket can go into
+// debt, so frames that are bigger than the bucket still get sent, and later frames wait for the debt to be paid.
+func (tb *tokenBucket) Reserve(now time.Time, n int) time.Time {
+	tb.tokens = min(tb.burst, tb.tokens+now.Sub(tb.last).Seconds()*tb.rate)
+	tb.last = now
+	tb.tokens -= float64(n)
+
+	if tb.tokens >= 0 {
+		return now
+	}
+
+	return now.Add(time.Duration(-tb.tokens / tb.rate * float64(time.Second)))
+}
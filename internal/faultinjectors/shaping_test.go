@@ -0,0 +1,352 @@
+package faultinjectors
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/broker"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/models"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestShaping_Latency(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		Shaping: &ShapingOptions{Out: &DirectionShaping{Latency: 500 * time.Millisecond}},
+	})
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+
+	waitForMessagesForTest(t, broker, "queue", 1)
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestShaping_BytesPerSecond(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		Shaping: &ShapingOptions{Out: &DirectionShaping{BytesPerSecond: 20000}},
+	})
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	body := strings.Repeat("0123456789", 1000)
+
+	start := time.Now()
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil))
+
+	messages := waitForMessagesForTest(t, broker, "queue", 1)
+	require.Equal(t, body, string(messages[0].GetData()))
+
+	// over 10,000 bytes, at 20,000 bytes a second.
+	require.GreaterOrEqual(t, time.Since(start), 500*time.Millisecond)
+}
+
+func TestShaping_Address(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		Shaping: &ShapingOptions{
+			Out:     &DirectionShaping{Latency: 2 * time.Second},
+			Address: "slow*",
+		},
+	})
+
+	conn := newConnForTest(t, fi.ListenAddr())
+
+	// links on other sessions aren't held up by the shaped link.
+	fastSession, err := conn.NewSession(context.Background(), nil)
+	require.NoError(t, err)
+
+	slowSession, err := conn.NewSession(context.Background(), nil)
+	require.NoError(t, err)
+
+	fastSender, err := fastSession.NewSender(context.Background(), "fast queue", nil)
+	require.NoError(t, err)
+
+	slowSender, err := slowSession.NewSender(context.Background(), "slow queue", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	slowErr := make(chan error, 1)
+
+	go func() {
+		slowErr <- slowSender.Send(context.Background(), amqp.NewMessage([]byte("slow")), nil)
+	}()
+
+	require.NoError(t, fastSender.Send(context.Background(), amqp.NewMessage([]byte("fast")), nil))
+	require.Less(t, time.Since(start), time.Second)
+
+	messages, err := broker.Messages("slow queue")
+	require.NoError(t, err)
+	require.Empty(t, messages)
+
+	require.NoError(t, <-slowErr)
+	require.GreaterOrEqual(t, time.Since(start), 2*time.Second)
+	waitForMessagesForTest(t, broker, "slow queue", 1)
+}
+
+func TestShaping_AddressQueueFull(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		return passthroughCallbackForTest
+	}, &FaultInjectorOptions{
+		Shaping: &ShapingOptions{
+			Out:        &DirectionShaping{Latency: time.Second},
+			Address:    "slow*",
+			QueueLimit: 1,
+		},
+	})
+
+	conn := newConnForTest(t, fi.ListenAddr())
+
+	fastSession, err := conn.NewSession(context.Background(), nil)
+	require.NoError(t, err)
+
+	slowSession, err := conn.NewSession(context.Background(), nil)
+	require.NoError(t, err)
+
+	fastSender, err := fastSession.NewSender(context.Background(), "fast queue", nil)
+	require.NoError(t, err)
+
+	slowSender, err := slowSession.NewSender(context.Background(), "slow queue", nil)
+	require.NoError(t, err)
+
+	// fill the slow session's queue, past its limit.
+	const slowMessages = 3
+	slowErrs := make(chan error, slowMessages)
+
+	for range slowMessages {
+		go func() {
+			slowErrs <- slowSender.Send(context.Background(), amqp.NewMessage([]byte("slow")), nil)
+		}()
+	}
+
+	require.Eventually(t, func() bool {
+		fi.connsMu.Lock()
+		defer fi.connsMu.Unlock()
+
+		for _, ac := range fi.conns {
+			if ac.mirror.shaper.queueLenForTest(true) >= slowMessages {
+				return true
+			}
+		}
+
+		return false
+	}, 5*time.Second, time.Millisecond)
+
+	// the fast session isn't held up, even though the slow session's queue is full.
+	start := time.Now()
+	require.NoError(t, fastSender.Send(context.Background(), amqp.NewMessage([]byte("fast")), nil))
+	require.Less(t, time.Since(start), 500*time.Millisecond)
+
+	for range slowMessages {
+		require.NoError(t, <-slowErrs)
+	}
+
+	waitForMessagesForTest(t, broker, "slow queue", slowMessages)
+}
+
+func TestShaper_SessionOrder(t *testing.T) {
+	sent := make(chan string, 3)
+
+	s := newShaper(ShapingOptions{Out: &DirectionShaping{Latency: 200 * time.Millisecond}, Address: "slow"}, func(out bool, metaFrame *MetaFrame) error {
+		sent <- metaFrame.Description
+		return nil
+	})
+	defer s.Close()
+
+	attach := func(channel uint16, handle uint32, address string) *MetaFrame {
+		return &MetaFrame{
+			Action:      MetaFrameActionModified,
+			Description: address,
+			Frame: &frames.Frame{
+				Header: frames.Header{Channel: channel},
+				Body:   &frames.PerformAttach{Handle: handle, Role: encoding.RoleSender, Target: &frames.Target{Address: address}},
+			},
+		}
+	}
+
+	require.True(t, s.Queue(true, attach(0, 0, "slow")))
+
+	// the session's other links aren't shaped, but can't overtake the shaped link's frames.
+	require.True(t, s.Queue(true, attach(0, 1, "fast")))
+
+	// other sessions aren't held up, and neither are links in the other direction.
+	require.False(t, s.Queue(true, attach(1, 0, "fast")))
+	require.False(t, s.Queue(false, attach(0, 0, "slow")))
+
+	require.Equal(t, "slow", <-sent)
+	require.Equal(t, "fast", <-sent)
+}
+
+func TestShaper_CloseWaitsForOtherSessions(t *testing.T) {
+	sent := make(chan string, 2)
+
+	s := newShaper(ShapingOptions{Out: &DirectionShaping{Latency: 200 * time.Millisecond}, Address: "slow"}, func(out bool, metaFrame *MetaFrame) error {
+		sent <- metaFrame.Description
+		return nil
+	})
+	defer s.Close()
+
+	require.True(t, s.Queue(true, &MetaFrame{
+		Action:      MetaFrameActionModified,
+		Description: "attach",
+		Frame: &frames.Frame{
+			Header: frames.Header{Channel: 1},
+			Body:   &frames.PerformAttach{Handle: 0, Role: encoding.RoleSender, Target: &frames.Target{Address: "slow"}},
+		},
+	}))
+
+	// the CLOSE isn't shaped, but it still waits for the other session's frames.
+	require.True(t, s.Queue(true, &MetaFrame{Action: MetaFrameActionAdded, Description: "close", Frame: &frames.Frame{Body: &frames.PerformClose{}}}))
+
+	require.Equal(t, "attach", <-sent)
+	require.Equal(t, "close", <-sent)
+
+	// with nothing queued, it's sent immediately.
+	require.False(t, s.Queue(true, &MetaFrame{Action: MetaFrameActionAdded, Description: "close", Frame: &frames.Frame{Body: &frames.PerformClose{}}}))
+}
+
+func TestShaper_QueueLimit(t *testing.T) {
+	s := newShaper(ShapingOptions{Out: &DirectionShaping{Latency: 300 * time.Millisecond}, QueueLimit: 2}, func(out bool, metaFrame *MetaFrame) error {
+		return nil
+	})
+	defer s.Close()
+
+	flow := func() *MetaFrame {
+		return &MetaFrame{Action: MetaFrameActionAdded, Frame: &frames.Frame{Body: &frames.PerformFlow{}}}
+	}
+
+	require.True(t, s.Queue(true, flow()))
+
+	// there's still room.
+	start := time.Now()
+	s.Wait(context.Background(), true)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	require.True(t, s.Queue(true, flow()))
+
+	// the other direction isn't affected.
+	s.Wait(context.Background(), false)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Wait(ctx, true)
+	require.Less(t, time.Since(start), 100*time.Millisecond)
+
+	// the queue's full, until the first frame's sent.
+	s.Wait(context.Background(), true)
+	require.GreaterOrEqual(t, time.Since(start), 250*time.Millisecond)
+}
+
+func TestShaping_Validate(t *testing.T) {
+	require.NoError(t, (&ShapingOptions{}).Validate())
+	require.NoError(t, (&ShapingOptions{In: &DirectionShaping{Jitter: time.Second, JitterDistribution: JitterDistributionNormal}}).Validate())
+
+	require.Error(t, (&ShapingOptions{Address: "["}).Validate())
+	require.Error(t, (&ShapingOptions{QueueLimit: -1}).Validate())
+	require.Error(t, (&ShapingOptions{Out: &DirectionShaping{Latency: -time.Second}}).Validate())
+	require.Error(t, (&ShapingOptions{Out: &DirectionShaping{JitterDistribution: "pareto"}}).Validate())
+}
+
+func TestShaperLatency(t *testing.T) {
+	s := newShaper(ShapingOptions{Seed: 1}, nil)
+
+	uniform := &DirectionShaping{Latency: 100 * time.Millisecond, Jitter: 50 * time.Millisecond}
+	normal := &DirectionShaping{Latency: 10 * time.Millisecond, Jitter: 50 * time.Millisecond, JitterDistribution: JitterDistributionNormal}
+
+	for range 1000 {
+		latency := s.latency(uniform)
+		require.GreaterOrEqual(t, latency, 50*time.Millisecond)
+		require.LessOrEqual(t, latency, 150*time.Millisecond)
+
+		require.GreaterOrEqual(t, s.latency(normal), time.Duration(0))
+	}
+
+	require.Equal(t, time.Second, s.latency(&DirectionShaping{Latency: time.Second}))
+}
+
+func TestTokenBucket(t *testing.T) {
+	t.Run("no burst", func(t *testing.T) {
+		tb := newTokenBucket(1000, 0)
+		now := tb.last
+
+		require.Equal(t, now.Add(500*time.Millisecond), tb.Reserve(now, 500))
+		require.Equal(t, now.Add(time.Second), tb.Reserve(now, 500))
+
+		// the debt's been paid off, and there's no burst, so the next frame waits for its own bytes.
+		now = now.Add(2 * time.Second)
+		require.Equal(t, now.Add(100*time.Millisecond), tb.Reserve(now, 100))
+	})
+
+	t.Run("burst", func(t *testing.T) {
+		tb := newTokenBucket(1000, 1000)
+		now := tb.last
+
+		require.Equal(t, now, tb.Reserve(now, 600))
+		require.Equal(t, now.Add(200*time.Millisecond), tb.Reserve(now, 600))
+
+		// the bucket fills back up, but never past the burst size.
+		now = now.Add(10 * time.Second)
+		require.Equal(t, now, tb.Reserve(now, 1000))
+		require.Equal(t, now.Add(time.Millisecond), tb.Reserve(now, 1))
+	})
+}
+
+// waitForMessagesForTest waits until the broker's queue has count messages, and returns them.
+func waitForMessagesForTest(t *testing.T, b *broker.Broker, queue string, count int) []*models.Message {
+	var messages []*models.Message
+
+	require.Eventually(t, func() bool {
+		var err error
+		messages, err = b.Messages(queue)
+		return err == nil && len(messages) == count
+	}, 10*time.Second, 10*time.Millisecond)
+
+	return messages
+}
+
+func passthroughCallbackForTest(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	return passthrough(params), nil
+}
+
+// queueLenForTest is the length of the longest queue, for frames going in the out direction.
+func (s *shaper) queueLenForTest(out bool) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := 0
+
+	for key, q := range s.queues {
+		if key.Out == out {
+			n = max(n, len(q.items))
+		}
+	}
+
+	return n
+}
@@ -0,0 +1,207 @@
+package faultinjectors
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// minMaxFrameSize is the smallest max-frame-size a peer is allowed to advertise (MIN-MAX-FRAME-SIZE, in the spec).
+const minMaxFrameSize = 512
+
+type SizeLimitInjectorOptions struct {
+	// MaxFrameSize, if set, replaces the max-frame-size in the service's OPEN, if it's smaller than the service's.
+	// It must be at least 512. TRANSFER frames from the client that are bigger than this are split, so they fit,
+	// and the transfer-ids in the session's FLOW frames are adjusted for the extra frames.
+	MaxFrameSize uint32
+
+	// MaxMessageSize, if set, replaces the max-message-size in the service's ATTACH, if it's smaller than the
+	// service's.
+	MaxMessageSize uint64
+
+	// Address, if set, only changes the max-message-size for links with an address that matches this glob (see
+	// [path.Match]). If it's empty, all links are changed, apart from $cbs and $management links.
+	Address string
+
+	// RejectOversizedMessages detaches links, with an amqp:link:message-size-exceeded error, when the client sends
+	// a message that's bigger than MaxMessageSize, like the service would. The message isn't sent to the service.
+	RejectOversizedMessages bool
+}
+
+// NewSizeLimitInjector creates an injector that shrinks the frame, and message, size limits the service
+// advertises. Useful for checking that clients honor the limits they've negotiated, and split frames properly.
+func NewSizeLimitInjector(options SizeLimitInjectorOptions) *SizeLimitInjector {
+	if options.MaxFrameSize == 0 && options.MaxMessageSize == 0 {
+		utils.Panicf("at least one of MaxFrameSize or MaxMessageSize must be set")
+	}
+
+	if options.MaxFrameSize != 0 && options.MaxFrameSize < minMaxFrameSize {
+		utils.Panicf("MaxFrameSize must be at least %d", minMaxFrameSize)
+	}
+
+	if options.RejectOversizedMessages && options.MaxMessageSize == 0 {
+		utils.Panicf("MaxMessageSize must be set, to reject oversized messages")
+	}
+
+	if _, err := path.Match(options.Address, ""); err != nil {
+		utils.Panicf("invalid glob %q: %w", options.Address, err)
+	}
+
+	return &SizeLimitInjector{
+		options:     options,
+		sizes:       map[linkID]uint64{},
+		terminator:  newTerminator(),
+		transferIDs: newTransferIDShifter(),
+	}
+}
+
+type SizeLimitInjector struct {
+	options     SizeLimitInjectorOptions
+	terminator  *terminator
+	transferIDs *transferIDShifter
+
+	mu sync.Mutex
+
+	// sizes are the number of bytes the client has sent, so far, for the delivery it's in the middle of
+	// sending, keyed by the client's channel and handle.
+	sizes map[linkID]uint64
+}
+
+func (inj *SizeLimitInjector) Callback(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	triggersAllowed := TriggersAllowed(ctx)
+
+	if metaFrames, handled := inj.terminator.Intercept(ctx, params); handled {
+		return metaFrames, nil
+	}
+
+	if inj.transferIDs.Intercept(params) {
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "adjusted for split, or rejected, frames"}}, nil
+	}
+
+	if !triggersAllowed {
+		return passthrough(params), nil
+	}
+
+	logger := logging.SloggerFromContext(ctx)
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformOpen:
+		if params.Out || inj.options.MaxFrameSize == 0 || body.MaxFrameSize <= inj.options.MaxFrameSize {
+			return passthrough(params), nil
+		}
+
+		logger.Info("Reducing max frame size", "maxFrameSize", body.MaxFrameSize, "newMaxFrameSize", inj.options.MaxFrameSize)
+		body.MaxFrameSize = inj.options.MaxFrameSize
+
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "reducing max frame size"}}, nil
+	case *frames.PerformAttach:
+		if params.Out || !inj.limitsMessages(params) || (body.MaxMessageSize != 0 && body.MaxMessageSize <= inj.options.MaxMessageSize) {
+			return passthrough(params), nil
+		}
+
+		logger.Info("Reducing max message size", "address", params.Address(), "maxMessageSize", body.MaxMessageSize, "newMaxMessageSize", inj.options.MaxMessageSize)
+		body.MaxMessageSize = inj.options.MaxMessageSize
+
+		return []MetaFrame{{Action: MetaFrameActionModified, Frame: params.Frame, Description: "reducing max message size"}}, nil
+	case *frames.PerformTransfer:
+		if !params.Out {
+			return passthrough(params), nil
+		}
+
+		if metaFrames, rejected := inj.rejectOversized(ctx, params, body); rejected {
+			return metaFrames, nil
+		}
+
+		return inj.fitFrame(ctx, params)
+	default:
+		return passthrough(params), nil
+	}
+}
+
+// limitsMessages is true if the link, for the current frame, should have its max message size reduced.
+func (inj *SizeLimitInjector) limitsMessages(params MirrorCallbackParams) bool {
+	return inj.options.MaxMessageSize != 0 && deliveryAddressMatches(inj.options.Address, params)
+}
+
+// rejectOversized detaches the link, if the delivery the client's sending has gone over the max message size.
+func (inj *SizeLimitInjector) rejectOversized(ctx context.Context, params MirrorCallbackParams, transferBody *frames.PerformTransfer) ([]MetaFrame, bool) {
+	if !inj.options.RejectOversizedMessages || !inj.limitsMessages(params) {
+		return nil, false
+	}
+
+	inj.mu.Lock()
+	defer inj.mu.Unlock()
+
+	id := linkID{params.Channel(), transferBody.Handle}
+	size := inj.sizes[id] + uint64(len(transferBody.Payload))
+
+	if transferBody.More && !transferBody.Aborted {
+		inj.sizes[id] = size
+	} else {
+		delete(inj.sizes, id)
+	}
+
+	if size <= inj.options.MaxMessageSize || transferBody.Aborted {
+		return nil, false
+	}
+
+	delete(inj.sizes, id)
+
+	logging.SloggerFromContext(ctx).Info("Rejecting oversized message", "address", params.Address(), "size", size, "maxMessageSize", inj.options.MaxMessageSize)
+	inj.transferIDs.Sent(params, 1, 0)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "rejecting oversized message"},
+		inj.terminator.Detach(params.Channel(), transferBody.Handle, &encoding.Error{
+			Condition:   proto.ErrCondMessageSizeExceeded,
+			Description: fmt.Sprintf("message is bigger than the max message size of %d bytes", inj.options.MaxMessageSize),
+		}, 0),
+	}, true
+}
+
+// fitFrame splits a TRANSFER frame from the client, if it's bigger than the service's (reduced) max frame size.
+func (inj *SizeLimitInjector) fitFrame(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+	frameSize := maxFrameSize(params)
+
+	if inj.options.MaxFrameSize != 0 {
+		frameSize = min(frameSize, inj.options.MaxFrameSize)
+	}
+
+	raw, err := params.Frame.MarshalAMQP()
+
+	if err != nil {
+		return nil, err
+	}
+
+	if len(raw) <= int(frameSize) {
+		return passthrough(params), nil
+	}
+
+	transferBody := params.Frame.Body.(*frames.PerformTransfer)
+	split, err := splitTransfer(params.Frame, transferBody.Payload, 1, frameSize)
+
+	if err != nil {
+		return nil, err
+	}
+
+	// the delivery carries on after this frame, if the original frame said it did.
+	split[len(split)-1].Body.(*frames.PerformTransfer).More = transferBody.More
+
+	logging.SloggerFromContext(ctx).Warn("Client sent a frame bigger than the max frame size, splitting it", "size", len(raw), "maxFrameSize", frameSize, "newFrames", len(split))
+
+	var metaFrames []MetaFrame
+
+	for _, fr := range split {
+		metaFrames = append(metaFrames, MetaFrame{Action: MetaFrameActionModified, Frame: fr, Description: "splitting oversized frame"})
+	}
+
+	inj.transferIDs.Sent(params, 1, len(split))
+	return metaFrames, nil
+}
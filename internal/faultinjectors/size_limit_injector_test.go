@@ -0,0 +1,179 @@
+package faultinjectors
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Azure/go-amqp"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/testhelpers"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSizeLimitInjector_MaxFrameSize(t *testing.T) {
+	for _, honorsLimit := range []bool{true, false} {
+		name := "client honors limit"
+
+		if !honorsLimit {
+			name = "client ignores limit"
+		}
+
+		t.Run(name, func(t *testing.T) {
+			broker := testhelpers.NewBrokerForTest(t, nil)
+			sizes := &frameSizesForTest{}
+
+			fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+				injector := NewSizeLimitInjector(SizeLimitInjectorOptions{MaxFrameSize: 1024})
+
+				return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+					if honorsLimit && params.Out && params.Type() == frames.BodyTypeTransfer {
+						require.LessOrEqual(t, len(params.Frame.Raw()), 1024)
+					}
+
+					metaFrames, err := injector.Callback(ctx, params)
+
+					if openBody, isOpen := params.Frame.Body.(*frames.PerformOpen); isOpen && !params.Out {
+						require.Equal(t, uint32(1024), openBody.MaxFrameSize)
+
+						if !honorsLimit {
+							// the client never finds out about the limit, but the injector still enforces it.
+							openBody.MaxFrameSize = 65536
+						}
+					}
+
+					sizes.Add(t, params.Out, metaFrames)
+					return metaFrames, err
+				}
+			}, nil)
+
+			session := newSessionForTest(t, fi.ListenAddr())
+
+			sender, err := session.NewSender(context.Background(), "queue", nil)
+			require.NoError(t, err)
+
+			body := strings.Repeat("0123456789", 500)
+			require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte(body)), nil))
+
+			messages, err := broker.Messages("queue")
+			require.NoError(t, err)
+			require.Equal(t, 1, len(messages))
+			require.Equal(t, body, string(messages[0].GetData()))
+
+			require.Greater(t, sizes.Transfers(), 4)
+			require.LessOrEqual(t, sizes.Max(), 1024)
+		})
+	}
+}
+
+func TestSizeLimitInjector_MaxMessageSize(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewSizeLimitInjector(SizeLimitInjectorOptions{MaxMessageSize: 1000, Address: "queue"})
+		return injector.Callback
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(1000), sender.MaxMessageSize())
+
+	// the client checks the limit itself, before sending anything.
+	err = sender.Send(context.Background(), amqp.NewMessage([]byte(strings.Repeat("0123456789", 200))), nil)
+
+	var amqpErr *amqp.Error
+	require.ErrorAs(t, err, &amqpErr)
+	require.Equal(t, amqp.ErrCondMessageSizeExceeded, amqpErr.Condition)
+
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+
+	// other links are left alone.
+	otherSender, err := session.NewSender(context.Background(), "other queue", nil)
+	require.NoError(t, err)
+	require.Equal(t, uint64(0), otherSender.MaxMessageSize())
+}
+
+func TestSizeLimitInjector_RejectOversizedMessages(t *testing.T) {
+	broker := testhelpers.NewBrokerForTest(t, nil)
+
+	fi := newFaultInjectorWithFactoryForTest(t, broker.ListenAddr(), func(connInfo ConnInfo) MirrorCallback {
+		injector := NewSizeLimitInjector(SizeLimitInjectorOptions{MaxMessageSize: 1000, RejectOversizedMessages: true})
+
+		return func(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, error) {
+			metaFrames, err := injector.Callback(ctx, params)
+
+			if attachBody, isAttach := params.Frame.Body.(*frames.PerformAttach); isAttach && !params.Out {
+				// the client never finds out about the limit, so it sends the message anyways.
+				attachBody.MaxMessageSize = 0
+			}
+
+			return metaFrames, err
+		}
+	}, nil)
+
+	session := newSessionForTest(t, fi.ListenAddr())
+
+	sender, err := session.NewSender(context.Background(), "queue", nil)
+	require.NoError(t, err)
+
+	require.NoError(t, sender.Send(context.Background(), amqp.NewMessage([]byte("hello")), nil))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	err = sender.Send(ctx, amqp.NewMessage([]byte(strings.Repeat("0123456789", 200))), nil)
+
+	var linkErr *amqp.LinkError
+	require.ErrorAs(t, err, &linkErr)
+	require.Equal(t, amqp.ErrCondMessageSizeExceeded, linkErr.RemoteErr.Condition)
+
+	// only the small message got to the service.
+	messages, err := broker.Messages("queue")
+	require.NoError(t, err)
+	require.Equal(t, 1, len(messages))
+	require.Equal(t, "hello", string(messages[0].GetData()))
+
+	require.False(t, errors.Is(err, context.DeadlineExceeded))
+}
+
+// frameSizesForTest tracks the TRANSFER frames a callback sends to the service.
+type frameSizesForTest struct {
+	mu    sync.Mutex
+	sizes []int
+}
+
+func (fs *frameSizesForTest) Add(t *testing.T, out bool, metaFrames []MetaFrame) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	for _, mf := range metaFrames {
+		if !out || mf.Action == MetaFrameActionDropped || mf.Frame.Body.Type() != frames.BodyTypeTransfer {
+			continue
+		}
+
+		raw, err := mf.Frame.MarshalAMQP()
+		require.NoError(t, err)
+
+		fs.sizes = append(fs.sizes, len(raw))
+	}
+}
+
+func (fs *frameSizesForTest) Transfers() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return len(fs.sizes)
+}
+
+func (fs *frameSizesForTest) Max() int {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+
+	return max(0, slices.Max(fs.sizes))
+}
@@ -13,6 +13,9 @@ import (
 // NewSlowTransfersInjector creates a SlowTransferFrames injector, which slows down any incoming
 // TRANSFER frames, to non-cbs/non-management links.
 //   - delayForFrame controls how long we hold onto a TRANSFER frame, before forwarding the frame to the Receiver.
+//
+// NOTE: the delay blocks every frame from the service, while it's waiting. To slow down a link, without blocking
+// the rest of the connection, use [FaultInjectorOptions.Shaping] instead.
 func NewSlowTransfersInjector(delayForFrame time.Duration) *SlowTransfersInjector {
 	return &SlowTransfersInjector{
 		delayForFrame: delayForFrame,
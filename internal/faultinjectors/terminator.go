@@ -0,0 +1,232 @@
+package faultinjectors
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/logging"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// terminator detaches links, ends sessions or closes connections, and makes it look, to the client,
+// like the service initiated it, with an error.
+//
+// It works by sending the DETACH/END/CLOSE to the service, as if the client sent it. When the service
+// replies we add our error, and forward it to the client, which sees a service initiated DETACH/END/CLOSE.
+// The client's reply is dropped, since the service already considers it done, as is anything else the
+// client sends on that link/session/connection in the meantime.
+//
+// Call [terminator.Intercept] at the start of your callback, for every frame, so it can do this bookkeeping.
+type terminator struct {
+	mu sync.Mutex
+
+	// links, keyed by the client's channel and handle.
+	links map[linkID]*termination
+
+	// sessions, keyed by the client's channel.
+	sessions map[uint16]*termination
+
+	conn *termination
+}
+
+type linkID struct {
+	Channel uint16
+	Handle  uint32
+}
+
+type termination struct {
+	err *encoding.Error
+
+	// startsAt is when the DETACH/END/CLOSE is sent, to the service. Until then the client's frames
+	// are passed through, as normal.
+	startsAt time.Time
+
+	// serviceReplied is true once the service has replied, and we've forwarded that reply to the client.
+	serviceReplied bool
+
+	// clientReplied is true once the client has sent its DETACH/END/CLOSE. This is usually the client's
+	// reply, but it can also be the client detaching (or ending, or closing) on its own, before the service
+	// has replied to us.
+	clientReplied bool
+
+	// forget removes this termination, once both sides have replied.
+	forget func()
+}
+
+func newTermination(err *encoding.Error, delay time.Duration, forget func()) *termination {
+	return &termination{err: err, startsAt: time.Now().Add(delay), forget: forget}
+}
+
+// started is true once the DETACH/END/CLOSE has been sent, to the service.
+func (term *termination) started() bool {
+	return !time.Now().Before(term.startsAt)
+}
+
+// reply records a reply from either the client, or the service. Once both have replied, the termination
+// is complete.
+func (term *termination) reply(fromService bool) {
+	if fromService {
+		term.serviceReplied = true
+	} else {
+		term.clientReplied = true
+	}
+
+	if term.serviceReplied && term.clientReplied {
+		term.forget()
+	}
+}
+
+func newTerminator() *terminator {
+	return &terminator{
+		links:    map[linkID]*termination{},
+		sessions: map[uint16]*termination{},
+	}
+}
+
+// Detach starts detaching a link. The returned MetaFrame should be sent, as part of your callback's result.
+//   - channel and handle are the client's channel and handle for the link.
+//   - delay is how long to wait before detaching.
+func (t *terminator) Detach(channel uint16, handle uint32, err *encoding.Error, delay time.Duration) MetaFrame {
+	id := linkID{channel, handle}
+
+	t.mu.Lock()
+	t.links[id] = newTermination(err, delay, func() { delete(t.links, id) })
+	t.mu.Unlock()
+
+	return MetaFrame{
+		Action:      MetaFrameActionAdded,
+		Delay:       delay,
+		OverrideOut: utils.Ptr(true),
+		Frame: &frames.Frame{
+			Header: frames.Header{Channel: channel},
+			Body:   &frames.PerformDetach{Handle: handle, Closed: true},
+		},
+		Description: "Detaching link",
+	}
+}
+
+// End starts ending a session. The returned MetaFrame should be sent, as part of your callback's result.
+//   - channel is the client's channel for the session.
+//   - delay is how long to wait before ending the session.
+func (t *terminator) End(channel uint16, err *encoding.Error, delay time.Duration) MetaFrame {
+	t.mu.Lock()
+	t.sessions[channel] = newTermination(err, delay, func() { delete(t.sessions, channel) })
+	t.mu.Unlock()
+
+	return MetaFrame{
+		Action:      MetaFrameActionAdded,
+		Delay:       delay,
+		OverrideOut: utils.Ptr(true),
+		Frame: &frames.Frame{
+			Header: frames.Header{Channel: channel},
+			Body:   &frames.PerformEnd{},
+		},
+		Description: "Ending session",
+	}
+}
+
+// Close starts closing the connection. The returned MetaFrame should be sent, as part of your callback's result.
+//   - delay is how long to wait before closing the connection.
+func (t *terminator) Close(err *encoding.Error, delay time.Duration) MetaFrame {
+	t.mu.Lock()
+	// NOTE: we never forget a closed connection - there's nothing useful the client can send after this.
+	t.conn = newTermination(err, delay, func() {})
+	t.mu.Unlock()
+
+	return MetaFrame{
+		Action:      MetaFrameActionAdded,
+		Delay:       delay,
+		OverrideOut: utils.Ptr(true),
+		Frame: &frames.Frame{
+			Body: &frames.PerformClose{},
+		},
+		Description: "Closing connection",
+	}
+}
+
+// Intercept handles frames for links, sessions or connections that are being terminated. If it returns
+// true, the frame's been handled, and the returned MetaFrames should be used as your callback's result.
+func (t *terminator) Intercept(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if params.Out {
+		return t.interceptOutbound(ctx, params)
+	}
+
+	return t.interceptInbound(ctx, params)
+}
+
+func (t *terminator) interceptOutbound(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, bool) {
+	if _, isEmpty := params.Frame.Body.(*frames.EmptyFrame); isEmpty {
+		return nil, false
+	}
+
+	if t.conn != nil && t.conn.started() {
+		return t.drop(ctx, params, t.conn, frames.BodyTypeClose), true
+	}
+
+	if term := t.sessions[params.Channel()]; term != nil && term.started() {
+		return t.drop(ctx, params, term, frames.BodyTypeEnd), true
+	}
+
+	if params.Handle() == nil {
+		return nil, false
+	}
+
+	if term := t.links[linkID{params.Channel(), *params.Handle()}]; term != nil && term.started() {
+		return t.drop(ctx, params, term, frames.BodyTypeDetach), true
+	}
+
+	return nil, false
+}
+
+// drop drops a client frame for a link/session/connection that's being terminated. If it's the client's
+// DETACH/END/CLOSE we record it, so we know when the termination is complete.
+func (t *terminator) drop(ctx context.Context, params MirrorCallbackParams, term *termination, replyType frames.BodyType) []MetaFrame {
+	slogger := logging.SloggerFromContext(ctx)
+
+	if params.Type() == replyType {
+		slogger.Info("Absorbing client's reply", "type", params.Type(), "channel", params.Channel())
+		term.reply(false)
+
+		return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "Absorbing client's reply"}}
+	}
+
+	slogger.Debug("Dropping client frame, it's being terminated", "type", params.Type(), "channel", params.Channel())
+	return []MetaFrame{{Action: MetaFrameActionDropped, Frame: params.Frame, Description: "Dropping frame, it's being terminated"}}
+}
+
+func (t *terminator) interceptInbound(ctx context.Context, params MirrorCallbackParams) ([]MetaFrame, bool) {
+	var term *termination
+	var errField **encoding.Error
+
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformClose:
+		term, errField = t.conn, &body.Error
+	case *frames.PerformEnd:
+		if localChannel := params.StateMap.LookupCorrespondingChannel(false, params.Channel()); localChannel != nil {
+			term, errField = t.sessions[*localChannel], &body.Error
+		}
+	case *frames.PerformDetach:
+		if localAttach := params.StateMap.LookupCorrespondingAttachFrame(false, params.Channel(), body.Handle); localAttach != nil {
+			term, errField = t.links[linkID{localAttach.Header.Channel, localAttach.Body.Handle}], &body.Error
+		}
+	}
+
+	if term == nil || !term.started() || term.serviceReplied {
+		return nil, false
+	}
+
+	*errField = term.err
+	term.reply(true)
+
+	logging.SloggerFromContext(ctx).Info("Adding error to service's reply", "type", params.Type(), "error", term.err)
+
+	return []MetaFrame{
+		{Action: MetaFrameActionModified, Frame: params.Frame, Description: "Adding error to service's reply"},
+	}, true
+}
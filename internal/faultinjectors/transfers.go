@@ -0,0 +1,237 @@
+package faultinjectors
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+// maxFrameSize is the largest frame we can send in the same direction as params.Frame. It's the max-frame-size
+// from the receiving peer's OPEN frame.
+func maxFrameSize(params MirrorCallbackParams) uint32 {
+	// outbound frames go to the service, so they're limited by the service's OPEN, and vice versa.
+	if openFrame := params.StateMap.GetOpenFrame(!params.Out); openFrame != nil {
+		return openFrame.Body.MaxFrameSize
+	}
+
+	return math.MaxUint32
+}
+
+// deliveryAddressMatches checks if a delivery's link address matches glob. If glob is empty, every link matches,
+// apart from $cbs and $management links.
+func deliveryAddressMatches(glob string, params MirrorCallbackParams) bool {
+	if glob == "" {
+		return !params.ManagementOrCBS()
+	}
+
+	return globMatches(glob, params.Address())
+}
+
+// transferAssembler holds onto the TRANSFER frames for a delivery, until it has all of them.
+type transferAssembler struct {
+	mu sync.Mutex
+
+	// pending are the frames we have so far, for deliveries that are split across multiple TRANSFER frames.
+	pending map[transferKey][]*frames.Frame
+}
+
+type transferKey struct {
+	Out bool
+	linkID
+}
+
+func newTransferAssembler() *transferAssembler {
+	return &transferAssembler{pending: map[transferKey][]*frames.Frame{}}
+}
+
+// Add adds a TRANSFER frame. Once the delivery's last frame has been added, all of its frames are returned,
+// otherwise it returns nil.
+//
+// NOTE: an aborted delivery's frames are returned too, once the aborted frame has been added.
+func (ta *transferAssembler) Add(params MirrorCallbackParams, transferBody *frames.PerformTransfer) []*frames.Frame {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	key := transferKey{Out: params.Out, linkID: linkID{params.Channel(), transferBody.Handle}}
+	delivery := append(ta.pending[key], params.Frame)
+
+	if transferBody.More && !transferBody.Aborted {
+		ta.pending[key] = delivery
+		return nil
+	}
+
+	delete(ta.pending, key)
+	return delivery
+}
+
+// Holding is true if the assembler has some, but not all, of the TRANSFER frames for the link's current delivery.
+func (ta *transferAssembler) Holding(params MirrorCallbackParams, transferBody *frames.PerformTransfer) bool {
+	ta.mu.Lock()
+	defer ta.mu.Unlock()
+
+	_, holding := ta.pending[transferKey{Out: params.Out, linkID: linkID{params.Channel(), transferBody.Handle}}]
+	return holding
+}
+
+// transferPayload is the payload for a delivery, from all of its TRANSFER frames.
+func transferPayload(delivery []*frames.Frame) []byte {
+	var payload []byte
+
+	for _, fr := range delivery {
+		payload = append(payload, fr.Body.(*frames.PerformTransfer).Payload...)
+	}
+
+	return payload
+}
+
+// splitTransfer splits payload across TRANSFER frames, for a delivery that starts with first. The first frame
+// has all of first's fields, and the rest just have the handle, and whether it's settled.
+//
+// The payload is split evenly across minFrames frames, so a delivery can keep the same number of frames (and,
+// with it, the session's transfer-ids), unless it needs more to keep each frame within maxFrameSize. If the number
+// of frames changes, record it with a [transferIDShifter].
+func splitTransfer(first *frames.Frame, payload []byte, minFrames int, maxFrameSize uint32) ([]*frames.Frame, error) {
+	firstBody := *first.Body.(*frames.PerformTransfer)
+	firstBody.Payload = nil
+	firstBody.More = false
+
+	overhead, err := (frames.Frame{Header: first.Header, Body: &firstBody}).MarshalAMQP()
+
+	if err != nil {
+		return nil, err
+	}
+
+	// a little extra room, since the encoding for the payload's size varies based on its length.
+	room := int(min(maxFrameSize, math.MaxInt32)) - len(overhead) - 8
+
+	if room <= 0 {
+		return nil, fmt.Errorf("max frame size %d is too small to send a TRANSFER", maxFrameSize)
+	}
+
+	count := max(minFrames, 1, (len(payload)+room-1)/room)
+	chunkSize := (len(payload) + count - 1) / count
+
+	var delivery []*frames.Frame
+
+	for i := range count {
+		body := &frames.PerformTransfer{Handle: firstBody.Handle, Settled: firstBody.Settled}
+
+		if i == 0 {
+			body = &firstBody
+		}
+
+		chunk := payload[min(i*chunkSize, len(payload)):min((i+1)*chunkSize, len(payload))]
+
+		body.Payload = chunk
+		body.More = i < count-1
+
+		delivery = append(delivery, &frames.Frame{
+			Header: frames.Header{FrameType: first.Header.FrameType, Channel: first.Header.Channel},
+			Body:   body,
+		})
+	}
+
+	return delivery, nil
+}
+
+// transferIDShifter keeps each session's transfer-ids in sync, for injectors that send a different number of
+// TRANSFER frames than the sending peer did (ex: by re-splitting a delivery). Each peer counts the TRANSFER frames it
+// sends, and receives, in the next-outgoing-id and next-incoming-id of its FLOW frames, so we shift those by the
+// difference.
+//
+// NOTE: the receiving peer's incoming-window isn't adjusted. A sender that fills the window can cause a
+// window-violation, if we've sent the receiver more frames than the sender did.
+type transferIDShifter struct {
+	mu sync.Mutex
+
+	// shifts are how many more TRANSFER frames we've sent than the sending peer did, keyed by the direction they
+	// were sent in, and the client's channel for the session. Like transfer-ids, they wrap.
+	shifts map[sessionDirection]uint32
+}
+
+type sessionDirection struct {
+	Out     bool
+	Channel uint16
+}
+
+func newTransferIDShifter() *transferIDShifter {
+	return &transferIDShifter{shifts: map[sessionDirection]uint32{}}
+}
+
+// Sent records that we've sent sent TRANSFER frames, in params.Frame's direction, in place of the received frames
+// from the peer.
+func (s *transferIDShifter) Sent(params MirrorCallbackParams, received int, sent int) {
+	if received == sent {
+		return
+	}
+
+	channel := clientChannel(params)
+
+	if channel == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sessionDirection{Out: params.Out, Channel: *channel}
+	s.shifts[key] += uint32(sent) - uint32(received)
+
+	if s.shifts[key] == 0 {
+		delete(s.shifts, key)
+	}
+}
+
+// Intercept shifts the transfer-ids in FLOW frames, and forgets sessions once the client ends them. If it returns
+// true the frame's been modified, and should be sent as a [MetaFrameActionModified].
+func (s *transferIDShifter) Intercept(params MirrorCallbackParams) bool {
+	switch body := params.Frame.Body.(type) {
+	case *frames.PerformFlow:
+		channel := clientChannel(params)
+
+		if channel == nil {
+			return false
+		}
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+
+		// the peer's next-incoming-id counts the frames sent to it, and its next-outgoing-id counts the frames it
+		// sent, before we changed them.
+		incoming := s.shifts[sessionDirection{Out: !params.Out, Channel: *channel}]
+		outgoing := s.shifts[sessionDirection{Out: params.Out, Channel: *channel}]
+
+		if incoming == 0 && outgoing == 0 {
+			return false
+		}
+
+		if body.NextIncomingID != nil {
+			body.NextIncomingID = utils.Ptr(*body.NextIncomingID - incoming)
+		}
+
+		body.NextOutgoingID += outgoing
+		return true
+	case *frames.PerformEnd:
+		if params.Out {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+
+			delete(s.shifts, sessionDirection{Out: true, Channel: params.Channel()})
+			delete(s.shifts, sessionDirection{Out: false, Channel: params.Channel()})
+		}
+	}
+
+	return false
+}
+
+// clientChannel is the client's channel, for the session params.Frame belongs to, or nil if the session isn't known.
+func clientChannel(params MirrorCallbackParams) *uint16 {
+	if params.Out {
+		return utils.Ptr(params.Channel())
+	}
+
+	return params.StateMap.LookupCorrespondingChannel(false, params.Channel())
+}
@@ -1,6 +1,7 @@
 package faultinjectors
 
 import (
+	"fmt"
 	"time"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
@@ -20,8 +21,53 @@ const (
 
 	// MetaFrameActionDropped indicates the frame should be logged, but should not be sent to the client/server.
 	MetaFrameActionDropped = MetaFrameAction("dropped")
+
+	// MetaFrameActionDisconnect indicates the underlying connections should be terminated, without an AMQP CLOSE,
+	// as described by [MetaFrame.Disconnect]. Frame is optional - if it's set it's logged, but not sent.
+	//
+	// Once a connection is disconnected nothing else is mirrored, in either direction.
+	MetaFrameActionDisconnect = MetaFrameAction("disconnect")
 )
 
+// DisconnectMode is how a connection is terminated, for [MetaFrameActionDisconnect].
+type DisconnectMode string
+
+const (
+	// DisconnectModeNone leaves the connection open, but nothing more is sent to it and anything it sends
+	// is discarded, like a network drop. The connection stays open until the peer gives up and closes it.
+	DisconnectModeNone = DisconnectMode("")
+
+	// DisconnectModeClose closes the TCP connection, so the peer reads an EOF.
+	DisconnectModeClose = DisconnectMode("close")
+
+	// DisconnectModeReset resets the TCP connection, so the peer gets a connection reset (RST).
+	DisconnectModeReset = DisconnectMode("reset")
+
+	// DisconnectModeHalfClose shuts down our sending side of the TCP connection, so the peer reads an EOF.
+	// Anything it sends is discarded, until it closes the connection.
+	DisconnectModeHalfClose = DisconnectMode("halfclose")
+)
+
+// Disconnect is how the local (client) and remote (service) connections are terminated, for
+// [MetaFrameActionDisconnect].
+type Disconnect struct {
+	Local  DisconnectMode `json:",omitempty"`
+	Remote DisconnectMode `json:",omitempty"`
+}
+
+// Validate checks that both modes are valid.
+func (d Disconnect) Validate() error {
+	for _, mode := range []DisconnectMode{d.Local, d.Remote} {
+		switch mode {
+		case DisconnectModeNone, DisconnectModeClose, DisconnectModeReset, DisconnectModeHalfClose:
+		default:
+			return fmt.Errorf("invalid disconnect mode %q, must be one of reset, close, halfclose or empty", mode)
+		}
+	}
+
+	return nil
+}
+
 // MetaFrame adds some metadata about the frame, as well as providing overrides for routing
 // and delaying the send of frames.
 type MetaFrame struct {
@@ -34,7 +80,8 @@ type MetaFrame struct {
 	// The delay here is best-effort.
 	//
 	// If you require absolute ordering, or greater control, you're better off doing that control inside of your
-	// injector's function directly. See the [SlowTransferFrames] injector for an example.
+	// injector's function directly. See the [SlowTransferFrames] injector for an example, and [Mirror] for the
+	// ordering guarantees for frames that aren't delayed.
 	Delay time.Duration `json:",omitempty"`
 
 	// Description is used as metadata in the frame logging file
@@ -43,5 +90,8 @@ type MetaFrame struct {
 	// OverrideOut lets you override the direction to send this frame.
 	OverrideOut *bool `json:",omitempty"`
 
+	// Disconnect is how the connections are terminated, when Action is [MetaFrameActionDisconnect].
+	Disconnect *Disconnect `json:",omitempty"`
+
 	Frame *frames.Frame `json:",omitempty"`
 }
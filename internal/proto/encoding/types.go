@@ -9,6 +9,7 @@ import (
 	"math"
 	"reflect"
 	"strconv"
+	"strings"
 	"time"
 	"unicode/utf8"
 
@@ -508,9 +509,33 @@ type SASLCode uint8
 const (
 	CodeSASLOK      SASLCode = iota // Connection authentication succeeded.
 	CodeSASLAuth                    // Connection authentication failed due to an unspecified problem with the supplied credentials.
+	CodeSASLSys                     // Connection authentication failed due to a system error.
 	CodeSASLSysPerm                 // Connection authentication failed due to a system error that is unlikely to be corrected without intervention.
+	CodeSASLSysTemp                 // Connection authentication failed due to a transient system error.
 )
 
+// saslCodeNames are the names the spec uses for each SASL code.
+var saslCodeNames = []string{"ok", "auth", "sys", "sys-perm", "sys-temp"}
+
+func (s SASLCode) String() string {
+	if int(s) < len(saslCodeNames) {
+		return saslCodeNames[s]
+	}
+
+	return fmt.Sprintf("unknown sasl code %d", uint8(s))
+}
+
+// ParseSASLCode parses the name the spec uses for a SASL code (ex: sys-temp).
+func ParseSASLCode(name string) (SASLCode, error) {
+	for i, codeName := range saslCodeNames {
+		if codeName == name {
+			return SASLCode(i), nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown sasl code %q, must be one of %s", name, strings.Join(saslCodeNames, ", "))
+}
+
 func (s SASLCode) Marshal(wr *buffer.Buffer) error {
 	return Marshal(wr, uint8(s))
 }
@@ -724,10 +749,17 @@ type Error struct {
 }
 
 func (e *Error) Marshal(wr *buffer.Buffer) error {
+	// info is a fields map, so its keys have to be symbols.
+	info := make(mapSymbolAny, len(e.Info))
+
+	for k, v := range e.Info {
+		info[Symbol(k)] = v
+	}
+
 	return MarshalComposite(wr, TypeCodeError, []MarshalField{
 		{Value: &e.Condition, Omit: false},
 		{Value: &e.Description, Omit: e.Description == ""},
-		{Value: e.Info, Omit: len(e.Info) == 0},
+		{Value: info, Omit: len(info) == 0},
 	})
 }
 
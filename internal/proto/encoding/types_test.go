@@ -66,3 +66,30 @@ func TestDecodeSmallInts(t *testing.T) {
 		require.Equal(t, int32(-1), val)
 	})
 }
+
+func TestSASLCode(t *testing.T) {
+	// the codes, in order, from the spec.
+	for i, name := range []string{"ok", "auth", "sys", "sys-perm", "sys-temp"} {
+		code, err := ParseSASLCode(name)
+		require.NoError(t, err)
+		require.Equal(t, SASLCode(i), code)
+		require.Equal(t, name, code.String())
+	}
+
+	require.Equal(t, SASLCode(3), CodeSASLSysPerm)
+	require.Equal(t, "unknown sasl code 5", SASLCode(5).String())
+
+	_, err := ParseSASLCode("bogus")
+	require.Error(t, err)
+}
+
+func TestErrorInfoHasSymbolKeys(t *testing.T) {
+	buff := &buffer.Buffer{}
+	require.NoError(t, (&Error{Condition: "amqp:link:redirect", Info: map[string]any{"hostname": "localhost"}}).Marshal(buff))
+
+	require.Contains(t, string(buff.Bytes()), string(append([]byte{byte(TypeCodeSym8), byte(len("hostname"))}, "hostname"...)))
+
+	unmarshalled := Error{}
+	require.NoError(t, unmarshalled.Unmarshal(buff))
+	require.Equal(t, map[string]any{"hostname": "localhost"}, unmarshalled.Info)
+}
@@ -375,6 +375,54 @@ func (r *RawFrame) Marshal(wr *buffer.Buffer) error {
 	return nil
 }
 
+// ProtocolID identifies the protocol in a [ProtocolHeader].
+type ProtocolID uint8
+
+const (
+	ProtocolIDAMQP ProtocolID = 0x0
+	ProtocolIDTLS  ProtocolID = 0x2
+	ProtocolIDSASL ProtocolID = 0x3
+)
+
+// ProtocolHeader is the protocol header (preamble) that each peer sends, before any frames, to say which
+// protocol, and version, it's using (ex: "AMQP\x03\x01\x00\x00" for SASL, with AMQP 1.0). It isn't
+// really a frame, but it's treated as one so it can be mirrored like one.
+type ProtocolHeader struct {
+	ProtocolID ProtocolID
+	Major      uint8
+	Minor      uint8
+	Revision   uint8
+}
+
+// NewProtocolHeaderFrame creates a pseudo-frame, with a [ProtocolHeader] body, from the protocol header's bytes.
+func NewProtocolHeaderFrame(preamble Preamble) (*Frame, error) {
+	if len(preamble) != 8 || string(preamble[0:4]) != "AMQP" {
+		return nil, fmt.Errorf("invalid protocol header %q", []byte(preamble))
+	}
+
+	return &Frame{
+		raw: preamble,
+		Body: &ProtocolHeader{
+			ProtocolID: ProtocolID(preamble[4]),
+			Major:      preamble[5],
+			Minor:      preamble[6],
+			Revision:   preamble[7],
+		},
+	}, nil
+}
+
+func (ph *ProtocolHeader) frameBody()         {}
+func (ph *ProtocolHeader) Type() BodyType     { return BodyTypeProtocolHeader }
+func (ph *ProtocolHeader) GetHandle() *uint32 { return nil }
+
+func (ph *ProtocolHeader) MarshalAMQP() ([]byte, error) {
+	return []byte{'A', 'M', 'Q', 'P', uint8(ph.ProtocolID), ph.Major, ph.Minor, ph.Revision}, nil
+}
+
+func (ph *ProtocolHeader) String() string {
+	return fmt.Sprintf("ProtocolHeader{ProtocolID: %d, Version: %d.%d.%d}", ph.ProtocolID, ph.Major, ph.Minor, ph.Revision)
+}
+
 /*
 <type name="open" class="composite" source="list" provides="frame">
     <descriptor name="amqp:open:list" code="0x00000000:0x00000010"/>
@@ -719,18 +767,19 @@ func (a *PerformAttach) Type() BodyType     { return BodyTypeAttach }
 func (a *PerformAttach) GetHandle() *uint32 { return &a.Handle }
 
 // Entity returns the underlying target or source for this ATTACH frame.
+// NOTE: the source and target are nil when the link's refused, in which case there's no address.
 func (a *PerformAttach) Address(out bool) (address string) {
 	switch {
-	case out && a.Role == encoding.RoleSender:
+	case out && a.Role == encoding.RoleSender && a.Target != nil:
 		return a.Target.Address
-	case out && a.Role == encoding.RoleReceiver:
+	case out && a.Role == encoding.RoleReceiver && a.Source != nil:
 		return a.Source.Address
 
 	// NOTE: the source and target are reversed when the ATTACH frames
 	// are incoming.
-	case !out && a.Role == encoding.RoleSender:
+	case !out && a.Role == encoding.RoleSender && a.Source != nil:
 		return a.Source.Address
-	case !out && a.Role == encoding.RoleReceiver:
+	case !out && a.Role == encoding.RoleReceiver && a.Target != nil:
 		return a.Target.Address
 	default:
 		return ""
@@ -26,3 +26,38 @@ func TestPerformAttach(t *testing.T) {
 	require.Equal(t, "source-address", fr.Address(true))
 	require.Equal(t, "target-address", fr.Address(false))
 }
+
+func TestPerformAttach_Refused(t *testing.T) {
+	// a refused link's ATTACH has no source or target.
+	for _, role := range []encoding.Role{encoding.RoleSender, encoding.RoleReceiver} {
+		fr := frames.PerformAttach{Role: role}
+
+		require.Empty(t, fr.Address(true))
+		require.Empty(t, fr.Address(false))
+	}
+}
+
+func TestProtocolHeader(t *testing.T) {
+	preamble := frames.Preamble("AMQP\x03\x01\x00\x00")
+
+	fr, err := frames.NewProtocolHeaderFrame(preamble)
+	require.NoError(t, err)
+	require.Equal(t, &frames.ProtocolHeader{ProtocolID: frames.ProtocolIDSASL, Major: 1}, fr.Body)
+	require.Equal(t, []byte(preamble), fr.Raw())
+
+	// protocol headers are sent as-is, without a frame header.
+	fr.Body.(*frames.ProtocolHeader).ProtocolID = frames.ProtocolIDAMQP
+
+	data, err := fr.MarshalAMQP()
+	require.NoError(t, err)
+	require.Equal(t, []byte("AMQP\x00\x01\x00\x00"), data)
+
+	_, err = frames.NewProtocolHeaderFrame(frames.Preamble("HTTP/1.1"))
+	require.Error(t, err)
+}
+
+func TestRawFrame(t *testing.T) {
+	data, err := frames.NewRawFrame([]byte("garbage")).MarshalAMQP()
+	require.NoError(t, err)
+	require.Equal(t, []byte("garbage"), data)
+}
@@ -1,9 +1,12 @@
 package frames
 
 import (
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"iter"
+	"net"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
 )
@@ -95,3 +98,56 @@ func (fc *ConnReadWriter) WriteBytes(data []byte) error {
 	_, err := fc.conn.Write(data)
 	return err
 }
+
+// Close closes the underlying connection, if it implements [io.Closer].
+func (fc *ConnReadWriter) Close() error {
+	if closer, ok := fc.conn.(io.Closer); ok {
+		return closer.Close()
+	}
+
+	return nil
+}
+
+// Reset closes the underlying TCP connection without the normal shutdown, so the peer gets a connection
+// reset (RST) rather than an EOF. For TLS connections, the TLS close_notify is skipped as well.
+func (fc *ConnReadWriter) Reset() error {
+	tcpConn, err := fc.tcpConn()
+
+	if err != nil {
+		return err
+	}
+
+	if err := tcpConn.SetLinger(0); err != nil {
+		return err
+	}
+
+	return tcpConn.Close()
+}
+
+// CloseWrite shuts down the sending side of the underlying TCP connection. The peer reads an EOF, but
+// anything it sends can still be read.
+func (fc *ConnReadWriter) CloseWrite() error {
+	tcpConn, err := fc.tcpConn()
+
+	if err != nil {
+		return err
+	}
+
+	return tcpConn.CloseWrite()
+}
+
+func (fc *ConnReadWriter) tcpConn() (*net.TCPConn, error) {
+	conn := fc.conn
+
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+
+	tcpConn, ok := conn.(*net.TCPConn)
+
+	if !ok {
+		return nil, fmt.Errorf("connection is a %T, not a TCP connection", fc.conn)
+	}
+
+	return tcpConn, nil
+}
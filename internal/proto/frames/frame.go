@@ -30,6 +30,8 @@ const (
 	BodyTypeEmptyFrame = "Empty" // a frame without a body. This is commonly used for AMQP keep-alives.
 	BodyTypeRawFrame   = "Raw"   // a frame that was fabricated. This is primarily useful when attempting to go outside of the AMQP, with full control over the encoded frame.
 
+	BodyTypeProtocolHeader = "ProtocolHeader" // the protocol header (preamble) each peer sends before its first frame, and again after SASL.
+
 	// AMQP frame types
 	BodyTypeAttach      = "Attach"
 	BodyTypeBegin       = "Begin"
@@ -127,6 +129,10 @@ func (fr *Frame) UnmarshalJSON(data []byte) error {
 		if err := unmarshalJSONBody[*EmptyFrame](tmpFrame.Body, &fr.Body); err != nil {
 			return err
 		}
+	case BodyTypeProtocolHeader:
+		if err := unmarshalJSONBody[*ProtocolHeader](tmpFrame.Body, &fr.Body); err != nil {
+			return err
+		}
 	case BodyTypeAttach:
 		if err := unmarshalJSONBody[*PerformAttach](tmpFrame.Body, &fr.Body); err != nil {
 			return err
@@ -225,6 +231,14 @@ func (a Frame) MustMarshalAMQP() []byte {
 
 // MarshalAMQP marshals this frame into the proper format to send on an AMQP connection.
 func (a Frame) MarshalAMQP() ([]byte, error) {
+	switch body := a.Body.(type) {
+	case *ProtocolHeader:
+		// protocol headers don't have a frame header.
+		return body.MarshalAMQP()
+	case *RawFrame:
+		return a.raw, nil
+	}
+
 	buff := buffer.New(nil)
 
 	// write header
@@ -11,6 +11,12 @@ import (
 
 const HeaderSize = 8
 
+// Frame types, for [Header.FrameType]
+const (
+	FrameTypeAMQP uint8 = 0x0
+	FrameTypeSASL uint8 = 0x1
+)
+
 // Frame structure:
 //
 //     header (8 bytes)
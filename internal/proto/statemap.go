@@ -1,7 +1,9 @@
 package proto
 
 import (
+	"cmp"
 	"fmt"
+	"slices"
 
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/encoding"
 	"github.com/richardpark-msft/amqpfaultinjector/internal/proto/frames"
@@ -19,6 +21,14 @@ type StateMap struct {
 	localToRemote attachFramesByChannelAndHandle
 	remoteToLocal attachFramesByChannelAndHandle
 
+	// Channel mappings for sessions. These aren't populated until we receive the remote service's
+	// BEGIN response.
+	localToRemoteChannel channelMap
+	remoteToLocalChannel channelMap
+
+	// detached has the local channel and handle of links that have been detached, by either side.
+	detached utils.SyncMap[channelAndHandle, bool]
+
 	remoteOpenFrame *StateFrame[*frames.PerformOpen]
 	localOpenFrame  *StateFrame[*frames.PerformOpen]
 }
@@ -38,15 +48,58 @@ func (sm *StateMap) AddFrame(out bool, fr *frames.Frame) {
 	switch fr.Body.(type) {
 	case *frames.PerformOpen:
 		sm.SetOpenFrame(out, NewStateFrame[*frames.PerformOpen](fr))
+	case *frames.PerformBegin:
+		if !out {
+			sm.incomingBegin(NewStateFrame[*frames.PerformBegin](fr))
+		}
 	case *frames.PerformAttach:
 		if out {
 			sm.outboundAttach(NewStateFrame[*frames.PerformAttach](fr))
 		} else {
 			sm.incomingAttach(NewStateFrame[*frames.PerformAttach](fr))
 		}
+	case *frames.PerformDetach:
+		sm.detach(out, NewStateFrame[*frames.PerformDetach](fr))
 	}
 }
 
+// LinkState is a link, from [StateMap.Links].
+type LinkState struct {
+	// LocalAttach is the ATTACH frame we sent.
+	LocalAttach *StateFrame[*frames.PerformAttach]
+
+	// RemoteAttach is the ATTACH frame the service replied with, or nil if it hasn't replied.
+	RemoteAttach *StateFrame[*frames.PerformAttach]
+
+	// Detached is true if either side has sent a DETACH for this link.
+	Detached bool
+}
+
+// Links returns all the links we've sent an ATTACH for, sorted by channel and handle. If a handle's
+// been reused only the latest link is returned.
+func (sm *StateMap) Links() []LinkState {
+	var links []LinkState
+
+	sm.localAttach.Range(func(key channelAndHandle, localAttach *StateFrame[*frames.PerformAttach]) bool {
+		links = append(links, LinkState{
+			LocalAttach:  localAttach,
+			RemoteAttach: sm.localToRemote.Load(key),
+			Detached:     sm.detached.Load(key),
+		})
+		return true
+	})
+
+	slices.SortFunc(links, func(a, b LinkState) int {
+		if c := cmp.Compare(a.LocalAttach.Header.Channel, b.LocalAttach.Header.Channel); c != 0 {
+			return c
+		}
+
+		return cmp.Compare(a.LocalAttach.Body.Handle, b.LocalAttach.Body.Handle)
+	})
+
+	return links
+}
+
 func (sm *StateMap) GetOpenFrame(out bool) *StateFrame[*frames.PerformOpen] {
 	if out {
 		return sm.localOpenFrame
@@ -74,6 +127,19 @@ func (sm *StateMap) LookupCorrespondingAttachFrame(localToRemote bool, channel u
 	}
 }
 
+// LookupCorrespondingChannel looks up the channel that the other side of the connection uses for the same session.
+// - If localToRemote is true, pass in a local channel. The service's channel for the session is returned.
+// - If localToRemote is false, pass in a remote channel. Our channel for the session is returned.
+//
+// Returns nil if the session isn't known, or the service hasn't yet replied to our BEGIN.
+func (sm *StateMap) LookupCorrespondingChannel(localToRemote bool, channel uint16) *uint16 {
+	if localToRemote {
+		return sm.localToRemoteChannel.Load(channel)
+	} else {
+		return sm.remoteToLocalChannel.Load(channel)
+	}
+}
+
 func (sm *StateMap) LookupAttachFrame(out bool, channel uint16, handle uint32) *StateFrame[*frames.PerformAttach] {
 	if out {
 		return sm.LookupLocalAttachFrame(channel, handle)
@@ -97,7 +163,13 @@ func (sm *StateMap) outboundAttach(fr *StateFrame[*frames.PerformAttach]) {
 		LinkName: fr.Body.Name,
 	}, fr)
 
-	sm.localAttach.Store(channelAndHandle{fr.Header.Channel, fr.Body.Handle}, fr)
+	key := channelAndHandle{fr.Header.Channel, fr.Body.Handle}
+
+	sm.localAttach.Store(key, fr)
+
+	// the handle might be getting reused, for a new link.
+	sm.localToRemote.Delete(key)
+	sm.detached.Delete(key)
 }
 
 // incomingAttach handles the ATTACH frame reply, from the service.
@@ -120,6 +192,39 @@ func (sm *StateMap) incomingAttach(remoteAttachFrame *StateFrame[*frames.Perform
 	sm.remoteToLocal.Store(channelAndHandle{remoteAttachFrame.Header.Channel, remoteAttachFrame.Body.Handle}, localAttachFrame)
 }
 
+// detach handles a DETACH frame, from either side.
+func (sm *StateMap) detach(out bool, detachFrame *StateFrame[*frames.PerformDetach]) {
+	key := channelAndHandle{detachFrame.Header.Channel, detachFrame.Body.Handle}
+
+	if !out {
+		localAttachFrame := sm.remoteToLocal.Load(key)
+
+		if localAttachFrame == nil {
+			return
+		}
+
+		key = channelAndHandle{localAttachFrame.Header.Channel, localAttachFrame.Body.Handle}
+	}
+
+	sm.detached.Store(key, true)
+}
+
+// incomingBegin handles the BEGIN frame reply, from the service.
+func (sm *StateMap) incomingBegin(remoteBeginFrame *StateFrame[*frames.PerformBegin]) {
+	if remoteBeginFrame.Body.RemoteChannel == nil {
+		// this is the service starting a session, not replying to one of ours. We'll get the mapping when
+		// we send our BEGIN in response.
+		return
+	}
+
+	localChannel := *remoteBeginFrame.Body.RemoteChannel
+	remoteChannel := remoteBeginFrame.Header.Channel
+
+	sm.localToRemoteChannel.Store(localChannel, &remoteChannel)
+	sm.remoteToLocalChannel.Store(remoteChannel, &localChannel)
+}
+
+type channelMap = utils.SyncMap[uint16, *uint16]
 type attachFramesByRoleAndName = utils.SyncMap[linkAndRole, *StateFrame[*frames.PerformAttach]]
 type attachFramesByChannelAndHandle = utils.SyncMap[channelAndHandle, *StateFrame[*frames.PerformAttach]]
 
@@ -78,3 +78,78 @@ func TestStatemap(t *testing.T) {
 	clientAttachFrame := sm.LookupCorrespondingAttachFrame(false, serverSideChannel, serverSideHandle)
 	require.True(t, clientAttachFrame.Body.Properties["client-side"].(bool))
 }
+
+func TestStatemap_Channels(t *testing.T) {
+	sm := NewStateMap()
+
+	sm.AddFrame(true, &frames.Frame{
+		Header: frames.Header{Channel: clientSideChannel},
+		Body:   &frames.PerformBegin{},
+	})
+
+	// the service hasn't replied yet, so we don't know their channel.
+	require.Nil(t, sm.LookupCorrespondingChannel(true, clientSideChannel))
+
+	remoteChannel := clientSideChannel
+
+	sm.AddFrame(false, &frames.Frame{
+		Header: frames.Header{Channel: serverSideChannel},
+		Body:   &frames.PerformBegin{RemoteChannel: &remoteChannel},
+	})
+
+	require.Equal(t, serverSideChannel, *sm.LookupCorrespondingChannel(true, clientSideChannel))
+	require.Equal(t, clientSideChannel, *sm.LookupCorrespondingChannel(false, serverSideChannel))
+
+	require.Nil(t, sm.LookupCorrespondingChannel(true, serverSideChannel))
+	require.Nil(t, sm.LookupCorrespondingChannel(false, clientSideChannel))
+}
+
+func TestStatemap_Links(t *testing.T) {
+	sm := NewStateMap()
+
+	attach := func(out bool, channel uint16, handle uint32, role encoding.Role, name string) {
+		sm.AddFrame(out, &frames.Frame{
+			Header: frames.Header{Channel: channel},
+			Body:   &frames.PerformAttach{Role: role, Name: name, Handle: handle},
+		})
+	}
+
+	attach(true, clientSideChannel, clientSideHandle+1, encoding.RoleSender, "second link")
+	attach(true, clientSideChannel, clientSideHandle, encoding.RoleReceiver, "first link")
+	attach(false, serverSideChannel, serverSideHandle, encoding.RoleSender, "first link")
+
+	links := sm.Links()
+	require.Len(t, links, 2)
+
+	require.Equal(t, "first link", links[0].LocalAttach.Body.Name)
+	require.Equal(t, serverSideHandle, links[0].RemoteAttach.Body.Handle)
+	require.False(t, links[0].Detached)
+
+	// the service hasn't replied to this one.
+	require.Equal(t, "second link", links[1].LocalAttach.Body.Name)
+	require.Nil(t, links[1].RemoteAttach)
+	require.False(t, links[1].Detached)
+
+	// the service detaches the first link, and we detach the second.
+	sm.AddFrame(false, &frames.Frame{
+		Header: frames.Header{Channel: serverSideChannel},
+		Body:   &frames.PerformDetach{Handle: serverSideHandle, Closed: true},
+	})
+
+	sm.AddFrame(true, &frames.Frame{
+		Header: frames.Header{Channel: clientSideChannel},
+		Body:   &frames.PerformDetach{Handle: clientSideHandle + 1, Closed: true},
+	})
+
+	links = sm.Links()
+	require.True(t, links[0].Detached)
+	require.True(t, links[1].Detached)
+
+	// reusing the handle replaces the old link.
+	attach(true, clientSideChannel, clientSideHandle, encoding.RoleReceiver, "third link")
+
+	links = sm.Links()
+	require.Equal(t, "third link", links[0].LocalAttach.Body.Name)
+	require.Nil(t, links[0].RemoteAttach)
+	require.False(t, links[0].Detached)
+}
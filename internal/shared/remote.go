@@ -0,0 +1,53 @@
+package shared
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/utils"
+)
+
+const (
+	// AMQPPort is the default port for AMQP, without TLS.
+	AMQPPort = "5672"
+
+	// AMQPSPort is the default port for AMQP, over TLS.
+	AMQPSPort = "5671"
+)
+
+// RemoteEndpointWithPort adds the default AMQP port to endpoint, if it doesn't already have one. The
+// port is 5671 (AMQPS) unless disableTLS is true, in which case it's 5672 (AMQP).
+func RemoteEndpointWithPort(endpoint string, disableTLS bool) string {
+	if strings.Contains(endpoint, ":") {
+		return endpoint
+	}
+
+	if disableTLS {
+		return endpoint + ":" + AMQPPort
+	}
+
+	return endpoint + ":" + AMQPSPort
+}
+
+// DialRemote opens a connection to the remote AMQP endpoint. Unless disableTLS is true, the connection
+// is wrapped in a TLS client.
+//   - keyLogWriter, if non-nil, receives the TLS keys. It's unused if disableTLS is true.
+func DialRemote(endpoint string, disableTLS bool, keyLogWriter io.Writer) (net.Conn, error) {
+	conn, err := net.Dial("tcp4", endpoint)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if disableTLS {
+		return conn, nil
+	}
+
+	return tls.Client(conn, &tls.Config{
+		ServerName: utils.HostOnly(endpoint),
+		// TODO: not thread safe....
+		KeyLogWriter: keyLogWriter,
+	}), nil
+}
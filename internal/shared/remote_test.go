@@ -0,0 +1,52 @@
+package shared_test
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/shared"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemoteEndpointWithPort(t *testing.T) {
+	require.Equal(t, "localhost:5671", shared.RemoteEndpointWithPort("localhost", false))
+	require.Equal(t, "localhost:5672", shared.RemoteEndpointWithPort("localhost", true))
+
+	// explicit ports are never changed
+	require.Equal(t, "localhost:1000", shared.RemoteEndpointWithPort("localhost:1000", false))
+	require.Equal(t, "localhost:1000", shared.RemoteEndpointWithPort("localhost:1000", true))
+}
+
+func TestDialRemote(t *testing.T) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	defer listener.Close()
+
+	go func() {
+		conn, err := listener.Accept()
+
+		if err != nil {
+			return
+		}
+
+		defer conn.Close()
+		_, _ = conn.Write([]byte("AMQP\x00\x01\x00\x00"))
+	}()
+
+	conn, err := shared.DialRemote(listener.Addr().String(), true, nil)
+	require.NoError(t, err)
+
+	defer conn.Close()
+
+	// no TLS, so we just get the bytes, as-is.
+	_, isTLS := conn.(*tls.Conn)
+	require.False(t, isTLS)
+
+	preamble := make([]byte, 8)
+	_, err = io.ReadFull(conn, preamble)
+	require.NoError(t, err)
+	require.Equal(t, []byte("AMQP\x00\x01\x00\x00"), preamble)
+}
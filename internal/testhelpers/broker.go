@@ -0,0 +1,22 @@
+package testhelpers
+
+import (
+	"testing"
+	"time"
+
+	"github.com/richardpark-msft/amqpfaultinjector/internal/broker"
+	"github.com/stretchr/testify/require"
+)
+
+// NewBrokerForTest starts an in-memory [broker.Broker], listening on a random local port. The broker
+// is closed when the test completes.
+func NewBrokerForTest(t *testing.T, options *broker.BrokerOptions) *broker.Broker {
+	b := broker.NewBroker("127.0.0.1:0", options)
+
+	go func() { _ = b.ListenAndServe() }()
+
+	t.Cleanup(func() { _ = b.Close() })
+
+	require.Eventually(t, func() bool { return b.ListenAddr() != "" }, 5*time.Second, 10*time.Millisecond)
+	return b
+}
@@ -52,6 +52,13 @@ func (sm *SyncMap[KeyT, ValueT]) Load(key KeyT) ValueT {
 	return v.(ValueT)
 }
 
+// Range calls fn for each key and value in the map, until fn returns false. See [sync.Map.Range].
+func (sm *SyncMap[KeyT, ValueT]) Range(fn func(key KeyT, value ValueT) bool) {
+	sm.m.Range(func(key, value any) bool {
+		return fn(key.(KeyT), value.(ValueT))
+	})
+}
+
 func Sleep(ctx context.Context, duration time.Duration) error {
 	select {
 	case <-ctx.Done():